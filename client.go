@@ -2,9 +2,15 @@ package osquery
 
 import (
 	"context"
+	stderrors "errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/bradleyjkemp/osquery-go/gen/osquery"
+	"github.com/bradleyjkemp/osquery-go/plugin/table"
 	"github.com/bradleyjkemp/osquery-go/transport"
 	"github.com/pkg/errors"
 
@@ -12,54 +18,576 @@ import (
 )
 
 // ExtensionManagerClient is a wrapper for the osquery Thrift extensions API.
+//
+// The RPC methods honor the deadline of the context they are passed: the
+// transport timeout is shortened so that a call returns an error wrapping
+// context.DeadlineExceeded rather than blocking past the deadline. Cancelling
+// the context interrupts a call in progress and drops the connection, so that
+// osquery sees the call was abandoned. The client reconnects for the next call.
+//
+// The client is safe for concurrent use, though calls are made one at a time.
 type ExtensionManagerClient struct {
 	osquery.ExtensionManager
-	transport thrift.TTransport
+	transport    thrift.TTransport
+	timeout      time.Duration
+	retries      int
+	retryBackoff time.Duration
+	kind         transport.Kind
+	// mutex serializes calls and reconnections, as the transport can only
+	// carry one call at a time.
+	mutex sync.Mutex
+
+	// uuid is the UUID osquery assigned to the extension registered through
+	// this client, or 0 (osquery's own UUID) if there isn't one.
+	uuid      osquery.ExtensionRouteUUID
+	uuidMutex sync.Mutex
+
+	closed      bool
+	closedMutex sync.Mutex
+}
+
+// ErrClientClosed is returned by the RPC methods of a client once Close has
+// been called.
+var ErrClientClosed = errors.New("client closed")
+
+// TransportError is returned by the RPC methods of a client when the call
+// fails while communicating with osquery, such as the connection being refused
+// or dropped, or the call timing out. Retrying the call may succeed. Use
+// errors.As to distinguish it from an *ExtensionError.
+type TransportError struct {
+	Err error
+}
+
+func (e *TransportError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error, so that errors.Is matches the
+// context's error for calls which failed once their context was done.
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+// ExtensionError is returned by the client's helpers, such as QueryRows and
+// WaitUntilReady, when osquery responds with a non-zero status. The request
+// reached osquery, so retrying it will fail in the same way.
+type ExtensionError struct {
+	Code    int32
+	Message string
+}
+
+func (e *ExtensionError) Error() string {
+	return e.Message
+}
+
+// ExtensionStatus returns the status osquery responded with, so that a plugin
+// which returns the error reports the same status to osquery.
+func (e *ExtensionError) ExtensionStatus() osquery.ExtensionStatus {
+	return osquery.ExtensionStatus{Code: e.Code, Message: e.Message}
+}
+
+// extensionError returns an *ExtensionError for a non-zero status, or nil if
+// the status reports success.
+func extensionError(status *osquery.ExtensionStatus) error {
+	if status.Code == 0 {
+		return nil
+	}
+	return &ExtensionError{Code: status.Code, Message: status.Message}
+}
+
+type ClientOption func(*ExtensionManagerClient)
+
+// ClientRetries sets the number of times the idempotent RPCs (Ping,
+// Extensions, Options, Query and GetQueryColumns) are retried after failing
+// with a transport error. The first retry waits for backoff, with the wait
+// doubling for each subsequent retry. Failures reported by osquery in the
+// response status are never retried as they are deterministic.
+func ClientRetries(retries int, backoff time.Duration) ClientOption {
+	return func(c *ExtensionManagerClient) {
+		c.retries = retries
+		c.retryBackoff = backoff
+	}
+}
+
+// ClientTransport sets the kind of connection used to communicate with osquery.
+// The default, transport.Socket, is the only kind osquery supports. With
+// transport.TCP the path passed to NewClient is a host:port address.
+func ClientTransport(kind transport.Kind) ClientOption {
+	return func(c *ExtensionManagerClient) {
+		c.kind = kind
+	}
 }
 
 // NewClient creates a new client communicating to osquery over the socket at
 // the provided path. If resolving the address or connecting to the socket
 // fails, this function will error.
-func NewClient(path string, timeout time.Duration) (*ExtensionManagerClient, error) {
-	trans, err := transport.Open(path, timeout)
+func NewClient(path string, timeout time.Duration, opts ...ClientOption) (*ExtensionManagerClient, error) {
+	c := &ExtensionManagerClient{timeout: timeout}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	trans, err := transport.OpenKind(c.kind, path, timeout)
 	if err != nil {
-		return nil, err
+		return nil, &TransportError{Err: err}
+	}
+
+	c.setTransport(trans)
+	return c, nil
+}
+
+// NewClientFromTransport creates a new client communicating to osquery over
+// the provided transport, which is opened if it isn't already. This allows
+// tests to use the transports from transport.NewInMemoryTransport. The
+// ClientTransport option has no effect.
+func NewClientFromTransport(trans thrift.TTransport, timeout time.Duration, opts ...ClientOption) (*ExtensionManagerClient, error) {
+	c := &ExtensionManagerClient{timeout: timeout}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if !trans.IsOpen() {
+		if err := trans.Open(); err != nil {
+			return nil, &TransportError{Err: errors.Wrap(err, "opening transport")}
+		}
 	}
+	if socket, ok := trans.(timeoutSetter); ok {
+		if err := socket.SetSocketTimeout(timeout); err != nil {
+			trans.Close()
+			return nil, errors.Wrap(err, "setting transport timeout")
+		}
+	}
+
+	c.setTransport(trans)
+	return c, nil
+}
 
-	client := osquery.NewExtensionManagerClientFactory(
+func (c *ExtensionManagerClient) setTransport(trans thrift.TTransport) {
+	c.ExtensionManager = osquery.NewExtensionManagerClientFactory(
 		trans,
 		thrift.NewTBinaryProtocolFactoryDefault(),
 	)
-
-	return &ExtensionManagerClient{client, trans}, nil
+	c.transport = trans
 }
 
 // Close should be called to close the transport when use of the client is
-// completed.
-func (c *ExtensionManagerClient) Close() {
+// completed. Calls made after the client is closed return ErrClientClosed.
+// Closing the client more than once has no effect.
+func (c *ExtensionManagerClient) Close() error {
+	c.closedMutex.Lock()
+	defer c.closedMutex.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
 	if c.transport != nil && c.transport.IsOpen() {
+		return c.transport.Close()
+	}
+	return nil
+}
+
+func (c *ExtensionManagerClient) isClosed() bool {
+	c.closedMutex.Lock()
+	defer c.closedMutex.Unlock()
+	return c.closed
+}
+
+// timeoutSetter is implemented by transports whose read and write timeout can
+// be changed between calls, such as thrift.TSocket.
+type timeoutSetter interface {
+	SetSocketTimeout(timeout time.Duration) error
+}
+
+// connTransport is implemented by transports with an underlying network
+// connection, such as thrift.TSocket.
+type connTransport interface {
+	Conn() net.Conn
+}
+
+// withContext runs the RPC in fn with the transport timeout bounded by the
+// deadline of ctx, interrupting the RPC if ctx is done before it completes.
+// Errors communicating with osquery are returned as a *TransportError.
+func (c *ExtensionManagerClient) withContext(ctx context.Context, fn func() error) error {
+	if c.isClosed() {
+		return ErrClientClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	deadline, hasDeadline := ctx.Deadline()
+	socket, canSetTimeout := c.transport.(timeoutSetter)
+	if hasDeadline && canSetTimeout {
+		timeout := time.Until(deadline)
+		if c.timeout > 0 && c.timeout < timeout {
+			timeout = c.timeout
+		}
+		if err := socket.SetSocketTimeout(timeout); err != nil {
+			return errors.Wrap(err, "setting transport timeout")
+		}
+		defer socket.SetSocketTimeout(c.timeout)
+	}
+
+	stop := c.interruptOnDone(ctx)
+	err := fn()
+	if stop() {
+		// The interrupted call may have left part of a message on the
+		// connection, and closing it tells osquery the call was
+		// abandoned.
+		c.reopen()
+	}
+	if err == nil {
+		return nil
+	}
+	transportErr := isTransportError(err)
+	ctxErr := ctx.Err()
+	if ctxErr == nil && hasDeadline && !time.Now().Before(deadline) {
+		// The transport timeout can expire before the context's own
+		// timer has marked it done.
+		ctxErr = context.DeadlineExceeded
+	}
+	if ctxErr != nil {
+		err = fmt.Errorf("%w: %v", ctxErr, err)
+	}
+	if transportErr {
+		return &TransportError{Err: err}
+	}
+	return err
+}
+
+// interruptOnDone interrupts any read or write on the transport's connection
+// once ctx is done. The returned function must be called when the RPC
+// completes, and reports whether the connection was interrupted.
+func (c *ExtensionManagerClient) interruptOnDone(ctx context.Context) (stop func() bool) {
+	socket, ok := c.transport.(connTransport)
+	if !ok || ctx.Done() == nil {
+		return func() bool { return false }
+	}
+	conn := socket.Conn()
+	if conn == nil {
+		return func() bool { return false }
+	}
+
+	finished := make(chan struct{})
+	interrupted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// A deadline in the past makes blocked reads and writes
+			// fail immediately.
+			conn.SetDeadline(time.Unix(1, 0))
+			interrupted <- true
+		case <-finished:
+			interrupted <- false
+		}
+	}()
+	return func() bool {
+		close(finished)
+		return <-interrupted
+	}
+}
+
+// withRetries runs an idempotent RPC in fn, retrying transport errors with
+// exponential backoff as configured by ClientRetries.
+func (c *ExtensionManagerClient) withRetries(ctx context.Context, fn func() error) error {
+	backoff := c.retryBackoff
+	for attempt := 0; ; attempt++ {
+		err := c.withContext(ctx, fn)
+		if err == nil || attempt >= c.retries || !isTransportError(err) || ctx.Err() != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return &TransportError{Err: fmt.Errorf("%w: %v", ctx.Err(), err)}
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+
+		c.reconnect()
+	}
+}
+
+// reconnect closes and reopens the transport after a failed call, as the call
+// can leave a partial message on the connection. If reopening fails then the
+// next call will report it.
+func (c *ExtensionManagerClient) reconnect() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.reopen()
+}
+
+// reopen closes and reopens the transport, unless the client has been closed.
+// The caller must hold c.mutex.
+func (c *ExtensionManagerClient) reopen() {
+	c.closedMutex.Lock()
+	defer c.closedMutex.Unlock()
+	if c.transport != nil && !c.closed {
 		c.transport.Close()
+		c.transport.Open()
+	}
+}
+
+// isTransportError reports whether the error from an RPC was caused by
+// communicating with osquery, rather than osquery rejecting the request or the
+// client being closed.
+func isTransportError(err error) bool {
+	if err == ErrClientClosed {
+		return false
+	}
+	var extensionErr *ExtensionError
+	if stderrors.As(err, &extensionErr) {
+		return false
+	}
+	_, isApplicationError := err.(thrift.TApplicationException)
+	return !isApplicationError
+}
+
+// Ping requests metadata from the extension manager.
+func (c *ExtensionManagerClient) Ping(ctx context.Context) (r *osquery.ExtensionStatus, err error) {
+	err = c.withRetries(ctx, func() error {
+		r, err = c.ExtensionManager.Ping(ctx)
+		return err
+	})
+	return r, err
+}
+
+// readyPollInterval is the delay between pings in WaitUntilReady.
+const readyPollInterval = 200 * time.Millisecond
+
+// WaitUntilReady pings osquery until it responds successfully, so that startup
+// code can block until the connection is usable. If the context is done first,
+// the error from the last ping is returned, wrapping a *TransportError or an
+// *ExtensionError.
+func (c *ExtensionManagerClient) WaitUntilReady(ctx context.Context) error {
+	for {
+		status, err := c.Ping(ctx)
+		if err == nil && status.Code == 0 {
+			return nil
+		}
+		if err == ErrClientClosed {
+			return err
+		}
+		if err == nil {
+			err = fmt.Errorf("ping returned status %d: %w", status.Code, extensionError(status))
+		} else if isTransportError(err) {
+			c.reconnect()
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(readyPollInterval):
+		}
+	}
+}
+
+// Call requests a call to an extension (or core) registry plugin.
+func (c *ExtensionManagerClient) Call(ctx context.Context, registry string, item string, request osquery.ExtensionPluginRequest) (r *osquery.ExtensionResponse, err error) {
+	err = c.withContext(ctx, func() error {
+		r, err = c.ExtensionManager.Call(ctx, registry, item, request)
+		return err
+	})
+	return r, err
+}
+
+// Extensions requests the list of active registered extensions.
+func (c *ExtensionManagerClient) Extensions(ctx context.Context) (r osquery.InternalExtensionList, err error) {
+	err = c.withRetries(ctx, func() error {
+		r, err = c.ExtensionManager.Extensions(ctx)
+		return err
+	})
+	return r, err
+}
+
+// Options requests the list of bootstrap or configuration options.
+func (c *ExtensionManagerClient) Options(ctx context.Context) (r osquery.InternalOptionList, err error) {
+	err = c.withRetries(ctx, func() error {
+		r, err = c.ExtensionManager.Options(ctx)
+		return err
+	})
+	return r, err
+}
+
+// RegisterExtension registers the extension plugins with the osquery process.
+// If registration succeeds, the UUID osquery assigned to the extension is
+// available from ExtensionUUID.
+func (c *ExtensionManagerClient) RegisterExtension(ctx context.Context, info *osquery.InternalExtensionInfo, registry osquery.ExtensionRegistry) (r *osquery.ExtensionStatus, err error) {
+	err = c.withContext(ctx, func() error {
+		r, err = c.ExtensionManager.RegisterExtension(ctx, info, registry)
+		return err
+	})
+	if err == nil && r != nil && r.Code == 0 {
+		c.uuidMutex.Lock()
+		c.uuid = r.UUID
+		c.uuidMutex.Unlock()
+	}
+	return r, err
+}
+
+// DeregisterExtension de-registers the extension plugins with the osquery
+// process.
+func (c *ExtensionManagerClient) DeregisterExtension(ctx context.Context, uuid osquery.ExtensionRouteUUID) (r *osquery.ExtensionStatus, err error) {
+	err = c.withContext(ctx, func() error {
+		r, err = c.ExtensionManager.DeregisterExtension(ctx, uuid)
+		return err
+	})
+	if err == nil && r != nil && r.Code == 0 {
+		c.uuidMutex.Lock()
+		if c.uuid == uuid {
+			c.uuid = 0
+		}
+		c.uuidMutex.Unlock()
+	}
+	return r, err
+}
+
+// ExtensionUUID returns the UUID osquery assigned to the extension registered
+// through this client. It returns false if no extension is registered.
+func (c *ExtensionManagerClient) ExtensionUUID() (osquery.ExtensionRouteUUID, bool) {
+	c.uuidMutex.Lock()
+	defer c.uuidMutex.Unlock()
+	return c.uuid, c.uuid != coreExtensionUUID
+}
+
+// Query requests a query to be run and returns the extension response.
+// Consider using the QueryRow or QueryRows helpers for a more friendly
+// interface.
+func (c *ExtensionManagerClient) Query(ctx context.Context, sql string) (r *osquery.ExtensionResponse, err error) {
+	err = c.withRetries(ctx, func() error {
+		r, err = c.ExtensionManager.Query(ctx, sql)
+		return err
+	})
+	return r, err
+}
+
+// GetQueryColumns requests the columns returned by the parsed query.
+func (c *ExtensionManagerClient) GetQueryColumns(ctx context.Context, sql string) (r *osquery.ExtensionResponse, err error) {
+	err = c.withRetries(ctx, func() error {
+		r, err = c.ExtensionManager.GetQueryColumns(ctx, sql)
+		return err
+	})
+	return r, err
+}
+
+// ServerVersion returns the version of the osquery process the client is
+// connected to. osquery reports itself as the "core" extension in the list of
+// registered extensions.
+func (c *ExtensionManagerClient) ServerVersion(ctx context.Context) (string, error) {
+	extensions, err := c.Extensions(ctx)
+	if err != nil {
+		return "", fmt.Errorf("listing extensions: %w", err)
+	}
+	core, ok := extensions[coreExtensionUUID]
+	if !ok || core == nil || core.Version == "" {
+		return "", errors.New("osquery core missing from extension list")
 	}
+	return core.Version, nil
 }
 
+// coreExtensionUUID is the UUID osquery lists itself under in the extension
+// list.
+const coreExtensionUUID osquery.ExtensionRouteUUID = 0
+
 // QueryRows is a helper that executes the requested query and returns the
 // results. It handles checking both the transport level errors and the osquery
-// internal errors by returning a normal Go error type.
+// internal errors by returning a normal Go error type, which wraps a
+// *TransportError or an *ExtensionError respectively.
 func (c *ExtensionManagerClient) QueryRows(ctx context.Context, sql string) ([]map[string]string, error) {
 	res, err := c.Query(ctx, sql)
 	if err != nil {
-		return nil, errors.Wrap(err, "transport error in query")
+		return nil, fmt.Errorf("transport error in query: %w", err)
 	}
 	if res.Status == nil {
 		return nil, errors.New("query returned nil status")
 	}
-	if res.Status.Code != 0 {
-		return nil, errors.Errorf("query returned error: %s", res.Status.Message)
+	if err := extensionError(res.Status); err != nil {
+		return nil, fmt.Errorf("query returned error: %w", err)
 	}
 	return res.Response, nil
 
 }
 
+// Tables returns the names of the tables currently registered with osquery,
+// including those of extensions, in alphabetical order.
+func (c *ExtensionManagerClient) Tables(ctx context.Context) ([]string, error) {
+	rows, err := c.QueryRows(ctx, "select name from osquery_registry where registry = 'table' and active = 1 order by name")
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(rows))
+	for _, row := range rows {
+		names = append(names, row["name"])
+	}
+	return names, nil
+}
+
+// TableColumns returns the name and type of each column of the named table,
+// in the order that osquery lists them. These are the columns returned by
+// "select *", so hidden columns, such as those only used to constrain a query,
+// are left out.
+func (c *ExtensionManagerClient) TableColumns(ctx context.Context, name string) ([]table.ColumnDefinition, error) {
+	if !validTableName(name) {
+		return nil, errors.Errorf("invalid table name %q", name)
+	}
+	res, err := c.GetQueryColumns(ctx, "select * from "+name)
+	if err != nil {
+		return nil, fmt.Errorf("transport error getting columns: %w", err)
+	}
+	if res.Status == nil {
+		return nil, errors.New("getting columns returned nil status")
+	}
+	if err := extensionError(res.Status); err != nil {
+		return nil, fmt.Errorf("getting columns of table %s: %w", name, err)
+	}
+
+	columns := make([]table.ColumnDefinition, 0, len(res.Response))
+	for _, row := range res.Response {
+		// Each row maps a single column name to its type.
+		for column, columnType := range row {
+			columns = append(columns, table.ColumnDefinition{Name: column, Type: normalizeColumnType(columnType)})
+		}
+	}
+	return columns, nil
+}
+
+// normalizeColumnType converts a column type as osquery reports it, such as
+// "UNSIGNED BIGINT", to the equivalent table.ColumnType.
+func normalizeColumnType(columnType string) table.ColumnType {
+	return table.ColumnType(strings.Replace(strings.ToUpper(columnType), " ", "_", -1))
+}
+
+// validTableName reports whether name can be used as a table name in a query
+// without quoting. osquery table names are made up of letters, digits and
+// underscores.
+func validTableName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// QueryInto executes the requested query like QueryRows, and decodes the rows
+// into dest, which must be a pointer to a slice of structs. The struct fields
+// use the same `column` tags as table row definitions, and are converted from
+// the string values in the results. See table.DecodeRows.
+func (c *ExtensionManagerClient) QueryInto(ctx context.Context, sql string, dest interface{}) error {
+	rows, err := c.QueryRows(ctx, sql)
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(table.DecodeRows(rows, dest), "decoding query results")
+}
+
 // QueryRow behaves similarly to QueryRows, but it returns an error if the
 // query does not return exactly one row.
 func (c *ExtensionManagerClient) QueryRow(ctx context.Context, sql string) (map[string]string, error) {
@@ -3,13 +3,61 @@ package osquery
 import (
 	"context"
 	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/apache/thrift/lib/go/thrift"
 	"github.com/bradleyjkemp/osquery-go/gen/osquery"
 	"github.com/bradleyjkemp/osquery-go/mock"
+	"github.com/bradleyjkemp/osquery-go/plugin/table"
+	"github.com/bradleyjkemp/osquery-go/transport"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
+func TestQueryInto(t *testing.T) {
+	mock := &mock.ExtensionManager{
+		QueryFunc: func(ctx context.Context, sql string) (*osquery.ExtensionResponse, error) {
+			return &osquery.ExtensionResponse{
+				Status: &osquery.ExtensionStatus{Code: 0, Message: "OK"},
+				Response: []map[string]string{
+					{"pid": "1", "name": "launchd"},
+					{"pid": "42", "name": "osqueryd"},
+				},
+			}, nil
+		},
+	}
+	client := &ExtensionManagerClient{ExtensionManager: mock}
+
+	type process struct {
+		PID  int    `column:"pid"`
+		Name string `column:"name"`
+	}
+	var processes []process
+	require.NoError(t, client.QueryInto(context.Background(), "select pid, name from processes", &processes))
+	assert.Equal(t, []process{{1, "launchd"}, {42, "osqueryd"}}, processes)
+
+	var invalid []struct {
+		PID bool `column:"pid"`
+	}
+	err := client.QueryInto(context.Background(), "select pid, name from processes", &invalid)
+	assert.EqualError(t, err, `decoding query results: row 1: column pid: strconv.ParseBool: parsing "42": invalid syntax`)
+
+	mock.QueryFunc = func(ctx context.Context, sql string) (*osquery.ExtensionResponse, error) {
+		return &osquery.ExtensionResponse{
+			Status: &osquery.ExtensionStatus{Code: 1, Message: "bad query"},
+		}, nil
+	}
+	err = client.QueryInto(context.Background(), "select bad query", &processes)
+	assert.EqualError(t, err, "query returned error: bad query")
+}
+
 func TestQueryRows(t *testing.T) {
 	mock := &mock.ExtensionManager{}
 	client := &ExtensionManagerClient{ExtensionManager: mock}
@@ -77,3 +125,475 @@ func TestQueryRows(t *testing.T) {
 	row, err = client.QueryRow(context.Background(), "select 1 union select 2")
 	assert.NotNil(t, err)
 }
+
+type mockTimeoutTransport struct {
+	thrift.TTransport
+	timeouts []time.Duration
+}
+
+func (m *mockTimeoutTransport) SetSocketTimeout(timeout time.Duration) error {
+	m.timeouts = append(m.timeouts, timeout)
+	return nil
+}
+
+func TestClientContextDeadline(t *testing.T) {
+	mock := &mock.ExtensionManager{}
+	trans := &mockTimeoutTransport{}
+	client := &ExtensionManagerClient{ExtensionManager: mock, transport: trans, timeout: 5 * time.Second}
+
+	mock.QueryFunc = func(ctx context.Context, sql string) (*osquery.ExtensionResponse, error) {
+		return &osquery.ExtensionResponse{Status: &osquery.ExtensionStatus{}}, nil
+	}
+
+	// No deadline leaves the transport timeout alone
+	_, err := client.Query(context.Background(), "select 1")
+	assert.Nil(t, err)
+	assert.Empty(t, trans.timeouts)
+
+	// A distant deadline is bounded by the client timeout
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	_, err = client.Query(ctx, "select 1")
+	assert.Nil(t, err)
+	assert.Equal(t, []time.Duration{5 * time.Second, 5 * time.Second}, trans.timeouts)
+
+	// A close deadline shortens the transport timeout for the call
+	trans.timeouts = nil
+	mock.QueryFunc = func(ctx context.Context, sql string) (*osquery.ExtensionResponse, error) {
+		<-ctx.Done()
+		return nil, errors.New("i/o timeout")
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = client.Query(ctx, "select 1")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	if assert.Len(t, trans.timeouts, 2) {
+		assert.True(t, trans.timeouts[0] <= 50*time.Millisecond)
+		assert.Equal(t, 5*time.Second, trans.timeouts[1])
+	}
+
+	// An expired context fails without making the call
+	mock.QueryFuncInvoked = false
+	_, err = client.Query(ctx, "select 1")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.False(t, mock.QueryFuncInvoked)
+}
+
+func TestClientContextDeadlineSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "osquery-go-client")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	sockPath := filepath.Join(dir, "osquery.em")
+
+	// osquery accepts the connection but never responds
+	listener, err := net.Listen("unix", sockPath)
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			ioutil.ReadAll(conn)
+		}
+	}()
+
+	client, err := NewClient(sockPath, 5*time.Second)
+	require.NoError(t, err)
+	defer client.Close()
+	_, ok := client.transport.(timeoutSetter)
+	assert.True(t, ok, "the socket's timeout should be settable")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = client.Query(ctx, "select 1")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+// mockConnTransport is a transport over one end of a pipe, recording when it is
+// reopened.
+type mockConnTransport struct {
+	thrift.TTransport
+	conn   net.Conn
+	closed bool
+	opened int
+}
+
+func (m *mockConnTransport) Conn() net.Conn { return m.conn }
+
+func (m *mockConnTransport) Close() error {
+	m.closed = true
+	return m.conn.Close()
+}
+
+func (m *mockConnTransport) Open() error {
+	m.opened++
+	return nil
+}
+
+func TestClientContextCancel(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	mock := &mock.ExtensionManager{}
+	trans := &mockConnTransport{conn: clientConn}
+	client := &ExtensionManagerClient{ExtensionManager: mock, transport: trans}
+
+	// The call blocks reading a response which never comes
+	mock.QueryFunc = func(ctx context.Context, sql string) (*osquery.ExtensionResponse, error) {
+		_, err := clientConn.Read(make([]byte, 1))
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	_, err := client.Query(ctx, "select 1")
+	assert.True(t, errors.Is(err, context.Canceled))
+
+	// The connection is dropped, so that osquery sees the call was abandoned,
+	// and then reopened for the next call
+	assert.True(t, trans.closed)
+	assert.Equal(t, 1, trans.opened)
+	_, err = serverConn.Read(make([]byte, 1))
+	assert.Error(t, err)
+
+	// Calls which complete aren't interrupted
+	trans.closed = false
+	mock.QueryFunc = func(ctx context.Context, sql string) (*osquery.ExtensionResponse, error) {
+		return &osquery.ExtensionResponse{Status: &osquery.ExtensionStatus{}}, nil
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	_, err = client.Query(ctx, "select 1")
+	assert.NoError(t, err)
+	assert.False(t, trans.closed)
+}
+
+func TestClientTCP(t *testing.T) {
+	mock := &mock.ExtensionManager{
+		PingFunc: func(ctx context.Context) (*osquery.ExtensionStatus, error) {
+			return &osquery.ExtensionStatus{Code: 0, Message: "OK"}, nil
+		},
+	}
+	trans, err := transport.OpenServerKind(transport.TCP, "127.0.0.1:0", time.Second)
+	require.NoError(t, err)
+	require.NoError(t, trans.Listen())
+	server := thrift.NewTSimpleServer2(osquery.NewExtensionManagerProcessor(mock), trans)
+	go server.Serve()
+	defer server.Stop()
+
+	addr := trans.(*thrift.TServerSocket).Addr().String()
+	client, err := NewClient(addr, time.Second, ClientTransport(transport.TCP))
+	require.NoError(t, err)
+	defer client.Close()
+
+	status, err := client.Ping(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "OK", status.Message)
+}
+
+func TestServerVersion(t *testing.T) {
+	mock := &mock.ExtensionManager{}
+	client := &ExtensionManagerClient{ExtensionManager: mock}
+
+	mock.ExtensionsFunc = func(ctx context.Context) (osquery.InternalExtensionList, error) {
+		return osquery.InternalExtensionList{
+			0:   {Name: "core", Version: "4.4.0", SdkVersion: "0.0.0"},
+			123: {Name: "example", Version: "1.0.0"},
+		}, nil
+	}
+	version, err := client.ServerVersion(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "4.4.0", version)
+
+	mock.ExtensionsFunc = func(ctx context.Context) (osquery.InternalExtensionList, error) {
+		return osquery.InternalExtensionList{123: {Name: "example", Version: "1.0.0"}}, nil
+	}
+	_, err = client.ServerVersion(context.Background())
+	assert.Error(t, err)
+
+	mock.ExtensionsFunc = func(ctx context.Context) (osquery.InternalExtensionList, error) {
+		return nil, errors.New("boom")
+	}
+	_, err = client.ServerVersion(context.Background())
+	assert.EqualError(t, err, "listing extensions: boom")
+}
+
+func TestExtensionUUID(t *testing.T) {
+	mock := &mock.ExtensionManager{}
+	client := &ExtensionManagerClient{ExtensionManager: mock}
+
+	_, ok := client.ExtensionUUID()
+	assert.False(t, ok)
+
+	// Failed registrations don't set the UUID
+	mock.RegisterExtensionFunc = func(ctx context.Context, info *osquery.InternalExtensionInfo, registry osquery.ExtensionRegistry) (*osquery.ExtensionStatus, error) {
+		return &osquery.ExtensionStatus{Code: 1, Message: "duplicate"}, nil
+	}
+	_, err := client.RegisterExtension(context.Background(), &osquery.InternalExtensionInfo{Name: "example"}, osquery.ExtensionRegistry{})
+	assert.NoError(t, err)
+	_, ok = client.ExtensionUUID()
+	assert.False(t, ok)
+
+	mock.RegisterExtensionFunc = func(ctx context.Context, info *osquery.InternalExtensionInfo, registry osquery.ExtensionRegistry) (*osquery.ExtensionStatus, error) {
+		return &osquery.ExtensionStatus{Code: 0, Message: "OK", UUID: 123}, nil
+	}
+	_, err = client.RegisterExtension(context.Background(), &osquery.InternalExtensionInfo{Name: "example"}, osquery.ExtensionRegistry{})
+	assert.NoError(t, err)
+	uuid, ok := client.ExtensionUUID()
+	assert.True(t, ok)
+	assert.Equal(t, osquery.ExtensionRouteUUID(123), uuid)
+
+	mock.DeregisterExtensionFunc = func(ctx context.Context, uuid osquery.ExtensionRouteUUID) (*osquery.ExtensionStatus, error) {
+		return &osquery.ExtensionStatus{Code: 0, Message: "OK"}, nil
+	}
+	_, err = client.DeregisterExtension(context.Background(), 123)
+	assert.NoError(t, err)
+	_, ok = client.ExtensionUUID()
+	assert.False(t, ok)
+}
+
+func TestClientClose(t *testing.T) {
+	trans, server := transport.NewInMemoryTransport()
+	require.NoError(t, server.Listen())
+	defer server.Close()
+
+	client, err := NewClientFromTransport(trans, time.Second, ClientRetries(3, time.Hour))
+	require.NoError(t, err)
+	require.NoError(t, client.Close())
+	assert.False(t, trans.IsOpen())
+
+	// Calls fail straight away, without retrying or reconnecting
+	_, err = client.Ping(context.Background())
+	assert.Equal(t, ErrClientClosed, err)
+	_, err = client.Query(context.Background(), "select 1")
+	assert.Equal(t, ErrClientClosed, err)
+	assert.Equal(t, ErrClientClosed, client.WaitUntilReady(context.Background()))
+	assert.False(t, trans.IsOpen())
+
+	assert.NoError(t, client.Close())
+}
+
+type mockReopenTransport struct {
+	thrift.TTransport
+	opened int
+}
+
+func (m *mockReopenTransport) Close() error { return nil }
+func (m *mockReopenTransport) Open() error {
+	m.opened++
+	return nil
+}
+
+func TestClientReconnectConcurrent(t *testing.T) {
+	mock := &mock.ExtensionManager{}
+	trans := &mockReopenTransport{}
+	client := &ExtensionManagerClient{ExtensionManager: mock, transport: trans}
+
+	// Calls use the transport which reconnecting reopens, so they mustn't
+	// overlap
+	mock.QueryFunc = func(ctx context.Context, sql string) (*osquery.ExtensionResponse, error) {
+		return &osquery.ExtensionResponse{
+			Status:   &osquery.ExtensionStatus{Code: 0},
+			Response: []map[string]string{{"opened": strconv.Itoa(trans.opened)}},
+		}, nil
+	}
+
+	var wait sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wait.Add(2)
+		go func() {
+			defer wait.Done()
+			_, err := client.Query(context.Background(), "select 1")
+			assert.NoError(t, err)
+		}()
+		go func() {
+			defer wait.Done()
+			client.reconnect()
+		}()
+	}
+	wait.Wait()
+	assert.Equal(t, 10, trans.opened)
+}
+
+func TestClientRetries(t *testing.T) {
+	mock := &mock.ExtensionManager{}
+	trans := &mockReopenTransport{}
+	client := &ExtensionManagerClient{ExtensionManager: mock, transport: trans}
+	ClientRetries(2, time.Millisecond)(client)
+
+	// Transport errors are retried until the call succeeds
+	calls := 0
+	mock.QueryFunc = func(ctx context.Context, sql string) (*osquery.ExtensionResponse, error) {
+		calls++
+		if calls < 3 {
+			return nil, thrift.NewTTransportException(thrift.END_OF_FILE, "EOF")
+		}
+		return &osquery.ExtensionResponse{Status: &osquery.ExtensionStatus{Code: 0}}, nil
+	}
+	_, err := client.Query(context.Background(), "select 1")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, 2, trans.opened)
+
+	// Or the retries run out
+	calls = 0
+	mock.GetQueryColumnsFunc = func(ctx context.Context, sql string) (*osquery.ExtensionResponse, error) {
+		calls++
+		return nil, errors.New("broken pipe")
+	}
+	_, err = client.GetQueryColumns(context.Background(), "select 1")
+	assert.EqualError(t, err, "broken pipe")
+	assert.Equal(t, 3, calls)
+
+	// Application errors are not retried
+	calls = 0
+	mock.QueryFunc = func(ctx context.Context, sql string) (*osquery.ExtensionResponse, error) {
+		calls++
+		return nil, thrift.NewTApplicationException(thrift.UNKNOWN_METHOD, "unknown method")
+	}
+	_, err = client.Query(context.Background(), "select 1")
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls)
+
+	calls = 0
+	mock.QueryFunc = func(ctx context.Context, sql string) (*osquery.ExtensionResponse, error) {
+		calls++
+		return &osquery.ExtensionResponse{Status: &osquery.ExtensionStatus{Code: 1, Message: "no such table"}}, nil
+	}
+	_, err = client.QueryRows(context.Background(), "select * from foo")
+	assert.EqualError(t, err, "query returned error: no such table")
+	assert.Equal(t, 1, calls)
+
+	// Calls may not be idempotent so are never retried
+	calls = 0
+	mock.CallFunc = func(ctx context.Context, registry string, item string, req osquery.ExtensionPluginRequest) (*osquery.ExtensionResponse, error) {
+		calls++
+		return nil, errors.New("broken pipe")
+	}
+	_, err = client.Call(context.Background(), "table", "foo", osquery.ExtensionPluginRequest{})
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls)
+}
+
+func TestClientErrorTypes(t *testing.T) {
+	mock := &mock.ExtensionManager{}
+	trans := &mockReopenTransport{}
+	client := &ExtensionManagerClient{ExtensionManager: mock, transport: trans}
+
+	// Failures communicating with osquery are transport errors
+	mock.QueryFunc = func(ctx context.Context, sql string) (*osquery.ExtensionResponse, error) {
+		return nil, thrift.NewTTransportException(thrift.END_OF_FILE, "EOF")
+	}
+	_, err := client.QueryRows(context.Background(), "select 1")
+	var transportErr *TransportError
+	require.True(t, errors.As(err, &transportErr))
+	assert.EqualError(t, transportErr, "EOF")
+	assert.EqualError(t, err, "transport error in query: EOF")
+	var extensionErr *ExtensionError
+	assert.False(t, errors.As(err, &extensionErr))
+
+	// A non-zero status from osquery is an extension error
+	mock.QueryFunc = func(ctx context.Context, sql string) (*osquery.ExtensionResponse, error) {
+		return &osquery.ExtensionResponse{Status: &osquery.ExtensionStatus{Code: 2, Message: "no such table"}}, nil
+	}
+	_, err = client.QueryRows(context.Background(), "select * from foo")
+	require.True(t, errors.As(err, &extensionErr))
+	assert.Equal(t, &ExtensionError{Code: 2, Message: "no such table"}, extensionErr)
+	assert.False(t, errors.As(err, &transportErr))
+	assert.Equal(t, osquery.ExtensionStatus{Code: 2, Message: "no such table"}, *errorStatus(err))
+
+	// Application exceptions are neither
+	mock.QueryFunc = func(ctx context.Context, sql string) (*osquery.ExtensionResponse, error) {
+		return nil, thrift.NewTApplicationException(thrift.UNKNOWN_METHOD, "unknown method")
+	}
+	_, err = client.Query(context.Background(), "select 1")
+	assert.False(t, errors.As(err, &transportErr))
+	assert.False(t, errors.As(err, &extensionErr))
+
+	// Interrupted calls are transport errors wrapping the context's error
+	mock.QueryFunc = func(ctx context.Context, sql string) (*osquery.ExtensionResponse, error) {
+		<-ctx.Done()
+		return nil, errors.New("i/o timeout")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = client.Query(ctx, "select 1")
+	assert.True(t, errors.As(err, &transportErr))
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+}
+
+func TestClientTables(t *testing.T) {
+	mock := &mock.ExtensionManager{
+		QueryFunc: func(ctx context.Context, sql string) (*osquery.ExtensionResponse, error) {
+			assert.Equal(t, "select name from osquery_registry where registry = 'table' and active = 1 order by name", sql)
+			return &osquery.ExtensionResponse{
+				Status:   &osquery.ExtensionStatus{Code: 0, Message: "OK"},
+				Response: []map[string]string{{"name": "foobar"}, {"name": "processes"}},
+			}, nil
+		},
+		GetQueryColumnsFunc: func(ctx context.Context, sql string) (*osquery.ExtensionResponse, error) {
+			if sql != "select * from processes" {
+				return &osquery.ExtensionResponse{Status: &osquery.ExtensionStatus{Code: 1, Message: "no such table"}}, nil
+			}
+			return &osquery.ExtensionResponse{
+				Status:   &osquery.ExtensionStatus{Code: 0, Message: "OK"},
+				Response: []map[string]string{{"pid": "BIGINT"}, {"name": "TEXT"}, {"start_time": "UNSIGNED BIGINT"}},
+			}, nil
+		},
+	}
+	client := &ExtensionManagerClient{ExtensionManager: mock}
+
+	tables, err := client.Tables(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"foobar", "processes"}, tables)
+
+	columns, err := client.TableColumns(context.Background(), "processes")
+	require.NoError(t, err)
+	assert.Equal(t, []table.ColumnDefinition{
+		{Name: "pid", Type: table.ColumnTypeBigInt},
+		{Name: "name", Type: table.ColumnTypeText},
+		{Name: "start_time", Type: table.ColumnTypeUnsignedBigInt},
+	}, columns)
+
+	_, err = client.TableColumns(context.Background(), "missing")
+	assert.EqualError(t, err, "getting columns of table missing: no such table")
+	var extensionErr *ExtensionError
+	assert.True(t, errors.As(err, &extensionErr))
+
+	mock.GetQueryColumnsFuncInvoked = false
+	_, err = client.TableColumns(context.Background(), "processes; drop table x")
+	assert.EqualError(t, err, `invalid table name "processes; drop table x"`)
+	assert.False(t, mock.GetQueryColumnsFuncInvoked)
+}
+
+func TestWaitUntilReady(t *testing.T) {
+	mock := &mock.ExtensionManager{}
+	trans := &mockReopenTransport{}
+	client := &ExtensionManagerClient{ExtensionManager: mock, transport: trans}
+
+	pings := 0
+	mock.PingFunc = func(ctx context.Context) (*osquery.ExtensionStatus, error) {
+		pings++
+		switch pings {
+		case 1:
+			return nil, thrift.NewTTransportException(thrift.END_OF_FILE, "EOF")
+		case 2:
+			return &osquery.ExtensionStatus{Code: 1, Message: "starting"}, nil
+		default:
+			return &osquery.ExtensionStatus{Code: 0, Message: "OK"}, nil
+		}
+	}
+	assert.NoError(t, client.WaitUntilReady(context.Background()))
+	assert.Equal(t, 3, pings)
+	assert.Equal(t, 1, trans.opened)
+
+	// The last error is returned once the context is done
+	mock.PingFunc = func(ctx context.Context) (*osquery.ExtensionStatus, error) {
+		return &osquery.ExtensionStatus{Code: 1, Message: "starting"}, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := client.WaitUntilReady(ctx)
+	assert.EqualError(t, err, "ping returned status 1: starting")
+}
@@ -0,0 +1,108 @@
+package osquery
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/apache/thrift/lib/go/thrift"
+	"github.com/pkg/errors"
+)
+
+// deadlineServerTransport wraps the connections accepted by a server transport
+// so that each read and write on them must complete within a timeout.
+type deadlineServerTransport struct {
+	thrift.TServerTransport
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	// socketTimeout is the timeout the server transport sets on the
+	// connections it accepts, which still applies to reads or writes
+	// without a timeout of their own.
+	socketTimeout time.Duration
+	// onTimeout is called with the error once a connection is closed
+	// after timing out.
+	onTimeout func(error)
+}
+
+// Accept returns the next connection. Connections from transports without an
+// underlying network connection are returned as is, as their deadlines can't
+// be set.
+func (t *deadlineServerTransport) Accept() (thrift.TTransport, error) {
+	trans, err := t.TServerTransport.Accept()
+	if err != nil {
+		return nil, err
+	}
+	socket, ok := trans.(connTransport)
+	if !ok || socket.Conn() == nil {
+		return trans, nil
+	}
+	return &deadlineTransport{
+		TTransport: trans,
+		conn:       socket.Conn(),
+		server:     t,
+	}, nil
+}
+
+// timeout returns the timeout for a read or write, falling back to the socket
+// timeout if the operation doesn't have one.
+func (t *deadlineServerTransport) timeout(timeout time.Duration) time.Duration {
+	if timeout > 0 {
+		return timeout
+	}
+	return t.socketTimeout
+}
+
+// deadlineTransport reads and writes the connection of an accepted transport
+// directly, setting the deadline before each operation, as the transport would
+// otherwise replace the deadline with its own.
+type deadlineTransport struct {
+	thrift.TTransport
+	conn   net.Conn
+	server *deadlineServerTransport
+}
+
+func (t *deadlineTransport) Read(buf []byte) (int, error) {
+	timeout := t.server.timeout(t.server.readTimeout)
+	if timeout > 0 {
+		t.conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+	n, err := t.conn.Read(buf)
+	if isTimeout(err) {
+		t.closeAfterTimeout(errors.Wrapf(err, "closing connection after %s read timeout", timeout))
+	}
+	return n, thrift.NewTTransportExceptionFromError(err)
+}
+
+func (t *deadlineTransport) Write(buf []byte) (int, error) {
+	// A pipe, as used by transport.NewInMemoryTransport, passes empty
+	// writes to the reader as empty reads.
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	timeout := t.server.timeout(t.server.writeTimeout)
+	if timeout > 0 {
+		t.conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	n, err := t.conn.Write(buf)
+	if isTimeout(err) {
+		t.closeAfterTimeout(errors.Wrapf(err, "closing connection after %s write timeout", timeout))
+	}
+	return n, thrift.NewTTransportExceptionFromError(err)
+}
+
+// Flush does nothing, as writes go straight to the connection.
+func (t *deadlineTransport) Flush(ctx context.Context) error {
+	return nil
+}
+
+func (t *deadlineTransport) closeAfterTimeout(err error) {
+	t.TTransport.Close()
+	if t.server.onTimeout != nil {
+		t.server.onTimeout(err)
+	}
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
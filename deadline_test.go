@@ -0,0 +1,104 @@
+package osquery
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bradleyjkemp/osquery-go/gen/osquery"
+	"github.com/bradleyjkemp/osquery-go/mock"
+	"github.com/bradleyjkemp/osquery-go/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeadlineServerTransport(t *testing.T) {
+	client, listener := transport.NewInMemoryTransport()
+	require.NoError(t, listener.Listen())
+	defer listener.Close()
+
+	timeouts := make(chan error, 2)
+	server := &deadlineServerTransport{
+		TServerTransport: listener,
+		readTimeout:      20 * time.Millisecond,
+		writeTimeout:     20 * time.Millisecond,
+		onTimeout:        func(err error) { timeouts <- err },
+	}
+
+	// Reads and writes within the timeout succeed
+	require.NoError(t, client.Open())
+	trans, err := server.Accept()
+	require.NoError(t, err)
+	go client.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(trans, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+
+	// A client which sends nothing has its connection closed
+	_, err = trans.Read(buf)
+	assert.Error(t, err)
+	assert.EqualError(t, <-timeouts, "closing connection after 20ms read timeout: read pipe: i/o timeout")
+	_, err = client.Read(buf)
+	assert.Error(t, err)
+	client.Close()
+
+	// As does one which doesn't read the response
+	require.NoError(t, client.Open())
+	defer client.Close()
+	trans, err = server.Accept()
+	require.NoError(t, err)
+	_, err = trans.Write([]byte("pong"))
+	assert.Error(t, err)
+	assert.EqualError(t, <-timeouts, "closing connection after 20ms write timeout: write pipe: i/o timeout")
+	client.Close()
+
+	// Writes without a timeout of their own keep the socket timeout
+	server.writeTimeout = 0
+	server.socketTimeout = 30 * time.Millisecond
+	require.NoError(t, client.Open())
+	trans, err = server.Accept()
+	require.NoError(t, err)
+	_, err = trans.Write([]byte("pong"))
+	assert.Error(t, err)
+	assert.EqualError(t, <-timeouts, "closing connection after 30ms write timeout: write pipe: i/o timeout")
+}
+
+func TestServerReadTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "osquery")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mock := &mock.ExtensionManager{
+		RegisterExtensionFunc: func(ctx context.Context, info *osquery.InternalExtensionInfo, registry osquery.ExtensionRegistry) (*osquery.ExtensionStatus, error) {
+			return &osquery.ExtensionStatus{Code: 0, UUID: 3}, nil
+		},
+	}
+	timeouts := make(chan error, 1)
+	server := &ExtensionManagerServer{serverClient: mock, sockPath: filepath.Join(dir, "osquery.em")}
+	ServerReadTimeout(50 * time.Millisecond)(server)
+	ServerErrorHandler(func(err error) { timeouts <- err })(server)
+
+	go server.Start()
+	server.waitStarted()
+	defer server.Shutdown(context.Background())
+
+	// osquery connects but never sends a request
+	conn, err := net.Dial("unix", server.SocketPath())
+	require.NoError(t, err)
+	defer conn.Close()
+	select {
+	case err := <-timeouts:
+		assert.Contains(t, err.Error(), "closing connection after 50ms read timeout")
+	case <-time.After(time.Second):
+		t.Fatal("connection didn't time out")
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
@@ -40,7 +40,9 @@ func main() {
 	if err != nil {
 		log.Fatalf("Error creating extension: %s\n", err)
 	}
-	server.RegisterPlugin(config.NewPlugin("example_config", GenerateConfigs))
+	if err := server.RegisterPlugin(config.NewPlugin("example_config", GenerateConfigs)); err != nil {
+		log.Fatalf("Error registering config plugin: %s\n", err)
+	}
 	if err := server.Run(); err != nil {
 		log.Fatal(err)
 	}
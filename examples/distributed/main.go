@@ -20,7 +20,9 @@ func main() {
 	if err != nil {
 		log.Fatalf("Error creating extension: %s\n", err)
 	}
-	server.RegisterPlugin(distributed.NewPlugin("example_distributed", getQueries, writeResults))
+	if err := server.RegisterPlugin(distributed.NewPlugin("example_distributed", getQueries, writeResults)); err != nil {
+		log.Fatalf("Error registering distributed plugin: %s\n", err)
+	}
 	if err := server.Run(); err != nil {
 		log.Fatal(err)
 	}
@@ -2,24 +2,26 @@ package main
 
 import (
 	"context"
-	"flag"
 	"log"
+	"os"
 
 	"github.com/bradleyjkemp/osquery-go"
 	"github.com/bradleyjkemp/osquery-go/plugin/logger"
 )
 
 func main() {
-	socketPath := flag.String("socket", "", "path to osqueryd extensions socket")
-	flag.Int("timeout", 0, "")
-	flag.Int("interval", 0, "")
-	flag.Parse()
+	flags, err := osquery.ParseExtensionFlags(os.Args[1:])
+	if err != nil {
+		log.Fatalln(err)
+	}
 
-	server, err := osquery.NewExtensionManagerServer("example_logger", *socketPath)
+	server, err := osquery.NewExtensionManagerServer("example_logger", flags.Socket, flags.ServerOptions()...)
 	if err != nil {
 		log.Fatalf("Error creating extension: %s\n", err)
 	}
-	server.RegisterPlugin(logger.NewPlugin("example_logger", LogString))
+	if err := server.RegisterPlugin(logger.NewPlugin("example_logger", LogString)); err != nil {
+		log.Fatalf("Error registering logger plugin: %s\n", err)
+	}
 	if err := server.Run(); err != nil {
 		log.Fatal(err)
 	}
@@ -2,41 +2,24 @@ package main
 
 import (
 	"context"
-	"flag"
 	"fmt"
 	"log"
 	"math/big"
-	"time"
+	"os"
 
 	"github.com/bradleyjkemp/osquery-go"
 	"github.com/bradleyjkemp/osquery-go/plugin/table"
 )
 
-var (
-	socket   = flag.String("socket", "", "Path to the extensions UNIX domain socket")
-	timeout  = flag.Int("timeout", 3, "Seconds to wait for autoloaded extensions")
-	interval = flag.Int("interval", 3, "Seconds delay between connectivity checks")
-)
-
 func main() {
-	flag.Parse()
-	if *socket == "" {
-		log.Fatalln("Missing required --socket argument")
+	// The flags include the --timeout osquery passes, which is also used as
+	// the deadline of the context passed to ExampleGenerate.
+	flags, err := osquery.ParseExtensionFlags(os.Args[1:])
+	if err != nil {
+		log.Fatalln(err)
 	}
-	serverTimeout := osquery.ServerTimeout(
-		time.Second * time.Duration(*timeout),
-	)
-	serverPingInterval := osquery.ServerPingInterval(
-		time.Second * time.Duration(*interval),
-	)
-
-	server, err := osquery.NewExtensionManagerServer(
-		"example_extension",
-		*socket,
-		serverTimeout,
-		serverPingInterval,
-	)
 
+	server, err := osquery.NewExtensionManagerServer("example_extension", flags.Socket, flags.ServerOptions()...)
 	if err != nil {
 		log.Fatalf("Error creating extension: %s\n", err)
 	}
@@ -51,7 +34,9 @@ func main() {
 		log.Fatalf("Error creating table plugin: %s\n", err)
 	}
 
-	server.RegisterPlugin(exampleTable)
+	if err := server.RegisterPlugin(exampleTable); err != nil {
+		log.Fatalf("Error registering table plugin: %s\n", err)
+	}
 	if err := server.Run(); err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,138 @@
+// Package extension provides a builder for osquery extensions, which cuts down
+// the boilerplate of creating an extension manager server and registering each
+// plugin with it. For example:
+//
+//	err := extension.New(*socket).
+//		AddTable("example_table", ExampleRow{}, table.GenerateRows(generate)).
+//		AddLogger("example_logger", logString).
+//		AddConfig("example_config", generateConfigs).
+//		Run()
+//
+// The builder records the first error from any step, which is then returned
+// by Build or Run, so the steps can be chained without checking each one.
+package extension
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bradleyjkemp/osquery-go"
+	"github.com/bradleyjkemp/osquery-go/plugin/config"
+	"github.com/bradleyjkemp/osquery-go/plugin/distributed"
+	"github.com/bradleyjkemp/osquery-go/plugin/logger"
+	"github.com/bradleyjkemp/osquery-go/plugin/table"
+	"github.com/pkg/errors"
+)
+
+// Builder collects the plugins of an extension before creating the server
+// that serves them.
+type Builder struct {
+	name       string
+	socket     string
+	opts       []osquery.ServerOption
+	plugins    []osquery.OsqueryPlugin
+	registered map[string]bool // registry/name of each added plugin
+	err        error
+}
+
+// New returns a builder for an extension which will communicate with osquery
+// over the socket at the provided path. The options are passed to
+// osquery.NewExtensionManagerServer. The extension is named after the
+// executable unless Named is called.
+func New(socket string, opts ...osquery.ServerOption) *Builder {
+	name := filepath.Base(os.Args[0])
+	return &Builder{
+		name:       strings.TrimSuffix(name, filepath.Ext(name)),
+		socket:     socket,
+		opts:       opts,
+		registered: map[string]bool{},
+	}
+}
+
+// Named sets the name the extension registers with osquery.
+func (b *Builder) Named(name string) *Builder {
+	b.name = name
+	return b
+}
+
+// AddTable adds a table plugin created with table.NewPlugin.
+func (b *Builder) AddTable(name string, rowDefinition table.RowDefinition, opts ...table.Option) *Builder {
+	if b.err != nil {
+		return b
+	}
+	plugin, err := table.NewPlugin(name, rowDefinition, opts...)
+	if err != nil {
+		b.err = errors.Wrapf(err, "creating table %s", name)
+		return b
+	}
+	return b.AddPlugin(plugin)
+}
+
+// AddLogger adds a logger plugin created with logger.NewPlugin.
+func (b *Builder) AddLogger(name string, fn logger.LogFunc) *Builder {
+	return b.AddPlugin(logger.NewPlugin(name, fn))
+}
+
+// AddConfig adds a config plugin created with config.NewPlugin.
+func (b *Builder) AddConfig(name string, fn config.GenerateConfigsFunc) *Builder {
+	return b.AddPlugin(config.NewPlugin(name, fn))
+}
+
+// AddDistributed adds a distributed plugin created with distributed.NewPlugin.
+func (b *Builder) AddDistributed(name string, getQueries distributed.GetQueriesFunc, writeResults distributed.WriteResultsFunc) *Builder {
+	return b.AddPlugin(distributed.NewPlugin(name, getQueries, writeResults))
+}
+
+// AddPlugin adds already created plugins, such as those needing options the
+// other Add methods don't provide. Adding a plugin with the same name as
+// another in its registry is an error.
+func (b *Builder) AddPlugin(plugins ...osquery.OsqueryPlugin) *Builder {
+	if b.err != nil {
+		return b
+	}
+	for _, plugin := range plugins {
+		key := plugin.RegistryName() + "/" + plugin.Name()
+		if b.registered[key] {
+			b.err = errors.Errorf("duplicate %s plugin: %s", plugin.RegistryName(), plugin.Name())
+			return b
+		}
+		b.registered[key] = true
+		b.plugins = append(b.plugins, plugin)
+	}
+	return b
+}
+
+// Err returns the first error from adding plugins, if any.
+func (b *Builder) Err() error {
+	return b.err
+}
+
+// Build creates the extension manager server and registers the plugins with
+// it, without starting it.
+func (b *Builder) Build() (*osquery.ExtensionManagerServer, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	server, err := osquery.NewExtensionManagerServer(b.name, b.socket, b.opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating extension")
+	}
+	if err := server.RegisterPlugin(b.plugins...); err != nil {
+		// The server has already connected to osquery.
+		server.Shutdown(context.Background())
+		return nil, errors.Wrap(err, "registering plugins")
+	}
+	return server, nil
+}
+
+// Run builds the extension and runs it until osquery shuts it down or goes
+// away. See ExtensionManagerServer.Run.
+func (b *Builder) Run() error {
+	server, err := b.Build()
+	if err != nil {
+		return err
+	}
+	return server.Run()
+}
@@ -0,0 +1,97 @@
+package extension
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bradleyjkemp/osquery-go"
+	"github.com/bradleyjkemp/osquery-go/plugin/logger"
+	"github.com/bradleyjkemp/osquery-go/plugin/table"
+	"github.com/bradleyjkemp/osquery-go/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type exampleRow struct {
+	Name string `column:"name"`
+}
+
+func generate(ctx context.Context, queryContext table.QueryContext) ([]table.RowDefinition, error) {
+	return nil, nil
+}
+
+func logString(ctx context.Context, log logger.Log) error {
+	return nil
+}
+
+func TestBuilder(t *testing.T) {
+	b := New("/tmp/osquery.em").
+		Named("example").
+		AddTable("example_table", exampleRow{}, table.GenerateRows(generate)).
+		AddLogger("example_logger", logString).
+		AddConfig("example_config", nil).
+		AddDistributed("example_distributed", nil, nil)
+	require.NoError(t, b.Err())
+	assert.Equal(t, "example", b.name)
+
+	var names []string
+	for _, plugin := range b.plugins {
+		names = append(names, plugin.RegistryName()+"/"+plugin.Name())
+	}
+	assert.Equal(t, []string{
+		"table/example_table",
+		"logger/example_logger",
+		"config/example_config",
+		"distributed/example_distributed",
+	}, names)
+}
+
+func TestBuilderErrors(t *testing.T) {
+	// The first error is kept and the later steps are skipped
+	b := New("/tmp/osquery.em").
+		AddTable("bad_table", "not a struct").
+		AddLogger("example_logger", logString)
+	assert.EqualError(t, b.Err(), "creating table bad_table: row definition must be a struct")
+	assert.Empty(t, b.plugins)
+	_, err := b.Build()
+	assert.Equal(t, b.Err(), err)
+
+	b = New("/tmp/osquery.em").
+		AddLogger("example", logString).
+		AddConfig("example", nil).
+		AddLogger("example", logString)
+	assert.EqualError(t, b.Err(), "duplicate logger plugin: example")
+	assert.Equal(t, b.Err(), b.Run())
+
+	dir, err := ioutil.TempDir("", "osquery-go-extension")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	_, err = New(filepath.Join(dir, "missing.em"), osquery.ServerTimeout(time.Millisecond)).Build()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "creating extension")
+}
+
+// customPlugin is a plugin for a registry the server doesn't allow by default.
+type customPlugin struct {
+	*logger.Plugin
+}
+
+func (customPlugin) RegistryName() string { return "custom" }
+
+func TestBuilderRegisterError(t *testing.T) {
+	clientTrans, serverTrans := transport.NewInMemoryTransport()
+	require.NoError(t, serverTrans.Listen())
+	defer serverTrans.Close()
+
+	_, err := New("", osquery.ServerClientTransport(clientTrans)).
+		AddPlugin(customPlugin{logger.NewPlugin("example", logString)}).
+		Build()
+	assert.EqualError(t, err, "registering plugins: invalid registry name: custom")
+
+	// The server's connection to osquery isn't left open
+	assert.False(t, clientTrans.IsOpen())
+}
@@ -0,0 +1,68 @@
+package osquery
+
+import (
+	"flag"
+	"io/ioutil"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ExtensionFlags contains the standard flags that osquery passes to the
+// extensions it autoloads.
+type ExtensionFlags struct {
+	// Socket is the path to the osquery extensions socket.
+	Socket string
+	// Timeout is how long osquery waits for the extension to register.
+	Timeout time.Duration
+	// Interval is the delay between osquery's connectivity checks.
+	Interval time.Duration
+	// Verbose is set when osquery is running with verbose logging.
+	Verbose bool
+}
+
+// ParseExtensionFlags parses the --socket, --timeout, --interval and
+// --verbose flags that osquery passes to autoloaded extensions. args should
+// not include the program name, so typically os.Args[1:] is passed. The
+// timeout and interval are given by osquery in seconds.
+func ParseExtensionFlags(args []string) (*ExtensionFlags, error) {
+	flags := flag.NewFlagSet("osquery extension", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+
+	socket := flags.String("socket", "", "path to the osquery extensions socket")
+	timeout := flags.Int("timeout", 0, "seconds to wait for the extension to register")
+	interval := flags.Int("interval", 0, "seconds between connectivity checks")
+	verbose := flags.Bool("verbose", false, "enable verbose logging")
+
+	if err := flags.Parse(args); err != nil {
+		return nil, errors.Wrap(err, "parsing extension flags")
+	}
+	if *socket == "" {
+		return nil, errors.New("missing required --socket flag")
+	}
+
+	return &ExtensionFlags{
+		Socket:   *socket,
+		Timeout:  time.Duration(*timeout) * time.Second,
+		Interval: time.Duration(*interval) * time.Second,
+		Verbose:  *verbose,
+	}, nil
+}
+
+// ServerOptions returns the options to pass to NewExtensionManagerServer so
+// that the server honours the flags. The timeout is used both for connecting to
+// osquery and as the deadline for each plugin call. For example:
+//
+//	flags, err := osquery.ParseExtensionFlags(os.Args[1:])
+//	...
+//	server, err := osquery.NewExtensionManagerServer("example", flags.Socket, flags.ServerOptions()...)
+func (f *ExtensionFlags) ServerOptions() []ServerOption {
+	var opts []ServerOption
+	if f.Timeout > 0 {
+		opts = append(opts, ServerTimeout(f.Timeout), ServerCallTimeout(f.Timeout))
+	}
+	if f.Interval > 0 {
+		opts = append(opts, ServerPingInterval(f.Interval))
+	}
+	return opts
+}
@@ -0,0 +1,76 @@
+package osquery
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bradleyjkemp/osquery-go/gen/osquery"
+	"github.com/bradleyjkemp/osquery-go/plugin/table"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseExtensionFlags(t *testing.T) {
+	flags, err := ParseExtensionFlags([]string{
+		"--socket", "/var/osquery/osquery.em",
+		"--timeout", "3",
+		"--interval=5",
+		"--verbose",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, &ExtensionFlags{
+		Socket:   "/var/osquery/osquery.em",
+		Timeout:  3 * time.Second,
+		Interval: 5 * time.Second,
+		Verbose:  true,
+	}, flags)
+
+	server := &ExtensionManagerServer{}
+	for _, opt := range flags.ServerOptions() {
+		opt(server)
+	}
+	assert.Equal(t, 3*time.Second, server.timeout)
+	assert.Equal(t, 3*time.Second, server.callTimeout)
+	assert.Equal(t, 5*time.Second, server.pingInterval)
+
+	flags, err = ParseExtensionFlags([]string{"--socket", "/var/osquery/osquery.em"})
+	require.NoError(t, err)
+	assert.Equal(t, &ExtensionFlags{Socket: "/var/osquery/osquery.em"}, flags)
+	assert.Empty(t, flags.ServerOptions())
+}
+
+func TestParseExtensionFlagsErrors(t *testing.T) {
+	_, err := ParseExtensionFlags([]string{})
+	assert.EqualError(t, err, "missing required --socket flag")
+
+	_, err = ParseExtensionFlags([]string{"--socket", "/tmp/sock", "--timeout", "soon"})
+	assert.Error(t, err)
+
+	_, err = ParseExtensionFlags([]string{"--socket", "/tmp/sock", "--unknown"})
+	assert.Error(t, err)
+}
+
+func TestExtensionFlagsCallDeadline(t *testing.T) {
+	flags, err := ParseExtensionFlags([]string{"--socket", "/tmp/test.em", "--timeout", "3"})
+	require.NoError(t, err)
+	server := newExtensionManagerServer("test", flags.Socket, flags.ServerOptions()...)
+
+	var remaining time.Duration
+	var hasDeadline bool
+	plugin, err := table.NewPlugin("deadline", struct {
+		Value string `column:"value"`
+	}{}, table.GenerateRows(func(ctx context.Context, queryContext table.QueryContext) ([]table.RowDefinition, error) {
+		var deadline time.Time
+		deadline, hasDeadline = ctx.Deadline()
+		remaining = time.Until(deadline)
+		return nil, nil
+	}))
+	require.NoError(t, err)
+	require.NoError(t, server.RegisterPlugin(plugin))
+
+	_, err = server.Call(context.Background(), "table", "deadline", osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	require.NoError(t, err)
+	assert.True(t, hasDeadline)
+	assert.True(t, remaining > 0 && remaining <= 3*time.Second, "remaining %s", remaining)
+}
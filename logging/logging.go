@@ -0,0 +1,76 @@
+// Package logging carries a structured logger through the context passed to
+// plugins, so that log lines from a plugin call are annotated with details of
+// the call such as the registry and plugin name.
+//
+// The Logger interface is satisfied by *slog.Logger, so a logger from the
+// log/slog package can be used directly.
+package logging
+
+import "context"
+
+// Logger is a structured logger. The args are alternating keys and values, as
+// for *slog.Logger.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+type loggerKey struct{}
+
+// NewContext returns a context carrying the logger, with the keys and values
+// in args added to every line it logs. A nil logger disables logging.
+func NewContext(ctx context.Context, logger Logger, args ...interface{}) context.Context {
+	if logger == nil {
+		return ctx
+	}
+	if len(args) > 0 {
+		logger = fieldLogger{logger, args}
+	}
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// With returns a context whose logger adds the keys and values in args to
+// every line it logs. If the context has no logger then it is returned as is,
+// so this is cheap when logging is disabled.
+func With(ctx context.Context, args ...interface{}) context.Context {
+	logger, ok := ctx.Value(loggerKey{}).(Logger)
+	if !ok {
+		return ctx
+	}
+	return NewContext(ctx, logger, args...)
+}
+
+// FromContext returns the logger carried by the context. If there isn't one, a
+// logger which discards everything is returned.
+func FromContext(ctx context.Context) Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(Logger); ok {
+		return logger
+	}
+	return nopLogger{}
+}
+
+// fieldLogger adds fields to every line logged by the underlying logger.
+type fieldLogger struct {
+	logger Logger
+	fields []interface{}
+}
+
+func (l fieldLogger) with(args []interface{}) []interface{} {
+	withFields := make([]interface{}, 0, len(l.fields)+len(args))
+	withFields = append(withFields, l.fields...)
+	return append(withFields, args...)
+}
+
+func (l fieldLogger) Debug(msg string, args ...interface{}) { l.logger.Debug(msg, l.with(args)...) }
+func (l fieldLogger) Info(msg string, args ...interface{})  { l.logger.Info(msg, l.with(args)...) }
+func (l fieldLogger) Warn(msg string, args ...interface{})  { l.logger.Warn(msg, l.with(args)...) }
+func (l fieldLogger) Error(msg string, args ...interface{}) { l.logger.Error(msg, l.with(args)...) }
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, args ...interface{}) {}
+func (nopLogger) Info(msg string, args ...interface{})  {}
+func (nopLogger) Warn(msg string, args ...interface{})  {}
+func (nopLogger) Error(msg string, args ...interface{}) {}
@@ -0,0 +1,59 @@
+package logging
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type logLine struct {
+	level, msg string
+	args       []interface{}
+}
+
+type recordingLogger struct {
+	lines []logLine
+}
+
+func (l *recordingLogger) log(level, msg string, args []interface{}) {
+	l.lines = append(l.lines, logLine{level, msg, args})
+}
+
+func (l *recordingLogger) Debug(msg string, args ...interface{}) { l.log("debug", msg, args) }
+func (l *recordingLogger) Info(msg string, args ...interface{})  { l.log("info", msg, args) }
+func (l *recordingLogger) Warn(msg string, args ...interface{})  { l.log("warn", msg, args) }
+func (l *recordingLogger) Error(msg string, args ...interface{}) { l.log("error", msg, args) }
+
+func TestContextLogger(t *testing.T) {
+	recorder := &recordingLogger{}
+	ctx := NewContext(context.Background(), recorder, "registry", "table")
+	ctx = With(ctx, "plugin", "example")
+
+	logger := FromContext(ctx)
+	logger.Debug("starting")
+	logger.Info("scanning", "path", "/tmp")
+	logger.Warn("slow")
+	logger.Error("failed", "err", "boom")
+
+	assert.Equal(t, []logLine{
+		{"debug", "starting", []interface{}{"registry", "table", "plugin", "example"}},
+		{"info", "scanning", []interface{}{"registry", "table", "plugin", "example", "path", "/tmp"}},
+		{"warn", "slow", []interface{}{"registry", "table", "plugin", "example"}},
+		{"error", "failed", []interface{}{"registry", "table", "plugin", "example", "err", "boom"}},
+	}, recorder.lines)
+
+	// The fields of one context don't leak into another
+	FromContext(NewContext(context.Background(), recorder)).Info("plain")
+	assert.Equal(t, logLine{"info", "plain", nil}, recorder.lines[4])
+}
+
+func TestNoLogger(t *testing.T) {
+	ctx := context.Background()
+	assert.Equal(t, ctx, NewContext(ctx, nil, "registry", "table"))
+	assert.Equal(t, ctx, With(ctx, "plugin", "example"))
+
+	logger := FromContext(ctx)
+	assert.NotNil(t, logger)
+	logger.Info("discarded", "path", "/tmp")
+}
@@ -0,0 +1,64 @@
+package osquery
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+
+	"github.com/bradleyjkemp/osquery-go/gen/osquery"
+)
+
+// CallHandler handles a call from osquery to the named plugin in a registry.
+type CallHandler func(ctx context.Context, registry, plugin string, request osquery.ExtensionPluginRequest) (osquery.ExtensionPluginResponse, error)
+
+// Middleware wraps the handling of every plugin call, to add behaviour such as
+// logging, timing or authorization without changing the plugins. A middleware
+// should usually call next to continue handling the call.
+type Middleware func(next CallHandler) CallHandler
+
+// Use adds middleware to be applied to every plugin call. The first middleware
+// added is the outermost, so it is the first to see each call.
+func (s *ExtensionManagerServer) Use(middleware ...Middleware) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.middleware = append(s.middleware, middleware...)
+}
+
+// handler returns the handler for plugin calls, wrapped in the middleware.
+func (s *ExtensionManagerServer) handler() CallHandler {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	handler := CallHandler(s.callPlugin)
+	for i := len(s.middleware) - 1; i >= 0; i-- {
+		handler = s.middleware[i](handler)
+	}
+	return handler
+}
+
+// PanicError is returned from a plugin call which panicked. The server recovers
+// from panics in plugins, so that middleware sees them as this error, and from
+// panics in middleware. It is also logged to the ServerLogger and passed to the
+// ErrorHandler, so that the stack trace isn't lost.
+type PanicError struct {
+	Registry string
+	Plugin   string
+	Value    interface{} // The value passed to panic
+	Stack    []byte      // The stack trace of the panicking goroutine
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic in %s plugin %s: %v", e.Registry, e.Plugin, e.Value)
+}
+
+// newPanicError returns the error for a plugin call which panicked with value.
+// It must be called from the deferred function which recovered, so that the
+// stack trace includes the panic.
+func newPanicError(registry, plugin string, value interface{}) *PanicError {
+	return &PanicError{
+		Registry: registry,
+		Plugin:   plugin,
+		Value:    value,
+		Stack:    debug.Stack(),
+	}
+}
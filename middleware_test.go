@@ -0,0 +1,93 @@
+package osquery
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/bradleyjkemp/osquery-go/gen/osquery"
+	"github.com/bradleyjkemp/osquery-go/plugin/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMiddleware(t *testing.T) {
+	server := &ExtensionManagerServer{registry: map[string]map[string]OsqueryPlugin{"logger": {}}}
+	require.NoError(t, server.RegisterPlugin(logger.NewPlugin("testLogger", func(ctx context.Context, log logger.Log) error {
+		return nil
+	})))
+
+	var calls []string
+	record := func(name string) Middleware {
+		return func(next CallHandler) CallHandler {
+			return func(ctx context.Context, registry, plugin string, request osquery.ExtensionPluginRequest) (osquery.ExtensionPluginResponse, error) {
+				calls = append(calls, name+" "+registry+"/"+plugin)
+				return next(ctx, registry, plugin, request)
+			}
+		}
+	}
+	server.Use(record("first"), record("second"))
+	server.Use(func(next CallHandler) CallHandler {
+		return func(ctx context.Context, registry, plugin string, request osquery.ExtensionPluginRequest) (osquery.ExtensionPluginResponse, error) {
+			if request["token"] != "secret" {
+				return nil, errors.New("unauthorized")
+			}
+			return next(ctx, registry, plugin, request)
+		}
+	})
+
+	_, err := server.Call(context.Background(), "logger", "testLogger", osquery.ExtensionPluginRequest{"string": "foo", "token": "secret"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"first logger/testLogger", "second logger/testLogger"}, calls)
+
+	_, err = server.Call(context.Background(), "logger", "testLogger", osquery.ExtensionPluginRequest{"string": "foo"})
+	assert.EqualError(t, err, "unauthorized")
+
+	// Calls to unknown plugins go through the middleware too
+	calls = nil
+	_, err = server.Call(context.Background(), "logger", "missing", osquery.ExtensionPluginRequest{"token": "secret"})
+	assert.EqualError(t, err, "Unknown registry item: missing")
+	assert.Equal(t, []string{"first logger/missing", "second logger/missing"}, calls)
+}
+
+func TestMiddlewarePanic(t *testing.T) {
+	server := &ExtensionManagerServer{registry: map[string]map[string]OsqueryPlugin{"logger": {}}}
+	require.NoError(t, server.RegisterPlugin(logger.NewPlugin("testLogger", func(ctx context.Context, log logger.Log) error {
+		var m map[string]string
+		m["foo"] = "bar"
+		return nil
+	})))
+
+	// Middleware sees a panic in the plugin as an error
+	var seen error
+	server.Use(func(next CallHandler) CallHandler {
+		return func(ctx context.Context, registry, plugin string, request osquery.ExtensionPluginRequest) (osquery.ExtensionPluginResponse, error) {
+			resp, err := next(ctx, registry, plugin, request)
+			seen = err
+			return resp, err
+		}
+	})
+
+	resp, err := ErrWrap{server}.Call(context.Background(), "logger", "testLogger", osquery.ExtensionPluginRequest{"string": "foo"})
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), resp.Status.Code)
+	assert.Equal(t, "panic in logger plugin testLogger: assignment to entry in nil map", resp.Status.Message)
+
+	_, err = server.Call(context.Background(), "logger", "testLogger", osquery.ExtensionPluginRequest{"string": "foo"})
+	var panicErr *PanicError
+	require.True(t, errors.As(err, &panicErr))
+	assert.Contains(t, string(panicErr.Stack), "TestMiddlewarePanic")
+	assert.Equal(t, err, seen)
+
+	// A panic in middleware is recovered too
+	server.Use(func(next CallHandler) CallHandler {
+		return func(ctx context.Context, registry, plugin string, request osquery.ExtensionPluginRequest) (osquery.ExtensionPluginResponse, error) {
+			panic("broken middleware")
+		}
+	})
+	_, err = server.Call(context.Background(), "logger", "testLogger", osquery.ExtensionPluginRequest{"string": "foo"})
+	assert.EqualError(t, err, "panic in logger plugin testLogger: broken middleware")
+
+	// The panicking call is no longer in flight, so shutdown isn't blocked
+	assert.NoError(t, server.Shutdown(context.Background()))
+}
@@ -0,0 +1,537 @@
+// Package osquerytest provides an in-process stand in for osquery, for
+// integration testing extensions without installing osquery.
+package osquerytest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/apache/thrift/lib/go/thrift"
+
+	"github.com/bradleyjkemp/osquery-go/gen/osquery"
+	"github.com/bradleyjkemp/osquery-go/plugin/table"
+	"github.com/bradleyjkemp/osquery-go/transport"
+	"github.com/pkg/errors"
+)
+
+const defaultTimeout = 1 * time.Second
+
+// MockExtensionManager implements the osquery side of the extension API. It
+// listens on a socket, accepts extension registrations and can run simple
+// queries against the tables that extensions register. For example:
+//
+//	manager, err := osquerytest.NewMockExtensionManager(sockPath)
+//	...
+//	defer manager.Close()
+//	server, err := osquery.NewExtensionManagerServer("example", sockPath)
+//	plugin, err := table.NewPlugin("mytable", ...)
+//	err = server.RegisterPlugin(plugin)
+//	go server.Run()
+//	...
+//	rows, err := manager.RunQuery(ctx, "select * from mytable where x = 1")
+//
+// Queries are passed to the table plugins through the same generate call and
+// query context JSON that osquery uses. Only single table SELECT statements
+// with constraints joined by AND are supported. The returned rows are
+// filtered by the constraints as osquery would, though LIKE and GLOB are the
+// only pattern operators evaluated.
+type MockExtensionManager struct {
+	sockPath string
+	server   *thrift.TSimpleServer
+	listener *connTrackingTransport
+
+	mutex      sync.Mutex
+	nextUUID   osquery.ExtensionRouteUUID
+	extensions map[osquery.ExtensionRouteUUID]*registeredExtension
+
+	// dial connects to the socket of a registered extension.
+	dial func(path string) (osquery.Extension, thrift.TTransport, error)
+}
+
+type registeredExtension struct {
+	info      *osquery.InternalExtensionInfo
+	registry  osquery.ExtensionRegistry
+	transport thrift.TTransport
+
+	// callMutex serializes calls as thrift clients are not safe for
+	// concurrent use.
+	callMutex sync.Mutex
+	client    osquery.Extension
+}
+
+func (e *registeredExtension) call(ctx context.Context, registry, item string, request osquery.ExtensionPluginRequest) (*osquery.ExtensionResponse, error) {
+	e.callMutex.Lock()
+	defer e.callMutex.Unlock()
+	return e.client.Call(ctx, registry, item, request)
+}
+
+var _ osquery.ExtensionManager = (*MockExtensionManager)(nil)
+
+// NewMockExtensionManager starts a mock extension manager listening on
+// sockPath. Close should be called to stop the manager.
+func NewMockExtensionManager(sockPath string) (*MockExtensionManager, error) {
+	trans, err := transport.OpenServer(sockPath, defaultTimeout)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening server socket (%s)", sockPath)
+	}
+	// Listen before returning so that extensions can connect immediately.
+	if err := trans.Listen(); err != nil {
+		return nil, errors.Wrapf(err, "listening on %s", sockPath)
+	}
+
+	m := newMockExtensionManager(sockPath)
+	m.listener = &connTrackingTransport{TServerTransport: trans}
+	m.server = thrift.NewTSimpleServer2(osquery.NewExtensionManagerProcessor(m), m.listener)
+	go m.server.Serve()
+	return m, nil
+}
+
+func newMockExtensionManager(sockPath string) *MockExtensionManager {
+	return &MockExtensionManager{
+		sockPath:   sockPath,
+		nextUUID:   1,
+		extensions: make(map[osquery.ExtensionRouteUUID]*registeredExtension),
+		dial:       dialExtension,
+	}
+}
+
+func dialExtension(path string) (osquery.Extension, thrift.TTransport, error) {
+	trans, err := transport.Open(path, defaultTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	client := osquery.NewExtensionClientFactory(trans, thrift.NewTBinaryProtocolFactoryDefault())
+	return client, trans, nil
+}
+
+// Close stops the manager and closes its connections to extensions, including
+// those extensions made to the manager.
+func (m *MockExtensionManager) Close() error {
+	m.mutex.Lock()
+	for _, ext := range m.extensions {
+		if ext.transport != nil {
+			ext.transport.Close()
+		}
+	}
+	m.extensions = make(map[osquery.ExtensionRouteUUID]*registeredExtension)
+	m.mutex.Unlock()
+
+	if m.server == nil {
+		return nil
+	}
+	// The server waits for its connections to close before stopping, and
+	// extensions keep theirs open until they exit.
+	m.listener.closeConns()
+	return m.server.Stop()
+}
+
+// connTrackingTransport records the connections the manager accepts from
+// extensions, so that Close can close them. The network connections are closed
+// rather than the transports, as the server may be reading from them.
+type connTrackingTransport struct {
+	thrift.TServerTransport
+	mutex sync.Mutex
+	conns []net.Conn
+}
+
+func (t *connTrackingTransport) Accept() (thrift.TTransport, error) {
+	trans, err := t.TServerTransport.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if socket, ok := trans.(*thrift.TSocket); ok {
+		t.mutex.Lock()
+		t.conns = append(t.conns, socket.Conn())
+		t.mutex.Unlock()
+	}
+	return trans, nil
+}
+
+func (t *connTrackingTransport) closeConns() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, conn := range t.conns {
+		conn.Close()
+	}
+	t.conns = nil
+}
+
+// Ping implements osquery.ExtensionManager.
+func (m *MockExtensionManager) Ping(ctx context.Context) (*osquery.ExtensionStatus, error) {
+	return &osquery.ExtensionStatus{Code: 0, Message: "OK"}, nil
+}
+
+// Call implements osquery.ExtensionManager by forwarding the request to the
+// extension that registered the plugin.
+func (m *MockExtensionManager) Call(ctx context.Context, registry string, item string, request osquery.ExtensionPluginRequest) (*osquery.ExtensionResponse, error) {
+	ext, err := m.extensionFor(registry, item)
+	if err != nil {
+		return &osquery.ExtensionResponse{
+			Status: &osquery.ExtensionStatus{Code: 1, Message: err.Error()},
+		}, nil
+	}
+	return ext.call(ctx, registry, item, request)
+}
+
+// Shutdown implements osquery.ExtensionManager.
+func (m *MockExtensionManager) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+// Extensions implements osquery.ExtensionManager. The manager itself is
+// reported with UUID 0, as osquery does.
+func (m *MockExtensionManager) Extensions(ctx context.Context) (osquery.InternalExtensionList, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	list := osquery.InternalExtensionList{
+		0: &osquery.InternalExtensionInfo{Name: "core", Version: "mock"},
+	}
+	for uuid, ext := range m.extensions {
+		list[uuid] = ext.info
+	}
+	return list, nil
+}
+
+// Options implements osquery.ExtensionManager. No options are reported.
+func (m *MockExtensionManager) Options(ctx context.Context) (osquery.InternalOptionList, error) {
+	return osquery.InternalOptionList{}, nil
+}
+
+// RegisterExtension implements osquery.ExtensionManager. The manager connects
+// to the extension's socket the first time one of its plugins is called.
+func (m *MockExtensionManager) RegisterExtension(ctx context.Context, info *osquery.InternalExtensionInfo, registry osquery.ExtensionRegistry) (*osquery.ExtensionStatus, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, ext := range m.extensions {
+		for registryName, routes := range registry {
+			for name := range routes {
+				if _, ok := ext.registry[registryName][name]; ok {
+					return &osquery.ExtensionStatus{
+						Code:    1,
+						Message: fmt.Sprintf("duplicate %s plugin %s", registryName, name),
+					}, nil
+				}
+			}
+		}
+	}
+
+	uuid := m.nextUUID
+	m.nextUUID++
+	m.extensions[uuid] = &registeredExtension{info: info, registry: registry}
+	return &osquery.ExtensionStatus{Code: 0, Message: "OK", UUID: uuid}, nil
+}
+
+// DeregisterExtension implements osquery.ExtensionManager.
+func (m *MockExtensionManager) DeregisterExtension(ctx context.Context, uuid osquery.ExtensionRouteUUID) (*osquery.ExtensionStatus, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	ext, ok := m.extensions[uuid]
+	if !ok {
+		return &osquery.ExtensionStatus{Code: 1, Message: fmt.Sprintf("no extension with UUID %d", uuid)}, nil
+	}
+	if ext.transport != nil {
+		ext.transport.Close()
+	}
+	delete(m.extensions, uuid)
+	return &osquery.ExtensionStatus{Code: 0, Message: "OK"}, nil
+}
+
+// Query implements osquery.ExtensionManager using RunQuery.
+func (m *MockExtensionManager) Query(ctx context.Context, sql string) (*osquery.ExtensionResponse, error) {
+	rows, err := m.RunQuery(ctx, sql)
+	if err != nil {
+		return &osquery.ExtensionResponse{
+			Status: &osquery.ExtensionStatus{Code: 1, Message: err.Error()},
+		}, nil
+	}
+	return &osquery.ExtensionResponse{
+		Status:   &osquery.ExtensionStatus{Code: 0, Message: "OK"},
+		Response: rows,
+	}, nil
+}
+
+// GetQueryColumns implements osquery.ExtensionManager. Each row maps a
+// selected column name to its type.
+func (m *MockExtensionManager) GetQueryColumns(ctx context.Context, sql string) (*osquery.ExtensionResponse, error) {
+	columns, err := m.queryColumns(sql)
+	if err != nil {
+		return &osquery.ExtensionResponse{
+			Status: &osquery.ExtensionStatus{Code: 1, Message: err.Error()},
+		}, nil
+	}
+
+	var resp osquery.ExtensionPluginResponse
+	for _, column := range columns {
+		resp = append(resp, map[string]string{column.Name: string(column.Type)})
+	}
+	return &osquery.ExtensionResponse{
+		Status:   &osquery.ExtensionStatus{Code: 0, Message: "OK"},
+		Response: resp,
+	}, nil
+}
+
+// RunQuery runs a query against the tables registered by extensions,
+// returning the resulting rows.
+func (m *MockExtensionManager) RunQuery(ctx context.Context, sql string) ([]map[string]string, error) {
+	query, err := parseQuery(sql)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing query")
+	}
+	ext, err := m.extensionFor("table", query.table)
+	if err != nil {
+		return nil, err
+	}
+	columns, err := tableColumns(ext.registry["table"][query.table])
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading columns of table %s", query.table)
+	}
+
+	constraints := make(map[string]table.ConstraintList)
+	for _, constraint := range query.constraints {
+		column, ok := columns[constraint.column]
+		if !ok {
+			return nil, errors.Errorf("no such column: %s", constraint.column)
+		}
+		list := constraints[column.name]
+		list.Affinity = column.affinity
+		list.Constraints = append(list.Constraints, constraint.Constraint)
+		constraints[column.name] = list
+	}
+	// As in osquery, the columns used include those in the WHERE clause, so
+	// that the rows can still be filtered.
+	var colsUsed []string
+	if query.columns != nil {
+		for _, column := range query.columns {
+			if _, ok := columns[column]; !ok {
+				return nil, errors.Errorf("no such column: %s", column)
+			}
+			colsUsed = appendColumn(colsUsed, columns[column].name)
+		}
+		for name := range constraints {
+			colsUsed = appendColumn(colsUsed, name)
+		}
+		sort.Strings(colsUsed)
+	}
+
+	ctxJSON, err := marshalQueryContext(constraints, colsUsed, query.distinct)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := ext.call(ctx, "table", query.table, osquery.ExtensionPluginRequest{
+		"action":  "generate",
+		"context": ctxJSON,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "calling table %s", query.table)
+	}
+	if resp.Status == nil {
+		return nil, errors.Errorf("calling table %s: missing status", query.table)
+	}
+	if resp.Status.Code != 0 {
+		return nil, errors.Errorf("calling table %s: status %d: %s", query.table, resp.Status.Code, resp.Status.Message)
+	}
+
+	rows := []map[string]string{}
+	seen := map[string]bool{}
+	for _, row := range resp.Response {
+		if !rowMatches(constraints, row) {
+			continue
+		}
+		if query.columns != nil {
+			selected := make(map[string]string, len(query.columns))
+			for _, column := range query.columns {
+				selected[column] = row[columns[column].name]
+			}
+			row = selected
+		}
+		if query.distinct {
+			// Maps are marshaled with sorted keys, so equal rows
+			// have the same JSON.
+			key, err := json.Marshal(row)
+			if err != nil {
+				return nil, errors.Wrap(err, "comparing rows")
+			}
+			if seen[string(key)] {
+				continue
+			}
+			seen[string(key)] = true
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func appendColumn(columns []string, name string) []string {
+	for _, column := range columns {
+		if column == name {
+			return columns
+		}
+	}
+	return append(columns, name)
+}
+
+func rowMatches(constraints map[string]table.ConstraintList, row map[string]string) bool {
+	for column, list := range constraints {
+		if !list.Matches(row[column]) {
+			return false
+		}
+	}
+	return true
+}
+
+// extensionFor returns the extension that registered the plugin, connecting
+// to it if this is the first call.
+func (m *MockExtensionManager) extensionFor(registry, item string) (*registeredExtension, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for uuid, ext := range m.extensions {
+		if _, ok := ext.registry[registry][item]; !ok {
+			continue
+		}
+		if ext.client == nil {
+			client, trans, err := m.dial(fmt.Sprintf("%s.%d", m.sockPath, uuid))
+			if err != nil {
+				return nil, errors.Wrapf(err, "connecting to extension %s", ext.info.Name)
+			}
+			ext.client, ext.transport = client, trans
+		}
+		return ext, nil
+	}
+	return nil, errors.Errorf("no such %s plugin: %s", registry, item)
+}
+
+type queryColumn struct {
+	Name string
+	Type table.ColumnType
+}
+
+func (m *MockExtensionManager) queryColumns(sql string) ([]queryColumn, error) {
+	query, err := parseQuery(sql)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing query")
+	}
+
+	m.mutex.Lock()
+	var routes osquery.ExtensionPluginResponse
+	for _, ext := range m.extensions {
+		if r, ok := ext.registry["table"][query.table]; ok {
+			routes = r
+		}
+	}
+	m.mutex.Unlock()
+	if routes == nil {
+		return nil, errors.Errorf("no such table: %s", query.table)
+	}
+
+	var columns []queryColumn
+	for _, route := range routes {
+		if route["id"] != "column" {
+			continue
+		}
+		columns = append(columns, queryColumn{route["name"], table.ColumnType(route["type"])})
+	}
+	if query.columns == nil {
+		return columns, nil
+	}
+
+	selected := make([]queryColumn, 0, len(query.columns))
+	for _, name := range query.columns {
+		found := false
+		for _, column := range columns {
+			if column.Name == name {
+				selected = append(selected, column)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, errors.Errorf("no such column: %s", name)
+		}
+	}
+	return selected, nil
+}
+
+// tableColumn is a column in the routes registered for a table.
+type tableColumn struct {
+	// name is the name of the column, which differs from the name the
+	// column is referred to by for aliases.
+	name     string
+	affinity table.ColumnType
+}
+
+// tableColumns returns the columns (including aliases) in the routes
+// registered for a table.
+func tableColumns(routes osquery.ExtensionPluginResponse) (map[string]tableColumn, error) {
+	columns := make(map[string]tableColumn)
+	for _, route := range routes {
+		if route["id"] == "column" {
+			columns[route["name"]] = tableColumn{route["name"], table.ColumnType(route["type"])}
+		}
+	}
+	for _, route := range routes {
+		if route["id"] != "columnAlias" {
+			continue
+		}
+		column, ok := columns[route["target"]]
+		if !ok {
+			return nil, errors.Errorf("alias %s for unknown column %s", route["name"], route["target"])
+		}
+		columns[route["name"]] = column
+	}
+	return columns, nil
+}
+
+// marshalQueryContext serializes constraints, the columns used by a query and
+// whether it selects distinct rows in the query context JSON format that
+// osquery passes to table plugins.
+func marshalQueryContext(constraints map[string]table.ConstraintList, colsUsed []string, distinct bool) (string, error) {
+	type constraintJSON struct {
+		Operator   table.Operator `json:"op"`
+		Expression string         `json:"expr"`
+	}
+	type constraintListJSON struct {
+		Name     string           `json:"name"`
+		Affinity string           `json:"affinity"`
+		List     []constraintJSON `json:"list"`
+	}
+
+	names := make([]string, 0, len(constraints))
+	for name := range constraints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lists := []constraintListJSON{}
+	for _, name := range names {
+		list := constraintListJSON{Name: name, Affinity: string(constraints[name].Affinity), List: []constraintJSON{}}
+		for _, constraint := range constraints[name].Constraints {
+			list.List = append(list.List, constraintJSON{
+				Operator:   constraint.Operator,
+				Expression: constraint.Expression,
+			})
+		}
+		lists = append(lists, list)
+	}
+
+	queryContext := map[string]interface{}{"constraints": lists}
+	if len(colsUsed) > 0 {
+		queryContext["colsUsed"] = colsUsed
+	}
+	if distinct {
+		queryContext["distinct"] = true
+	}
+	ctxJSON, err := json.Marshal(queryContext)
+	if err != nil {
+		return "", errors.Wrap(err, "marshaling query context")
+	}
+	return string(ctxJSON), nil
+}
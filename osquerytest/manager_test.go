@@ -0,0 +1,245 @@
+package osquerytest
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/apache/thrift/lib/go/thrift"
+	osqueryext "github.com/bradleyjkemp/osquery-go"
+	"github.com/bradleyjkemp/osquery-go/gen/osquery"
+	"github.com/bradleyjkemp/osquery-go/plugin/table"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type exampleRow struct {
+	Name  string `column:"name,alias=label"`
+	Count int    `column:"count"`
+}
+
+// pluginExtension serves table plugins in place of an extension's thrift
+// server.
+type pluginExtension struct {
+	plugins map[string]*table.Plugin
+}
+
+func (e *pluginExtension) Ping(ctx context.Context) (*osquery.ExtensionStatus, error) {
+	return &osquery.ExtensionStatus{Code: 0, Message: "OK"}, nil
+}
+
+func (e *pluginExtension) Call(ctx context.Context, registry string, item string, request osquery.ExtensionPluginRequest) (*osquery.ExtensionResponse, error) {
+	resp, err := e.plugins[item].Call(ctx, request)
+	if err != nil {
+		return &osquery.ExtensionResponse{
+			Status: &osquery.ExtensionStatus{Code: 1, Message: err.Error()},
+		}, nil
+	}
+	return &osquery.ExtensionResponse{
+		Status:   &osquery.ExtensionStatus{Code: 0, Message: "OK"},
+		Response: resp,
+	}, nil
+}
+
+func (e *pluginExtension) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+func newTestManager(t *testing.T, plugins ...*table.Plugin) *MockExtensionManager {
+	ext := &pluginExtension{plugins: make(map[string]*table.Plugin)}
+	routes := osquery.ExtensionRouteTable{}
+	for _, plugin := range plugins {
+		ext.plugins[plugin.Name()] = plugin
+		routes[plugin.Name()] = plugin.Routes()
+	}
+
+	m := newMockExtensionManager("/tmp/osquery.em")
+	m.dial = func(path string) (osquery.Extension, thrift.TTransport, error) {
+		assert.Equal(t, "/tmp/osquery.em.1", path)
+		return ext, nil, nil
+	}
+
+	stat, err := m.RegisterExtension(
+		context.Background(),
+		&osquery.InternalExtensionInfo{Name: "test"},
+		osquery.ExtensionRegistry{"table": routes},
+	)
+	require.NoError(t, err)
+	require.Equal(t, int32(0), stat.Code, stat.Message)
+	assert.Equal(t, osquery.ExtensionRouteUUID(1), stat.UUID)
+	return m
+}
+
+func TestRunQuery(t *testing.T) {
+	var calledQueryCtx table.QueryContext
+	plugin, err := table.NewPlugin(
+		"mytable",
+		exampleRow{},
+		table.GenerateRows(func(ctx context.Context, queryCtx table.QueryContext) ([]table.RowDefinition, error) {
+			calledQueryCtx = queryCtx
+			return []table.RowDefinition{
+				exampleRow{"foo", 1},
+				exampleRow{"bar", 2},
+				exampleRow{"baz", 3},
+			}, nil
+		}),
+	)
+	require.NoError(t, err)
+	m := newTestManager(t, plugin)
+
+	rows, err := m.RunQuery(context.Background(), "select * from mytable")
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]string{
+		{"name": "foo", "count": "1"},
+		{"name": "bar", "count": "2"},
+		{"name": "baz", "count": "3"},
+	}, rows)
+	assert.Equal(t, table.QueryContext{Constraints: map[string]table.ConstraintList{}}, calledQueryCtx)
+
+	// The constraints are passed to the plugin and also applied to the
+	// returned rows, as the plugin above ignores them. The columns used
+	// include those which are constrained.
+	rows, err = m.RunQuery(context.Background(), "select name from mytable where count > 1 and label like 'b%' and count < 10")
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]string{{"name": "bar"}, {"name": "baz"}}, rows)
+	assert.Equal(t, table.QueryContext{Constraints: map[string]table.ConstraintList{
+		"count": {Affinity: table.ColumnTypeInteger, Constraints: []table.Constraint{
+			{Operator: table.OperatorGreaterThan, Expression: "1"},
+			{Operator: table.OperatorLessThan, Expression: "10"},
+		}},
+		"name": {Affinity: table.ColumnTypeText, Constraints: []table.Constraint{
+			{Operator: table.OperatorLike, Expression: "b%"},
+		}},
+	}, SelectedColumns: []string{"count", "name"}}, calledQueryCtx)
+
+	resp, err := m.Query(context.Background(), "select * from mytable where count = 3")
+	require.NoError(t, err)
+	assert.Equal(t, int32(0), resp.Status.Code)
+	assert.Equal(t, osquery.ExtensionPluginResponse{{"name": "baz", "count": "3"}}, resp.Response)
+
+	resp, err = m.GetQueryColumns(context.Background(), "select count from mytable")
+	require.NoError(t, err)
+	assert.Equal(t, osquery.ExtensionPluginResponse{{"count": "INTEGER"}}, resp.Response)
+}
+
+func TestMockExtensionManagerSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "osquery-go-osquerytest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	sockPath := filepath.Join(dir, "osquery.em")
+
+	m, err := NewMockExtensionManager(sockPath)
+	require.NoError(t, err)
+	defer m.Close()
+
+	plugin, err := table.NewPlugin(
+		"mytable",
+		exampleRow{},
+		table.GenerateRows(func(ctx context.Context, queryCtx table.QueryContext) ([]table.RowDefinition, error) {
+			return []table.RowDefinition{exampleRow{"foo", 1}, exampleRow{"bar", 2}}, nil
+		}),
+	)
+	require.NoError(t, err)
+
+	// A real extension registers over the manager's socket, and the manager
+	// calls the table over the extension's socket
+	server, err := osqueryext.NewExtensionManagerServer("test", sockPath)
+	require.NoError(t, err)
+	require.NoError(t, server.RegisterPlugin(plugin))
+	go server.Start()
+	defer server.Shutdown(context.Background())
+	for start := time.Now(); server.SocketPath() == ""; time.Sleep(10 * time.Millisecond) {
+		require.True(t, time.Since(start) < 5*time.Second, "extension didn't register")
+	}
+	assert.Equal(t, sockPath+".1", server.SocketPath())
+
+	rows, err := m.RunQuery(context.Background(), "select name from mytable where count > 1")
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]string{{"name": "bar"}}, rows)
+}
+
+func TestRunQueryDistinct(t *testing.T) {
+	var calledQueryCtx table.QueryContext
+	plugin, err := table.NewPlugin(
+		"mytable",
+		exampleRow{},
+		table.GenerateRows(func(ctx context.Context, queryCtx table.QueryContext) ([]table.RowDefinition, error) {
+			calledQueryCtx = queryCtx
+			return []table.RowDefinition{
+				exampleRow{"foo", 1},
+				exampleRow{"foo", 2},
+				exampleRow{"bar", 3},
+			}, nil
+		}),
+	)
+	require.NoError(t, err)
+	m := newTestManager(t, plugin)
+
+	rows, err := m.RunQuery(context.Background(), "select distinct name from mytable")
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]string{{"name": "foo"}, {"name": "bar"}}, rows)
+	assert.True(t, calledQueryCtx.Distinct)
+	assert.Equal(t, []string{"name"}, calledQueryCtx.SelectedColumns)
+
+	rows, err = m.RunQuery(context.Background(), "select name from mytable")
+	require.NoError(t, err)
+	assert.Len(t, rows, 3)
+	assert.False(t, calledQueryCtx.Distinct)
+}
+
+func TestRunQueryErrors(t *testing.T) {
+	plugin, err := table.NewPlugin(
+		"mytable",
+		exampleRow{},
+		table.GenerateRows(func(ctx context.Context, queryCtx table.QueryContext) ([]table.RowDefinition, error) {
+			return nil, assert.AnError
+		}),
+	)
+	require.NoError(t, err)
+	m := newTestManager(t, plugin)
+
+	_, err = m.RunQuery(context.Background(), "select * from othertable")
+	assert.EqualError(t, err, "no such table plugin: othertable")
+
+	_, err = m.RunQuery(context.Background(), "select * from mytable where missing = 1")
+	assert.EqualError(t, err, "no such column: missing")
+
+	_, err = m.RunQuery(context.Background(), "select * from mytable")
+	assert.EqualError(t, err, "calling table mytable: status 1: error generating table: "+assert.AnError.Error())
+
+	resp, err := m.Query(context.Background(), "select * from")
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), resp.Status.Code)
+	assert.Equal(t, "parsing query: expected table name, got end of query", resp.Status.Message)
+}
+
+func TestRegisterExtension(t *testing.T) {
+	m := newMockExtensionManager("/tmp/osquery.em")
+	registry := osquery.ExtensionRegistry{"table": {"mytable": {}}}
+
+	stat, err := m.RegisterExtension(context.Background(), &osquery.InternalExtensionInfo{Name: "first"}, registry)
+	require.NoError(t, err)
+	assert.Equal(t, int32(0), stat.Code)
+
+	stat, err = m.RegisterExtension(context.Background(), &osquery.InternalExtensionInfo{Name: "second"}, registry)
+	require.NoError(t, err)
+	assert.Equal(t, &osquery.ExtensionStatus{Code: 1, Message: "duplicate table plugin mytable"}, stat)
+
+	extensions, err := m.Extensions(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, osquery.InternalExtensionList{
+		0: {Name: "core", Version: "mock"},
+		1: {Name: "first"},
+	}, extensions)
+
+	stat, err = m.DeregisterExtension(context.Background(), 1)
+	require.NoError(t, err)
+	assert.Equal(t, int32(0), stat.Code)
+
+	stat, err = m.RegisterExtension(context.Background(), &osquery.InternalExtensionInfo{Name: "second"}, registry)
+	require.NoError(t, err)
+	assert.Equal(t, &osquery.ExtensionStatus{Code: 0, Message: "OK", UUID: 2}, stat)
+}
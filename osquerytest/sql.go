@@ -0,0 +1,239 @@
+package osquerytest
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/bradleyjkemp/osquery-go/plugin/table"
+	"github.com/pkg/errors"
+)
+
+// selectQuery is a parsed query of the form
+//
+//	SELECT [DISTINCT] * | column [, column...] FROM table [WHERE column op value [AND ...]]
+type selectQuery struct {
+	table       string
+	columns     []string // nil when all columns are selected
+	distinct    bool
+	constraints []whereConstraint
+}
+
+type whereConstraint struct {
+	column string
+	table.Constraint
+}
+
+// operators maps the comparison operators osquery passes to table plugins to
+// their constraint operators.
+var operators = map[string]table.Operator{
+	"=":      table.OperatorEquals,
+	"==":     table.OperatorEquals,
+	">":      table.OperatorGreaterThan,
+	">=":     table.OperatorGreaterThanOrEquals,
+	"<":      table.OperatorLessThan,
+	"<=":     table.OperatorLessThanOrEquals,
+	"LIKE":   table.OperatorLike,
+	"GLOB":   table.OperatorGlob,
+	"MATCH":  table.OperatorMatch,
+	"REGEXP": table.OperatorRegexp,
+}
+
+type tokenKind int
+
+const (
+	tokenWord tokenKind = iota
+	tokenString
+	tokenSymbol
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+// is reports whether the token is the given keyword or symbol, ignoring case.
+func (t token) is(text string) bool {
+	return t.kind != tokenString && strings.EqualFold(t.text, text)
+}
+
+// parseQuery parses the small subset of SQL that is needed to query a single
+// table with constraints. Joins, subqueries, OR and functions are not
+// supported.
+func parseQuery(sql string) (*selectQuery, error) {
+	tokens, err := tokenize(sql)
+	if err != nil {
+		return nil, err
+	}
+	if n := len(tokens); n > 0 && tokens[n-1].is(";") {
+		tokens = tokens[:n-1]
+	}
+
+	p := &queryParser{tokens: tokens}
+	query := &selectQuery{}
+	if err := p.expect("SELECT"); err != nil {
+		return nil, err
+	}
+	query.distinct = p.accept("DISTINCT")
+	if p.accept("*") {
+		query.columns = nil
+	} else {
+		for {
+			column, err := p.word("column name")
+			if err != nil {
+				return nil, err
+			}
+			query.columns = append(query.columns, column)
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+
+	if err := p.expect("FROM"); err != nil {
+		return nil, err
+	}
+	if query.table, err = p.word("table name"); err != nil {
+		return nil, err
+	}
+
+	if p.accept("WHERE") {
+		for {
+			constraint, err := p.constraint()
+			if err != nil {
+				return nil, err
+			}
+			query.constraints = append(query.constraints, constraint)
+			if !p.accept("AND") {
+				break
+			}
+		}
+	}
+
+	if !p.done() {
+		return nil, errors.Errorf("unexpected %q", p.peek().text)
+	}
+	return query, nil
+}
+
+type queryParser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *queryParser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *queryParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *queryParser) accept(text string) bool {
+	if !p.done() && p.peek().is(text) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *queryParser) expect(text string) error {
+	if p.accept(text) {
+		return nil
+	}
+	if p.done() {
+		return errors.Errorf("expected %s, got end of query", text)
+	}
+	return errors.Errorf("expected %s, got %q", text, p.peek().text)
+}
+
+func (p *queryParser) word(what string) (string, error) {
+	if p.done() {
+		return "", errors.Errorf("expected %s, got end of query", what)
+	}
+	tok := p.peek()
+	if tok.kind != tokenWord {
+		return "", errors.Errorf("expected %s, got %q", what, tok.text)
+	}
+	p.pos++
+	return tok.text, nil
+}
+
+func (p *queryParser) constraint() (whereConstraint, error) {
+	column, err := p.word("column name")
+	if err != nil {
+		return whereConstraint{}, err
+	}
+	if p.done() {
+		return whereConstraint{}, errors.New("expected operator, got end of query")
+	}
+	op, ok := operators[strings.ToUpper(p.peek().text)]
+	if !ok || p.peek().kind == tokenString {
+		return whereConstraint{}, errors.Errorf("unsupported operator %q", p.peek().text)
+	}
+	p.pos++
+
+	if p.done() {
+		return whereConstraint{}, errors.New("expected value, got end of query")
+	}
+	value := p.peek()
+	if value.kind == tokenSymbol {
+		return whereConstraint{}, errors.Errorf("expected value, got %q", value.text)
+	}
+	p.pos++
+	return whereConstraint{column, table.Constraint{Operator: op, Expression: value.text}}, nil
+}
+
+// tokenize splits a query into words, quoted strings and symbols. Quoted
+// strings use SQL quoting where a doubled quote is an escaped quote.
+func tokenize(sql string) ([]token, error) {
+	var tokens []token
+	runes := []rune(sql)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+
+		case r == '\'' || r == '"':
+			var text strings.Builder
+			closed := false
+			for i++; i < len(runes); i++ {
+				if runes[i] == r {
+					if i+1 < len(runes) && runes[i+1] == r {
+						text.WriteRune(r)
+						i++
+						continue
+					}
+					closed = true
+					i++
+					break
+				}
+				text.WriteRune(runes[i])
+			}
+			if !closed {
+				return nil, errors.New("unterminated quoted string")
+			}
+			tokens = append(tokens, token{tokenString, text.String()})
+
+		case strings.ContainsRune("<>=!", r):
+			text := string(r)
+			if i+1 < len(runes) && strings.ContainsRune("<>=", runes[i+1]) {
+				text += string(runes[i+1])
+			}
+			i += len([]rune(text))
+			tokens = append(tokens, token{tokenSymbol, text})
+
+		case strings.ContainsRune(",*;()", r):
+			tokens = append(tokens, token{tokenSymbol, string(r)})
+			i++
+
+		default:
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && !strings.ContainsRune("'\"<>=!,*;()", runes[i]) {
+				i++
+			}
+			tokens = append(tokens, token{tokenWord, string(runes[start:i])})
+		}
+	}
+	return tokens, nil
+}
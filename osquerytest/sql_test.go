@@ -0,0 +1,80 @@
+package osquerytest
+
+import (
+	"testing"
+
+	"github.com/bradleyjkemp/osquery-go/plugin/table"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseQuery(t *testing.T) {
+	var testCases = []struct {
+		sql      string
+		expected *selectQuery
+	}{
+		{
+			sql:      "select * from mytable",
+			expected: &selectQuery{table: "mytable"},
+		},
+		{
+			sql:      "SELECT a, b FROM mytable;",
+			expected: &selectQuery{table: "mytable", columns: []string{"a", "b"}},
+		},
+		{
+			sql:      "select distinct a from mytable",
+			expected: &selectQuery{table: "mytable", columns: []string{"a"}, distinct: true},
+		},
+		{
+			sql: "select * from mytable where x = 1 and name like 'it''s%' AND y>=-2.5",
+			expected: &selectQuery{
+				table: "mytable",
+				constraints: []whereConstraint{
+					{"x", table.Constraint{Operator: table.OperatorEquals, Expression: "1"}},
+					{"name", table.Constraint{Operator: table.OperatorLike, Expression: "it's%"}},
+					{"y", table.Constraint{Operator: table.OperatorGreaterThanOrEquals, Expression: "-2.5"}},
+				},
+			},
+		},
+		{
+			sql: `select * from mytable where path glob "/tmp/*" and size < 10`,
+			expected: &selectQuery{
+				table: "mytable",
+				constraints: []whereConstraint{
+					{"path", table.Constraint{Operator: table.OperatorGlob, Expression: "/tmp/*"}},
+					{"size", table.Constraint{Operator: table.OperatorLessThan, Expression: "10"}},
+				},
+			},
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.sql, func(t *testing.T) {
+			query, err := parseQuery(tt.sql)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, query)
+		})
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	var testCases = []struct {
+		sql string
+		err string
+	}{
+		{"", "expected SELECT, got end of query"},
+		{"delete from mytable", `expected SELECT, got "delete"`},
+		{"select * from", "expected table name, got end of query"},
+		{"select * from mytable where x != 1", `unsupported operator "!="`},
+		{"select * from mytable where x = 1 or y = 2", `unexpected "or"`},
+		{"select * from mytable where x = 'foo", "unterminated quoted string"},
+		{"select * from mytable where x =", "expected value, got end of query"},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.sql, func(t *testing.T) {
+			_, err := parseQuery(tt.sql)
+			assert.EqualError(t, err, tt.err)
+		})
+	}
+}
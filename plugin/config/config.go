@@ -17,6 +17,11 @@ import (
 // cancellation in long-running operations.
 type GenerateConfigsFunc func(ctx context.Context) (map[string]Config, error)
 
+// GenerateRawConfigsFunc is like GenerateConfigsFunc but returns each config
+// source as a JSON string. This is useful for serving configs which are
+// stored as JSON or use options not modelled by the Config struct.
+type GenerateRawConfigsFunc func(ctx context.Context) (map[string]string, error)
+
 type Config struct {
 	Options               map[string]interface{}           `json:"options,omitempty"`
 	Schedule              map[string]Query                 `json:"schedule,omitempty"`
@@ -49,8 +54,9 @@ type AutoTableConstruction struct {
 // Plugin is an osquery configuration plugin. Plugin implements the OsqueryPlugin
 // interface.
 type Plugin struct {
-	name     string
-	generate GenerateConfigsFunc
+	name        string
+	generate    GenerateConfigsFunc
+	generateRaw GenerateRawConfigsFunc
 }
 
 // NewConfigPlugin takes a value that implements ConfigPlugin and wraps it with
@@ -60,15 +66,21 @@ func NewPlugin(name string, fn GenerateConfigsFunc) *Plugin {
 	return &Plugin{name: name, generate: fn}
 }
 
+// NewRawPlugin is like NewPlugin but takes a function returning the config
+// sources as JSON strings.
+func NewRawPlugin(name string, fn GenerateRawConfigsFunc) *Plugin {
+	return &Plugin{name: name, generateRaw: fn}
+}
+
 func (t *Plugin) Name() string {
 	return t.name
 }
 
-// Registry name for config plugins
-const configRegistryName = "config"
+// Registry is the name of the osquery registry for config plugins.
+const Registry = "config"
 
 func (t *Plugin) RegistryName() string {
-	return configRegistryName
+	return Registry
 }
 
 func (t *Plugin) Routes() osquery.ExtensionPluginResponse {
@@ -88,17 +100,11 @@ const genConfigAction = "genConfig"
 func (t *Plugin) Call(ctx context.Context, request osquery.ExtensionPluginRequest) (osquery.ExtensionPluginResponse, error) {
 	switch request[requestActionKey] {
 	case genConfigAction:
-		configs, err := t.generate(ctx)
+		resp, err := t.generateConfigs(ctx)
 		if err != nil {
 			return nil, fmt.Errorf("error getting config: %w", err)
 		}
 
-		resp := map[string]string{}
-		for source, config := range configs {
-			c, _ := json.Marshal(config)
-			resp[source] = string(c)
-		}
-
 		return osquery.ExtensionPluginResponse{resp}, nil
 
 	default:
@@ -108,4 +114,23 @@ func (t *Plugin) Call(ctx context.Context, request osquery.ExtensionPluginReques
 
 }
 
+// generateConfigs returns the JSON of each config source.
+func (t *Plugin) generateConfigs(ctx context.Context) (map[string]string, error) {
+	if t.generateRaw != nil {
+		return t.generateRaw(ctx)
+	}
+
+	configs, err := t.generate(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := map[string]string{}
+	for source, config := range configs {
+		c, _ := json.Marshal(config)
+		resp[source] = string(c)
+	}
+	return resp, nil
+}
+
 func (t *Plugin) Shutdown() {}
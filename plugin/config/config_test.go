@@ -35,6 +35,32 @@ func TestConfigPlugin(t *testing.T) {
 	assert.Equal(t, osquery.ExtensionPluginResponse{{"conf1": `{"options":{"foo":"bar"}}`}}, resp)
 }
 
+func TestRawConfigPlugin(t *testing.T) {
+	plugin := NewRawPlugin("mock", func(context.Context) (map[string]string, error) {
+		return map[string]string{
+			"pack1": `{"packs":{"pack1":{"queries":{}}}}`,
+			"pack2": `{"packs":{"pack2":{"queries":{}}}}`,
+		}, nil
+	})
+
+	assert.Equal(t, "config", plugin.RegistryName())
+	assert.Equal(t, "mock", plugin.Name())
+
+	resp, err := plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "genConfig"})
+	assert.NoError(t, err)
+	assert.Equal(t, osquery.ExtensionPluginResponse{{
+		"pack1": `{"packs":{"pack1":{"queries":{}}}}`,
+		"pack2": `{"packs":{"pack2":{"queries":{}}}}`,
+	}}, resp)
+
+	plugin = NewRawPlugin("mock", func(context.Context) (map[string]string, error) {
+		return nil, errors.New("foobar")
+	})
+	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "genConfig"})
+	assert.Error(t, err)
+	assert.Equal(t, "error getting config: foobar", err.Error())
+}
+
 func TestConfigPluginErrors(t *testing.T) {
 	var called bool
 	plugin := NewPlugin("mock", func(context.Context) (map[string]Config, error) {
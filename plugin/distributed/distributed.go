@@ -43,10 +43,22 @@ type Result struct {
 	QueryName string `json:"query_name"`
 	// Status is an integer status code for the query execution (0 = OK)
 	Status int `json:"status"`
-	// Rows is the result rows of the query.
+	// Message is a description of the query status, typically the error
+	// message if the query failed.
+	Message string `json:"message"`
+	// Rows is the result rows of the query. It is empty for results without
+	// any rows, including those of queries which failed to run. Only
+	// results created with StatusResult have nil rows.
 	Rows []map[string]string `json:"rows"`
 }
 
+// StatusResult returns a result which records only the outcome of a query,
+// without any rows. EncodeResults encodes it with a status but no result, as
+// osquery does for queries which fail.
+func StatusResult(queryName string, status int, message string) Result {
+	return Result{QueryName: queryName, Status: status, Message: message}
+}
+
 // WriteResultsFunc writes the results of the executed distributed queries. The
 // query results will be serialized JSON in the results map with the query name
 // as the key.
@@ -71,11 +83,11 @@ func (t *Plugin) Name() string {
 	return t.name
 }
 
-// Registry name for distributed plugins
-const distributedRegistryName = "distributed"
+// Registry is the name of the osquery registry for distributed plugins.
+const Registry = "distributed"
 
 func (t *Plugin) RegistryName() string {
-	return distributedRegistryName
+	return Registry
 }
 
 func (t *Plugin) Routes() osquery.ExtensionPluginResponse {
@@ -139,6 +151,7 @@ func (oi *OsqueryInt) UnmarshalJSON(buff []byte) error {
 type ResultsStruct struct {
 	Queries  map[string][]map[string]string `json:"queries"`
 	Statuses map[string]OsqueryInt          `json:"statuses"`
+	Messages map[string]string              `json:"messages"`
 }
 
 // UnmarshalJSON turns structurally inconsistent osquery json into a ResultsStruct.
@@ -146,17 +159,22 @@ func (rs *ResultsStruct) UnmarshalJSON(buff []byte) error {
 	emptyRow := []map[string]string{}
 	rs.Queries = make(map[string][]map[string]string)
 	rs.Statuses = make(map[string]OsqueryInt)
+	rs.Messages = make(map[string]string)
 	// Queries can be []map[string]string OR an empty string
 	// so we need to deal with an interface to accomodate two types
 	intermediate := struct {
 		Queries  map[string]interface{} `json:"queries"`
 		Statuses map[string]OsqueryInt  `json:"statuses"`
+		Messages map[string]string      `json:"messages"`
 	}{}
 	if err := json.Unmarshal(buff, &intermediate); err != nil {
 		return err
 	}
 	for queryName, status := range intermediate.Statuses {
 		rs.Statuses[queryName] = status
+		if message, ok := intermediate.Messages[queryName]; ok {
+			rs.Messages[queryName] = message
+		}
 		// Sometimes we have a status but don't have a corresponding
 		// result.
 		queryResult, ok := intermediate.Queries[queryName]
@@ -189,12 +207,52 @@ func (rs *ResultsStruct) toResults() ([]Result, error) {
 			QueryName: queryName,
 			Rows:      rows,
 			Status:    int(rs.Statuses[queryName]),
+			Message:   rs.Messages[queryName],
 		}
 		results = append(results, result)
 	}
 	return results, nil
 }
 
+// EncodeResults encodes results in the JSON format osquery passes to the
+// writeResults action, which is the inverse of how the plugin parses them.
+// Status only results are encoded with a status but no rows, as osquery does
+// for queries which fail. This is useful for testing a WriteResultsFunc, or for
+// forwarding results to another plugin.
+func EncodeResults(results []Result) (string, error) {
+	encoded := struct {
+		Queries  map[string]interface{} `json:"queries"`
+		Statuses map[string]int         `json:"statuses"`
+		Messages map[string]string      `json:"messages,omitempty"`
+	}{
+		Queries:  map[string]interface{}{},
+		Statuses: map[string]int{},
+	}
+	for _, result := range results {
+		encoded.Statuses[result.QueryName] = result.Status
+		if result.Message != "" {
+			if encoded.Messages == nil {
+				encoded.Messages = map[string]string{}
+			}
+			encoded.Messages[result.QueryName] = result.Message
+		}
+		switch {
+		case result.Rows == nil:
+		case len(result.Rows) == 0:
+			// osquery sends an empty string for queries without rows
+			encoded.Queries[result.QueryName] = ""
+		default:
+			encoded.Queries[result.QueryName] = result.Rows
+		}
+	}
+
+	resultsJSON, err := json.Marshal(encoded)
+	if err != nil {
+		return "", fmt.Errorf("error marshalling results: %w", err)
+	}
+	return string(resultsJSON), nil
+}
+
 func convertRows(rows []interface{}) ([]map[string]string, error) {
 	var results []map[string]string
 	for _, intf := range rows {
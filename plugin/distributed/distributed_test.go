@@ -63,9 +63,30 @@ func TestDistributedPlugin(t *testing.T) {
 	// Ensure correct ordering for comparison
 	sort.Slice(results, func(i, j int) bool { return results[i].QueryName < results[j].QueryName })
 	assert.Equal(t, []Result{
-		{"query1", 0, []map[string]string{{"iso_8601": "2017-07-10T22:08:40Z"}}},
-		{"query2", 0, []map[string]string{{"version": "2.4.0"}}},
-		{"query3", 1, []map[string]string{}},
+		{"query1", 0, "", []map[string]string{{"iso_8601": "2017-07-10T22:08:40Z"}}},
+		{"query2", 0, "", []map[string]string{{"version": "2.4.0"}}},
+		{"query3", 1, "", []map[string]string{}},
+	},
+		results)
+}
+
+func TestDistributedPluginStatusMessages(t *testing.T) {
+	var results []Result
+	plugin := NewPlugin(
+		"mock",
+		nil,
+		func(ctx context.Context, res []Result) error {
+			results = res
+			return nil
+		},
+	)
+
+	_, err := plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "writeResults", "results": `{"queries":{"query1":[{"version":"2.4.0"}],"query2":""},"statuses":{"query1":"0","query2":"1"},"messages":{"query1":"","query2":"no such table: foo"}}`})
+	assert.NoError(t, err)
+	sort.Slice(results, func(i, j int) bool { return results[i].QueryName < results[j].QueryName })
+	assert.Equal(t, []Result{
+		{"query1", 0, "", []map[string]string{{"version": "2.4.0"}}},
+		{"query2", 1, "no such table: foo", []map[string]string{}},
 	},
 		results)
 }
@@ -208,3 +229,35 @@ func TestHandleResults(t *testing.T) {
 	assert.Len(t, results, 8)
 	assert.NoError(t, err)
 }
+
+func TestEncodeResults(t *testing.T) {
+	sent := []Result{
+		{"query1", 0, "", []map[string]string{{"version": "2.4.0"}}},
+		{"query2", 0, "", []map[string]string{}},
+		StatusResult("query3", 1, "no such table: foo"),
+	}
+	encoded, err := EncodeResults(sent)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"queries":{"query1":[{"version":"2.4.0"}],"query2":""},"statuses":{"query1":0,"query2":0,"query3":1},"messages":{"query3":"no such table: foo"}}`, encoded)
+
+	// The plugin decodes the results it was sent
+	var results []Result
+	plugin := NewPlugin(
+		"mock",
+		nil,
+		func(ctx context.Context, res []Result) error {
+			results = res
+			return nil
+		},
+	)
+	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "writeResults", "results": encoded})
+	require.NoError(t, err)
+	// Status only results are received without any rows, as osquery sends
+	// them
+	sort.Slice(results, func(i, j int) bool { return results[i].QueryName < results[j].QueryName })
+	assert.Equal(t, []Result{
+		sent[0],
+		sent[1],
+		{"query3", 1, "no such table: foo", []map[string]string{}},
+	}, results)
+}
@@ -0,0 +1,190 @@
+package logger
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// BatchLogFunc is the logger function used by a batching osquery Logger
+// plugin. It is passed all of the logs received since the previous batch, in
+// the order that osquery sent them.
+type BatchLogFunc func(ctx context.Context, logs []Log) error
+
+// Option configures optional behaviour of a logger Plugin.
+type Option func(*Plugin)
+
+// BatchOption configures optional behaviour of a batching logger Plugin.
+// Every Option is also a BatchOption, but options such as BatchSize which only
+// apply to batching can't be passed to NewPlugin.
+type BatchOption interface {
+	applyBatch(*Plugin)
+}
+
+func (o Option) applyBatch(p *Plugin) {
+	o(p)
+}
+
+type batchOption func(*batcher)
+
+func (o batchOption) applyBatch(p *Plugin) {
+	o(p.batch)
+}
+
+// BatchErrorHandler is called with errors from writing a batch of logs.
+type BatchErrorHandler func(err error)
+
+const (
+	defaultBatchSize     = 100
+	defaultFlushInterval = 5 * time.Second
+)
+
+// BatchSize sets the number of logs a batching plugin buffers before they are
+// written. It defaults to 100.
+func BatchSize(size int) BatchOption {
+	return batchOption(func(b *batcher) {
+		b.size = size
+	})
+}
+
+// FlushInterval sets the longest time a batching plugin will buffer logs for
+// before they are written, regardless of how many are buffered. It defaults to
+// 5 seconds. An interval of zero disables the periodic flush.
+func FlushInterval(interval time.Duration) BatchOption {
+	return batchOption(func(b *batcher) {
+		b.interval = interval
+	})
+}
+
+// WithBatchErrorHandler sets a function to be called when a batch of logs
+// can't be written. As batches are written in the background, or alongside a
+// different log than the one which failed, these errors aren't returned to
+// osquery. Set this, for example to the server's ErrorHandler, to find out
+// about them.
+func WithBatchErrorHandler(handler BatchErrorHandler) BatchOption {
+	return batchOption(func(b *batcher) {
+		b.onError = handler
+	})
+}
+
+// NewBatchPlugin creates a logger plugin which buffers the logs it receives
+// and writes them in batches, whichever comes first of BatchSize logs being
+// buffered or FlushInterval passing. Any buffered logs are written when the
+// plugin is shut down.
+//
+// The logs from a batch which fails to be written are kept and written again,
+// ahead of any newer logs, with the next batch.
+func NewBatchPlugin(name string, fn BatchLogFunc, opts ...BatchOption) *Plugin {
+	plugin := &Plugin{
+		name: name,
+		batch: &batcher{
+			fn:       fn,
+			size:     defaultBatchSize,
+			interval: defaultFlushInterval,
+			done:     make(chan struct{}),
+			stopped:  make(chan struct{}),
+		},
+	}
+
+	for _, opt := range opts {
+		opt.applyBatch(plugin)
+	}
+
+	go plugin.batch.run()
+	return plugin
+}
+
+type batcher struct {
+	fn       BatchLogFunc
+	size     int
+	interval time.Duration
+	onError  BatchErrorHandler
+
+	// mutex protects the buffer and whether the batcher has been stopped.
+	mutex  sync.Mutex
+	buffer []Log
+	closed bool
+
+	// flushMutex is held while a batch is being written so that batches
+	// are written one at a time and in order.
+	flushMutex sync.Mutex
+
+	done     chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+// add buffers the log, writing the buffered batch if it is full. Once the
+// batcher has been stopped, logs are written immediately as nothing else would
+// write them. The log is kept if the batch can't be written, so the error is
+// reported to the error handler rather than returned.
+func (b *batcher) add(ctx context.Context, log Log) {
+	b.mutex.Lock()
+	b.buffer = append(b.buffer, log)
+	full := len(b.buffer) >= b.size || b.closed
+	b.mutex.Unlock()
+
+	if full {
+		b.flush(ctx)
+	}
+}
+
+// flush writes the buffered logs. If they can't be written, they are put back
+// at the front of the buffer to be written with the next batch.
+func (b *batcher) flush(ctx context.Context) {
+	b.flushMutex.Lock()
+	defer b.flushMutex.Unlock()
+
+	b.mutex.Lock()
+	logs := b.buffer
+	b.buffer = nil
+	b.mutex.Unlock()
+
+	if len(logs) == 0 {
+		return
+	}
+	if err := b.fn(ctx, logs); err != nil {
+		b.mutex.Lock()
+		b.buffer = append(logs, b.buffer...)
+		b.mutex.Unlock()
+
+		if b.onError != nil {
+			b.onError(fmt.Errorf("error logging batch of %d logs: %w", len(logs), err))
+		}
+	}
+}
+
+func (b *batcher) run() {
+	defer close(b.stopped)
+	if b.interval <= 0 {
+		<-b.done
+		return
+	}
+
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.flush(context.Background())
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// stop ends the periodic flushing and writes any remaining logs. Logs added
+// before the batcher is marked as closed are written by the final flush, and
+// those added after are written by add, so none are lost.
+func (b *batcher) stop() {
+	b.stopOnce.Do(func() {
+		close(b.done)
+	})
+	<-b.stopped
+
+	b.mutex.Lock()
+	b.closed = true
+	b.mutex.Unlock()
+	b.flush(context.Background())
+}
@@ -0,0 +1,209 @@
+package logger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bradleyjkemp/osquery-go/gen/osquery"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatchPluginSize(t *testing.T) {
+	var batches [][]Log
+	plugin := NewBatchPlugin("mock", func(ctx context.Context, logs []Log) error {
+		batches = append(batches, logs)
+		return nil
+	}, BatchSize(2), FlushInterval(0))
+
+	assert.Equal(t, "logger", plugin.RegistryName())
+	assert.Equal(t, "mock", plugin.Name())
+
+	for _, log := range []string{"one", "two", "three"} {
+		_, err := plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"string": log})
+		require.NoError(t, err)
+	}
+	assert.Equal(t, [][]Log{
+		{UnknownLog{"string": "one"}, UnknownLog{"string": "two"}},
+	}, batches)
+
+	// Remaining logs are written on shutdown
+	plugin.Shutdown()
+	assert.Equal(t, [][]Log{
+		{UnknownLog{"string": "one"}, UnknownLog{"string": "two"}},
+		{UnknownLog{"string": "three"}},
+	}, batches)
+
+	// Shutting down again is harmless
+	plugin.Shutdown()
+	assert.Len(t, batches, 2)
+}
+
+func TestBatchPluginInterval(t *testing.T) {
+	var mutex sync.Mutex
+	var batches [][]Log
+	plugin := NewBatchPlugin("mock", func(ctx context.Context, logs []Log) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		batches = append(batches, logs)
+		return nil
+	}, BatchSize(100), FlushInterval(10*time.Millisecond))
+	defer plugin.Shutdown()
+
+	_, err := plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"string": "one"})
+	require.NoError(t, err)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		mutex.Lock()
+		flushed := len(batches)
+		mutex.Unlock()
+		if flushed > 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(t, [][]Log{{UnknownLog{"string": "one"}}}, batches)
+}
+
+func TestBatchPluginErrors(t *testing.T) {
+	var batches [][]Log
+	var errs []error
+	fail := true
+	plugin := NewBatchPlugin("mock", func(ctx context.Context, logs []Log) error {
+		if fail {
+			return errors.New("foobar")
+		}
+		batches = append(batches, logs)
+		return nil
+	}, BatchSize(1), FlushInterval(0), WithBatchErrorHandler(func(err error) {
+		errs = append(errs, err)
+	}))
+
+	// The failure is reported to the error handler rather than osquery,
+	// and the log is kept to be written with the next batch
+	_, err := plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"string": "one"})
+	require.NoError(t, err)
+	require.Len(t, errs, 1)
+	assert.Equal(t, "error logging batch of 1 logs: foobar", errs[0].Error())
+	assert.Empty(t, batches)
+
+	fail = false
+	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"string": "two"})
+	require.NoError(t, err)
+	assert.Len(t, errs, 1)
+	assert.Equal(t, [][]Log{
+		{UnknownLog{"string": "one"}, UnknownLog{"string": "two"}},
+	}, batches)
+}
+
+func TestBatchPluginShutdownError(t *testing.T) {
+	var errs []error
+	plugin := NewBatchPlugin("mock", func(ctx context.Context, logs []Log) error {
+		return errors.New("foobar")
+	}, BatchSize(100), FlushInterval(0), WithBatchErrorHandler(func(err error) {
+		errs = append(errs, err)
+	}))
+
+	_, err := plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"string": "one"})
+	require.NoError(t, err)
+	assert.Empty(t, errs)
+
+	plugin.Shutdown()
+	require.Len(t, errs, 1)
+	assert.Equal(t, "error logging batch of 1 logs: foobar", errs[0].Error())
+}
+
+func TestBatchPluginOptions(t *testing.T) {
+	// Plugin options can be used with a batching plugin
+	var initialized string
+	plugin := NewBatchPlugin("mock", func(ctx context.Context, logs []Log) error {
+		return nil
+	}, WithInit(func(ctx context.Context, name string) error {
+		initialized = name
+		return nil
+	}), FlushInterval(0))
+	defer plugin.Shutdown()
+
+	_, err := plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"init": "osqueryd"})
+	require.NoError(t, err)
+	assert.Equal(t, "osqueryd", initialized)
+}
+
+func TestBatchPluginAfterShutdown(t *testing.T) {
+	var batches [][]Log
+	plugin := NewBatchPlugin("mock", func(ctx context.Context, logs []Log) error {
+		batches = append(batches, logs)
+		return nil
+	}, BatchSize(100), FlushInterval(0))
+	plugin.Shutdown()
+
+	// Logs received after shutdown are written straight away
+	_, err := plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"string": "late"})
+	require.NoError(t, err)
+	assert.Equal(t, [][]Log{{UnknownLog{"string": "late"}}}, batches)
+}
+
+func TestBatchPluginConcurrent(t *testing.T) {
+	const (
+		goroutines = 20
+		perRoutine = 200
+	)
+
+	var mutex sync.Mutex
+	received := map[string]int{}
+	var oversized int
+	plugin := NewBatchPlugin("mock", func(ctx context.Context, logs []Log) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, log := range logs {
+			received[log.(UnknownLog)["string"]]++
+		}
+		// Batches only exceed the batch size by the logs added while a
+		// full batch is waiting to be written, at most one per caller.
+		if len(logs) > 7+goroutines {
+			oversized++
+		}
+		return nil
+	}, BatchSize(7), FlushInterval(time.Millisecond))
+
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			<-start
+			for i := 0; i < perRoutine; i++ {
+				request := osquery.ExtensionPluginRequest{"string": fmt.Sprintf("%d-%d", g, i)}
+				if _, err := plugin.Call(context.Background(), request); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(g)
+	}
+
+	// Shut down while the last logs are still being sent
+	close(start)
+	time.Sleep(time.Millisecond)
+	plugin.Shutdown()
+	wg.Wait()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Len(t, received, goroutines*perRoutine)
+	for log, count := range received {
+		if count != 1 {
+			t.Errorf("log %s written %d times", log, count)
+		}
+	}
+	assert.Zero(t, oversized)
+}
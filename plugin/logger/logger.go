@@ -5,6 +5,7 @@ package logger
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 
 	"github.com/bradleyjkemp/osquery-go/gen/osquery"
@@ -12,32 +13,75 @@ import (
 
 // LogFunc is the logger function used by an osquery Logger plugin.
 //
-// The LogFunc should log the provided result string. The LogType
-// argument can be optionally used to log differently depending on the
-// type of log received. The context argument can optionally be used
-// for cancellation in long-running operations.
+// The LogFunc should log the provided Log. The Type method of the Log
+// can be used to log differently depending on the type of log received,
+// for example sending status logs and query results to different places.
+// The context argument can optionally be used for cancellation in
+// long-running operations.
 type LogFunc func(ctx context.Context, log Log) error
 
+// InitFunc is called when osquery initializes a logger plugin, which it does
+// when the plugin is first used and again whenever its configuration changes,
+// so that the plugin can (re)configure where it sends logs. It is passed the
+// name of the osquery process, such as "osqueryd".
+type InitFunc func(ctx context.Context, name string) error
+
+// SnapshotFunc is passed a snapshot query result, which osquery sends as a
+// single log once the scheduled query has run. Its metadata, such as the name
+// of the query, is never nil.
+type SnapshotFunc func(ctx context.Context, snapshot *SnapshotResult) error
+
 // Plugin is an osquery logger plugin.
 // The Plugin struct implements the OsqueryPlugin interface.
 type Plugin struct {
-	name  string
-	logFn LogFunc
+	name       string
+	logFn      LogFunc
+	initFn     InitFunc
+	snapshotFn SnapshotFunc
+	batch      *batcher
 }
 
 // NewPlugin takes a value that implements LoggerPlugin and wraps it with
 // the appropriate methods to satisfy the OsqueryPlugin interface. Use this to
 // easily create plugins implementing osquery loggers.
-func NewPlugin(name string, fn LogFunc) *Plugin {
-	return &Plugin{name: name, logFn: fn}
+func NewPlugin(name string, fn LogFunc, opts ...Option) *Plugin {
+	plugin := &Plugin{name: name, logFn: fn}
+	for _, opt := range opts {
+		opt(plugin)
+	}
+	return plugin
+}
+
+// WithInit sets a function to be called when osquery initializes the plugin.
+// The init requests are then no longer passed to the plugin as logs of type
+// LogTypeInit. The status logs osquery buffered before the plugin was
+// initialized, which it sends along with the init request, are passed to the
+// plugin as a log of type LogTypeStatus once the function returns.
+func WithInit(fn InitFunc) Option {
+	return func(p *Plugin) {
+		p.initFn = fn
+	}
+}
+
+// WithSnapshot sets a function to be called with each decoded snapshot query
+// result, so that a snapshot can be processed as a whole. The
+// snapshots are then no longer passed to the plugin as logs of type
+// LogTypeSnapshot, and are not buffered by a batching plugin.
+func WithSnapshot(fn SnapshotFunc) Option {
+	return func(p *Plugin) {
+		p.snapshotFn = fn
+	}
 }
 
 func (t *Plugin) Name() string {
 	return t.name
 }
 
+// Registry is the name of the osquery registry for logger plugins.
+const Registry = "logger"
+
 func (t *Plugin) RegistryName() string {
-	return "logger"
+	return Registry
 }
 
 func (t *Plugin) Routes() osquery.ExtensionPluginResponse {
@@ -50,43 +94,42 @@ func (t *Plugin) Ping(ctx context.Context) osquery.ExtensionStatus {
 
 func (t *Plugin) Call(ctx context.Context, request osquery.ExtensionPluginRequest) (osquery.ExtensionPluginResponse, error) {
 	log := RequestToLog(request)
-	err := t.logFn(ctx, log)
-	if err != nil {
+
+	if t.initFn != nil && log.Type() == LogTypeInit {
+		if err := t.initFn(ctx, request["init"]); err != nil {
+			return nil, fmt.Errorf("error initializing logger: %w", err)
+		}
+		if request["log"] == "" {
+			return nil, nil
+		}
+		log = UnknownLog{"status": "true", "log": request["log"]}
+	}
+
+	if t.snapshotFn != nil && log.Type() == LogTypeSnapshot {
+		snapshot := &SnapshotResult{ResultMetadata: &ResultMetadata{}}
+		if err := json.Unmarshal([]byte(request["snapshot"]), snapshot); err != nil {
+			return nil, fmt.Errorf("error decoding snapshot: %w", err)
+		}
+		if err := t.snapshotFn(ctx, snapshot); err != nil {
+			return nil, fmt.Errorf("error logging snapshot: %w", err)
+		}
+		return nil, nil
+	}
+
+	if t.batch != nil {
+		t.batch.add(ctx, log)
+		return nil, nil
+	}
+	if err := t.logFn(ctx, log); err != nil {
 		return nil, fmt.Errorf("error logging: %w", err)
 	}
 
 	return nil, nil
 }
 
-func (t *Plugin) Shutdown() {}
-
-//LogType encodes the type of log osquery is outputting.
-//type LogType int
-//
-//const (
-//	LogTypeString LogType = iota
-//	LogTypeSnapshot
-//	LogTypeHealth
-//	LogTypeInit
-//	LogTypeStatus
-//)
-//
-//// String implements the fmt.Stringer interface for LogType.
-//func (l LogType) String() string {
-//	var typeString string
-//	switch l {
-//	case LogTypeString:
-//		typeString = "string"
-//	case LogTypeSnapshot:
-//		typeString = "snapshot"
-//	case LogTypeHealth:
-//		typeString = "health"
-//	case LogTypeInit:
-//		typeString = "init"
-//	case LogTypeStatus:
-//		typeString = "status"
-//	default:
-//		typeString = "unknown"
-//	}
-//	return typeString
-//}
+// Shutdown writes any logs still buffered by a batching plugin.
+func (t *Plugin) Shutdown() {
+	if t.batch != nil {
+		t.batch.stop()
+	}
+}
@@ -41,25 +41,30 @@ func TestLoggerPlugin(t *testing.T) {
 	// Log string
 	_, err := plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"string": "logged string"})
 	assert.NoError(t, err)
-	assert.Equal(t, LogTypeStatus, calledType)
+	assert.Equal(t, LogTypeString, calledType)
 	//assert.Equal(t, "logged string", calledLog)
 
 	// Log snapshot
 	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"snapshot": "logged snapshot"})
 	assert.NoError(t, err)
+	assert.Equal(t, LogTypeSnapshot, calledType)
+
+	// Log differential result
+	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"category": "event", "string": "{}"})
+	assert.NoError(t, err)
 	assert.Equal(t, LogTypeResult, calledType)
 	//assert.Equal(t, "logged snapshot", calledLog)
 
 	// Log health
 	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"health": "logged health"})
 	assert.NoError(t, err)
-	assert.Equal(t, LogTypeStatus, calledType)
+	assert.Equal(t, LogTypeHealth, calledType)
 	//assert.Equal(t, "logged health", calledLog)
 
 	// Log init
 	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"init": "logged init"})
 	assert.NoError(t, err)
-	assert.Equal(t, LogTypeStatus, calledType)
+	assert.Equal(t, LogTypeInit, calledType)
 	//assert.Equal(t, "logged init", calledLog)
 
 	// Log status
@@ -95,3 +100,81 @@ func TestLogPluginErrors(t *testing.T) {
 	assert.Error(t, err)
 	assert.Equal(t, "error logging: foobar", err.Error())
 }
+
+func TestLoggerPluginInit(t *testing.T) {
+	var logged []Log
+	logFn := func(ctx context.Context, log Log) error {
+		logged = append(logged, log)
+		return nil
+	}
+
+	var names []string
+	plugin := NewPlugin("mock", logFn, WithInit(func(ctx context.Context, name string) error {
+		names = append(names, name)
+		return nil
+	}))
+
+	_, err := plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"init": "osqueryd"})
+	assert.NoError(t, err)
+	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"string": "logged string"})
+	assert.NoError(t, err)
+
+	// The status logs buffered before initialization are logged
+	statusLogs := `{"":{"s":"0","f":"events.cpp","i":"828","m":"Event publisher failed setup"}}`
+	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"init": "osqueryd", "log": statusLogs})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"osqueryd", "osqueryd"}, names)
+	assert.Equal(t, []Log{
+		UnknownLog{"string": "logged string"},
+		UnknownLog{"status": "true", "log": statusLogs},
+	}, logged)
+
+	plugin = NewPlugin("mock", logFn, WithInit(func(ctx context.Context, name string) error {
+		return errors.New("bad config")
+	}))
+	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"init": "osqueryd"})
+	assert.EqualError(t, err, "error initializing logger: bad config")
+}
+
+func TestLoggerPluginSnapshot(t *testing.T) {
+	var logged []LogType
+	logFn := func(ctx context.Context, log Log) error {
+		logged = append(logged, log.Type())
+		return nil
+	}
+
+	var snapshots []*SnapshotResult
+	plugin := NewPlugin("mock", logFn, WithSnapshot(func(ctx context.Context, snapshot *SnapshotResult) error {
+		snapshots = append(snapshots, snapshot)
+		return nil
+	}))
+
+	_, err := plugin.Call(context.Background(), osquery.ExtensionPluginRequest{
+		"snapshot": `{"name":"processes","snapshot":[{"pid":"1","name":"init"},{"pid":"2","name":"kthreadd"}]}`,
+	})
+	assert.NoError(t, err)
+	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"category": "event", "string": "{}"})
+	assert.NoError(t, err)
+	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"snapshot": `{"snapshot":[]}`})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []*SnapshotResult{
+		{
+			ResultMetadata: &ResultMetadata{Name: "processes"},
+			Snapshot:       []map[string]string{{"pid": "1", "name": "init"}, {"pid": "2", "name": "kthreadd"}},
+		},
+		{ResultMetadata: &ResultMetadata{}, Snapshot: []map[string]string{}},
+	}, snapshots)
+	assert.Equal(t, []LogType{LogTypeResult}, logged)
+
+	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"snapshot": "not json"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "error decoding snapshot")
+
+	plugin = NewPlugin("mock", logFn, WithSnapshot(func(ctx context.Context, snapshot *SnapshotResult) error {
+		return errors.New("disk full")
+	}))
+	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"snapshot": `{"snapshot":[]}`})
+	assert.EqualError(t, err, "error logging snapshot: disk full")
+}
@@ -6,11 +6,22 @@ import (
 	"github.com/bradleyjkemp/osquery-go/gen/osquery"
 )
 
+// LogType encodes the type of log osquery is outputting.
 type LogType string
 
 const (
-	LogTypeStatus LogType = "status"
+	// LogTypeResult is a differential result of a scheduled query.
 	LogTypeResult LogType = "result"
+	// LogTypeSnapshot is a snapshot result of a scheduled query.
+	LogTypeSnapshot LogType = "snapshot"
+	// LogTypeString is any other string logged by osquery.
+	LogTypeString LogType = "string"
+	// LogTypeStatus is a batch of osquery's own status (glog) lines.
+	LogTypeStatus LogType = "status"
+	// LogTypeInit is sent when osquery initializes the logger plugin.
+	LogTypeInit LogType = "init"
+	// LogTypeHealth is a health check log.
+	LogTypeHealth LogType = "health"
 )
 
 type Log interface {
@@ -62,7 +73,7 @@ type SnapshotResult struct {
 }
 
 func (SnapshotResult) Type() LogType {
-	return LogTypeResult
+	return LogTypeSnapshot
 }
 
 func (s SnapshotResult) ToRequest() osquery.ExtensionPluginRequest {
@@ -72,10 +83,23 @@ func (s SnapshotResult) ToRequest() osquery.ExtensionPluginRequest {
 	}
 }
 
+// UnknownLog is any log which isn't a query result. The type of log is
+// determined by which keys osquery included in the request.
 type UnknownLog map[string]string
 
 func (u UnknownLog) Type() LogType {
-	return LogTypeStatus
+	switch {
+	case u["status"] != "":
+		return LogTypeStatus
+	case u["init"] != "":
+		return LogTypeInit
+	case u["health"] != "":
+		return LogTypeHealth
+	case u["string"] != "":
+		return LogTypeString
+	default:
+		return LogTypeStatus
+	}
 }
 
 func (u UnknownLog) ToRequest() osquery.ExtensionPluginRequest {
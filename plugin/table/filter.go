@@ -0,0 +1,242 @@
+package table
+
+import (
+	"math/big"
+	"reflect"
+	"strings"
+	"unicode"
+)
+
+// FilterRows returns the rows which satisfy every constraint in the provided
+// QueryContext. It can be called at the end of a GenerateRows implementation
+// to avoid returning rows that osquery would discard anyway.
+//
+// Comparisons are numeric for columns with an INTEGER, BIGINT,
+// UNSIGNED_BIGINT or DOUBLE affinity and lexical otherwise. LIKE and GLOB
+// follow the SQLite semantics, as described for MatchLike and MatchGlob.
+// Operators that are not understood are left for the osquery SQLite engine to
+// evaluate.
+func FilterRows(queryContext QueryContext, rows []RowDefinition) []RowDefinition {
+	filtered := make([]RowDefinition, 0, len(rows))
+
+	var rowType reflect.Type
+	var fields []columnField
+	for _, row := range rows {
+		if reflect.TypeOf(row) != rowType {
+			var err error
+			if _, fields, err = generateColumnDefinition(row); err != nil {
+				// Leave rows we can't interpret to osquery
+				filtered = append(filtered, row)
+				continue
+			}
+			rowType = reflect.TypeOf(row)
+		}
+
+		if rowMatches(queryContext, fields, row) {
+			filtered = append(filtered, row)
+		}
+	}
+	return filtered
+}
+
+func rowMatches(queryContext QueryContext, fields []columnField, row RowDefinition) bool {
+	response, err := rowsToPluginResponse(fields, row)
+	if err != nil {
+		// Leave rows we can't serialize to osquery
+		return true
+	}
+	values := response[0]
+	for columnName, constraintList := range queryContext.Constraints {
+		value, ok := values[columnName]
+		if !ok {
+			continue
+		}
+
+		if !constraintList.Matches(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// Matches reports whether the value of a cell in the constrained column
+// satisfies every constraint in the list. Values are compared numerically if
+// the affinity is INTEGER, BIGINT, UNSIGNED_BIGINT or DOUBLE (so "9" < "10")
+// and lexically otherwise. Operators other than =, <, <=, >, >=, LIKE and GLOB
+// are always considered to match, leaving them to osquery to evaluate.
+func (c ConstraintList) Matches(value string) bool {
+	for _, constraint := range c.Constraints {
+		if !constraintMatches(constraint, c.Affinity, value) {
+			return false
+		}
+	}
+	return true
+}
+
+func constraintMatches(constraint Constraint, affinity ColumnType, value string) bool {
+	switch constraint.Operator {
+	case OperatorEquals:
+		return compareValues(affinity, value, constraint.Expression) == 0
+	case OperatorGreaterThan:
+		return compareValues(affinity, value, constraint.Expression) > 0
+	case OperatorGreaterThanOrEquals:
+		return compareValues(affinity, value, constraint.Expression) >= 0
+	case OperatorLessThan:
+		return compareValues(affinity, value, constraint.Expression) < 0
+	case OperatorLessThanOrEquals:
+		return compareValues(affinity, value, constraint.Expression) <= 0
+	case OperatorLike:
+		return MatchLike(constraint.Expression, value)
+	case OperatorGlob:
+		return MatchGlob(constraint.Expression, value)
+	default:
+		return true
+	}
+}
+
+// compareValues compares two cell values according to the column affinity,
+// falling back to a lexical comparison if either value is not numeric.
+func compareValues(affinity ColumnType, a, b string) int {
+	switch affinity {
+	case ColumnTypeInteger, ColumnTypeBigInt, ColumnTypeUnsignedBigInt, ColumnTypeDouble:
+		aNum, aOk := new(big.Rat).SetString(a)
+		bNum, bOk := new(big.Rat).SetString(b)
+		if aOk && bOk {
+			return aNum.Cmp(bNum)
+		}
+	}
+	return strings.Compare(a, b)
+}
+
+// MatchLike reports whether value matches the pattern of an OperatorLike
+// constraint, following the SQLite LIKE semantics: % matches any sequence of
+// zero or more characters, _ matches exactly one character and ASCII letters
+// are matched case-insensitively. As osquery does not pass an ESCAPE clause to
+// extensions there is no escape character, so % and _ are always wildcards.
+func MatchLike(pattern, value string) bool {
+	p, v := []rune(pattern), []rune(value)
+	pi, vi := 0, 0
+	// Position of the most recent % in the pattern and the value index it
+	// was matched at, so that we can backtrack and let it consume more.
+	wildcard, wildcardMatch := -1, 0
+
+	for vi < len(v) {
+		switch {
+		case pi < len(p) && p[pi] == '%':
+			wildcard, wildcardMatch = pi, vi
+			pi++
+		case pi < len(p) && (p[pi] == '_' || equalFoldASCII(p[pi], v[vi])):
+			pi++
+			vi++
+		case wildcard >= 0:
+			wildcardMatch++
+			pi, vi = wildcard+1, wildcardMatch
+		default:
+			return false
+		}
+	}
+
+	for pi < len(p) && p[pi] == '%' {
+		pi++
+	}
+	return pi == len(p)
+}
+
+// MatchGlob reports whether value matches the pattern of an OperatorGlob
+// constraint, following the SQLite GLOB semantics: * matches any sequence of
+// zero or more characters, ? matches exactly one character and [...] matches
+// one character from the set, which may include ranges such as a-z and is
+// negated if it starts with ^. Unlike LIKE, matching is case-sensitive. A set
+// which is never closed matches nothing.
+func MatchGlob(pattern, value string) bool {
+	p, v := []rune(pattern), []rune(value)
+	pi, vi := 0, 0
+	// Position of the most recent * in the pattern and the value index it
+	// was matched at, so that we can backtrack and let it consume more.
+	wildcard, wildcardMatch := -1, 0
+
+	for vi < len(v) {
+		if pi < len(p) && p[pi] == '*' {
+			wildcard, wildcardMatch = pi, vi
+			pi++
+			continue
+		}
+
+		matched, next := false, pi+1
+		if pi < len(p) {
+			switch p[pi] {
+			case '?':
+				matched = true
+			case '[':
+				var closed bool
+				matched, next, closed = matchGlobSet(p, pi, v[vi])
+				if !closed {
+					return false
+				}
+			default:
+				matched = p[pi] == v[vi]
+			}
+		}
+
+		switch {
+		case matched:
+			pi = next
+			vi++
+		case wildcard >= 0:
+			wildcardMatch++
+			pi, vi = wildcard+1, wildcardMatch
+		default:
+			return false
+		}
+	}
+
+	for pi < len(p) && p[pi] == '*' {
+		pi++
+	}
+	return pi == len(p)
+}
+
+// matchGlobSet matches c against the [...] set starting at p[start], returning
+// whether it matched and the index of the pattern after the set. closed is
+// false if the set has no closing bracket. As in SQLite, a ] straight after the
+// opening [ (or ^) is part of the set, as is a - at either end of it.
+func matchGlobSet(p []rune, start int, c rune) (matched bool, next int, closed bool) {
+	i := start + 1
+	invert := false
+	if i < len(p) && p[i] == '^' {
+		invert = true
+		i++
+	}
+	if i < len(p) && p[i] == ']' {
+		matched = c == ']'
+		i++
+	}
+
+	var prior rune
+	hasPrior := false
+	for ; i < len(p) && p[i] != ']'; i++ {
+		if p[i] == '-' && hasPrior && i+1 < len(p) && p[i+1] != ']' {
+			i++
+			if c >= prior && c <= p[i] {
+				matched = true
+			}
+			hasPrior = false
+			continue
+		}
+		if p[i] == c {
+			matched = true
+		}
+		prior, hasPrior = p[i], true
+	}
+	if i >= len(p) {
+		return false, i, false
+	}
+	return matched != invert, i + 1, true
+}
+
+func equalFoldASCII(a, b rune) bool {
+	if a < unicode.MaxASCII && b < unicode.MaxASCII {
+		return unicode.ToLower(a) == unicode.ToLower(b)
+	}
+	return a == b
+}
@@ -0,0 +1,200 @@
+package table
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterRows(t *testing.T) {
+	rows := []RowDefinition{
+		ExampleRow{Text: "alpha", Integer: 9, BigInt: big.NewInt(1), Double: 0.5},
+		ExampleRow{Text: "Beta", Integer: 10, BigInt: big.NewInt(2), Double: 1.5},
+		ExampleRow{Text: "gamma", Integer: 100, BigInt: big.NewInt(3), Double: 2.5},
+	}
+
+	var testCases = []struct {
+		name        string
+		constraints map[string]ConstraintList
+		expected    []RowDefinition
+	}{
+		{
+			name:     "no constraints",
+			expected: rows,
+		},
+		{
+			name: "text equals",
+			constraints: map[string]ConstraintList{
+				"text": {ColumnTypeText, []Constraint{{Operator: OperatorEquals, Expression: "gamma"}}},
+			},
+			expected: rows[2:],
+		},
+		{
+			name: "numeric comparison",
+			constraints: map[string]ConstraintList{
+				"integer": {ColumnTypeInteger, []Constraint{{Operator: OperatorGreaterThan, Expression: "9"}}},
+			},
+			expected: rows[1:],
+		},
+		{
+			name: "lexical comparison",
+			constraints: map[string]ConstraintList{
+				"integer": {ColumnTypeText, []Constraint{{Operator: OperatorGreaterThan, Expression: "9"}}},
+			},
+			expected: []RowDefinition{},
+		},
+		{
+			name: "range",
+			constraints: map[string]ConstraintList{
+				"double": {ColumnTypeDouble, []Constraint{
+					{Operator: OperatorGreaterThanOrEquals, Expression: "1.5"},
+					{Operator: OperatorLessThan, Expression: "2.5"},
+				}},
+			},
+			expected: rows[1:2],
+		},
+		{
+			name: "multiple columns",
+			constraints: map[string]ConstraintList{
+				"big_int": {ColumnTypeBigInt, []Constraint{{Operator: OperatorLessThanOrEquals, Expression: "2"}}},
+				"text":    {ColumnTypeText, []Constraint{{Operator: OperatorLike, Expression: "%a"}}},
+			},
+			expected: rows[:2],
+		},
+		{
+			name: "unknown column",
+			constraints: map[string]ConstraintList{
+				"missing": {ColumnTypeText, []Constraint{{Operator: OperatorEquals, Expression: "foo"}}},
+			},
+			expected: rows,
+		},
+		{
+			name: "unsupported operator",
+			constraints: map[string]ConstraintList{
+				"text": {ColumnTypeText, []Constraint{{Operator: OperatorRegexp, Expression: "^a"}}},
+			},
+			expected: rows,
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, FilterRows(QueryContext{Constraints: tt.constraints}, rows))
+		})
+	}
+}
+
+func TestConstraintListMatches(t *testing.T) {
+	var testCases = []struct {
+		name        string
+		constraints ConstraintList
+		value       string
+		matches     bool
+	}{
+		{"integer greater than", ConstraintList{ColumnTypeInteger, []Constraint{{Operator: OperatorGreaterThan, Expression: "9"}}}, "10", true},
+		{"text greater than", ConstraintList{ColumnTypeText, []Constraint{{Operator: OperatorGreaterThan, Expression: "9"}}}, "10", false},
+		{"bigint less than", ConstraintList{ColumnTypeBigInt, []Constraint{{Operator: OperatorLessThan, Expression: "-5"}}}, "-10", true},
+		{"unsigned equals", ConstraintList{ColumnTypeUnsignedBigInt, []Constraint{{Operator: OperatorEquals, Expression: "18446744073709551615"}}}, "18446744073709551615", true},
+		{"double equals", ConstraintList{ColumnTypeDouble, []Constraint{{Operator: OperatorEquals, Expression: "1.50"}}}, "1.5", true},
+		{"double bounds", ConstraintList{ColumnTypeDouble, []Constraint{
+			{Operator: OperatorGreaterThanOrEquals, Expression: "1"},
+			{Operator: OperatorLessThanOrEquals, Expression: "2"},
+		}}, "2.5", false},
+		{"not numeric", ConstraintList{ColumnTypeInteger, []Constraint{{Operator: OperatorEquals, Expression: "abc"}}}, "abc", true},
+		{"glob is case-sensitive", ConstraintList{ColumnTypeText, []Constraint{{Operator: OperatorGlob, Expression: "*.Conf"}}}, "sshd.conf", false},
+		{"glob is not like", ConstraintList{ColumnTypeText, []Constraint{{Operator: OperatorGlob, Expression: "%.conf"}}}, "sshd.conf", false},
+		{"glob", ConstraintList{ColumnTypeText, []Constraint{{Operator: OperatorGlob, Expression: "/etc/*.conf"}}}, "/etc/sshd.conf", true},
+		{"no constraints", ConstraintList{ColumnTypeInteger, []Constraint{}}, "1", true},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.matches, tt.constraints.Matches(tt.value))
+		})
+	}
+}
+
+func TestMatchLike(t *testing.T) {
+	var testCases = []struct {
+		pattern string
+		value   string
+		matches bool
+	}{
+		{"", "", true},
+		{"", "a", false},
+		{"%", "", true},
+		{"%", "anything", true},
+		{"abc", "abc", true},
+		{"abc", "ABC", true},
+		{"abc", "abcd", false},
+		{"a_c", "abc", true},
+		{"a_c", "ac", false},
+		{"%bar", "foobar", true},
+		{"foo%", "foobar", true},
+		{"%oba%", "foobar", true},
+		{"f%b_r", "foobar", true},
+		{"f%b_r", "foobaz", false},
+		{"%a%a%", "banana", true},
+		{"%x%", "banana", false},
+		{"ÄÖ", "äö", false},
+		{"ä_", "äx", true},
+		{"100%", "100%", true},
+		{"100%", "1000", true},
+		{"a\\_c", "a\\bc", true},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.pattern+"/"+tt.value, func(t *testing.T) {
+			assert.Equal(t, tt.matches, MatchLike(tt.pattern, tt.value))
+		})
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	var testCases = []struct {
+		pattern string
+		value   string
+		matches bool
+	}{
+		{"", "", true},
+		{"", "a", false},
+		{"*", "", true},
+		{"*", "anything", true},
+		{"abc", "abc", true},
+		{"abc", "ABC", false},
+		{"abc", "abcd", false},
+		{"a?c", "abc", true},
+		{"a?c", "ac", false},
+		{"*.conf", "/etc/ssh/sshd.conf", true},
+		{"*.conf", "/etc/ssh/sshd.confd", false},
+		{"/etc/*", "/etc/hosts", true},
+		{"*a*a*", "banana", true},
+		{"*x*", "banana", false},
+		{"%", "anything", false},
+		{"a_c", "abc", false},
+		{"[abc]x", "bx", true},
+		{"[abc]x", "dx", false},
+		{"[a-c]", "b", true},
+		{"[a-c]", "B", false},
+		{"[^a-c]", "d", true},
+		{"[^a-c]", "b", false},
+		{"[]]", "]", true},
+		{"[^]]", "]", false},
+		{"[a-]", "-", true},
+		{"[-a]", "-", true},
+		{"[*?]", "?", true},
+		{"[*?]", "x", false},
+		{"*[0-9]", "file1", true},
+		{"*[0-9]", "file", false},
+		{"[abc", "a", false},
+		{"a*[", "abc", false},
+		{"ä?", "äx", true},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.pattern+"/"+tt.value, func(t *testing.T) {
+			assert.Equal(t, tt.matches, MatchGlob(tt.pattern, tt.value))
+		})
+	}
+}
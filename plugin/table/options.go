@@ -1,10 +1,19 @@
 package table
 
-import "context"
+import (
+	"context"
+
+	"github.com/bradleyjkemp/osquery-go/gen/osquery"
+)
 
 type GenerateRowsImpl func(ctx context.Context, queryContext QueryContext) ([]RowDefinition, error)
+type StreamRowsImpl func(ctx context.Context, queryContext QueryContext, emit func(RowDefinition) error) error
+type GenerateMapsImpl func(ctx context.Context, queryContext QueryContext) ([]map[string]string, error)
+type GenerateRowsChanImpl func(ctx context.Context, queryContext QueryContext) (<-chan RowDefinition, <-chan error)
 type InsertRowImpl func(ctx context.Context, row RowDefinition) (rowID RowID, err error)
 type UpdateRowImpl func(ctx context.Context, rowID RowID, row RowDefinition) error
+type ColumnsImpl func(ctx context.Context) osquery.ExtensionPluginResponse
+type RawActionImpl func(ctx context.Context, request osquery.ExtensionPluginRequest) (osquery.ExtensionPluginResponse, error)
 
 // GenerateRows allows you to provide a function that is used by OSQuery
 // to fulfill SELECT SQL statements.
@@ -12,12 +21,86 @@ type UpdateRowImpl func(ctx context.Context, rowID RowID, row RowDefinition) err
 // Your Generate function is passed a set of constraints (representing any WHERE clauses in the query).
 // These are optional to do anything with: the OSQuery SQLite engine will do its own filtering but
 // they can be useful as optimisations or for taking arguments.
+//
+// If only some of the rows can be generated, return them along with a
+// *PartialError so that osquery still receives them.
+//
+// When the server has a call timeout, such as the --timeout osquery passes to
+// extensions when it is set with osquery.ExtensionFlags, the context has a
+// deadline and time.Until(deadline) is the time left to generate the rows.
 func GenerateRows(generate GenerateRowsImpl) Option {
 	return func(plugin *Plugin) {
 		plugin.generate = generate
 	}
 }
 
+// StreamRows is an alternative to GenerateRows for tables which are too large
+// to comfortably hold in memory as a slice of rows.
+//
+// Your Stream function is passed the same constraints as a Generate function
+// and should call emit once for each row in the table. If emit returns an error
+// then generation should stop and that error should be returned.
+//
+// emit is safe to call from several goroutines at once, so it can be passed
+// directly to a pool of workers. Rows are returned in the order emit is called.
+// Every call must complete before the Stream function returns; rows emitted
+// afterwards are rejected with ErrEmitAfterReturn. Lazy columns are computed
+// by the goroutine which emits the row, so their functions must also be safe to
+// call concurrently.
+// If both StreamRows and GenerateRows are provided, StreamRows is used.
+func StreamRows(stream StreamRowsImpl) Option {
+	return func(plugin *Plugin) {
+		plugin.stream = stream
+	}
+}
+
+// GenerateRowsChan is an alternative to StreamRows for tables whose rows are
+// naturally produced by goroutines, such as a pool of workers.
+//
+// Your function is passed the same constraints as a Generate function and
+// should start producing rows in the background, returning a channel of rows
+// and a channel of errors. The rows channel must be closed once every row has
+// been sent. Generation fails with the first error received on the error
+// channel, which may be nil if generation can't fail. The context is cancelled
+// once the rows are no longer being read, so producers must stop sending when
+// it is done.
+// This replaces any StreamRows function, and is used instead of GenerateRows.
+func GenerateRowsChan(generate GenerateRowsChanImpl) Option {
+	return StreamRows(func(ctx context.Context, queryContext QueryContext, emit func(RowDefinition) error) error {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		rows, errs := generate(ctx, queryContext)
+		for {
+			select {
+			case row, ok := <-rows:
+				if !ok {
+					// An error may have been sent just before the
+					// rows channel was closed.
+					select {
+					case err := <-errs:
+						return err
+					default:
+						return nil
+					}
+				}
+				if err := emit(row); err != nil {
+					return err
+				}
+			case err := <-errs:
+				if err != nil {
+					return err
+				}
+				// A nil error (or a closed channel) isn't a
+				// failure, so carry on reading rows.
+				errs = nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	})
+}
+
 // InsertRow allows you to provide a function that is used by OSQuery
 // to fulfill INSERT SQL statements.
 // Your Insert function must return a RowID.
@@ -40,3 +123,173 @@ func UpdateRow(update UpdateRowImpl) Option {
 		plugin.update = update
 	}
 }
+
+// WithColumnsHandler allows you to provide the response to osquery's "columns"
+// action, which otherwise describes the columns of the table's row definition.
+// This can be used to present a different schema depending on the request.
+// The response should be in the same form as Plugin.Routes, which is still
+// used when the extension registers with osquery.
+func WithColumnsHandler(columns ColumnsImpl) Option {
+	return func(plugin *Plugin) {
+		plugin.columnsHandler = columns
+	}
+}
+
+// WithRawActionHandler allows you to handle requests for the given action
+// yourself, with full access to the request sent by osquery. Requests for the
+// action are passed to handler instead of the built in handling, so this can
+// be used for custom actions or to handle actions like "generate" in ways that
+// the typed API doesn't support.
+// Most tables should not need this.
+func WithRawActionHandler(action string, handler RawActionImpl) Option {
+	return func(plugin *Plugin) {
+		if plugin.rawActions == nil {
+			plugin.rawActions = map[string]RawActionImpl{}
+		}
+		plugin.rawActions[action] = handler
+	}
+}
+
+// WithUnknownActionHandler sets a handler for requests with actions the table
+// doesn't otherwise handle, so that a table can keep working when a newer
+// version of osquery adds an action. Without one, such requests fail with an
+// *UnknownActionError naming the action.
+func WithUnknownActionHandler(handler RawActionImpl) Option {
+	return func(plugin *Plugin) {
+		plugin.unknownActionHandler = handler
+	}
+}
+
+// SkipInvalidConstraints makes the plugin ignore any constraints in a query
+// that it cannot parse, rather than failing the whole query. The remaining
+// constraints are passed to the table as usual and the reasons the others were
+// skipped are available from ConstraintWarnings.
+func SkipInvalidConstraints() Option {
+	return func(plugin *Plugin) {
+		plugin.skipInvalidConstraints = true
+	}
+}
+
+// NormalizeConstraints puts the constraints on each column into a canonical
+// form before they are passed to the table: identical constraints, which
+// osquery can send more than once for complex queries or which arise from
+// constraints on a column and its aliases, are collapsed into one, and the
+// constraints are sorted by operator and then expression.
+func NormalizeConstraints() Option {
+	return func(plugin *Plugin) {
+		plugin.normalizeConstraints = true
+	}
+}
+
+// UnknownColumnPolicy is how a plugin handles constraints on columns that the
+// table doesn't declare, which osquery can send if its schema for the table
+// differs from the plugin's.
+type UnknownColumnPolicy int
+
+const (
+	// KeepUnknownColumns passes the constraints to the table like any
+	// other. This is the default.
+	KeepUnknownColumns UnknownColumnPolicy = iota
+	// SkipUnknownColumns leaves the constraints out of the query context,
+	// reporting each one skipped in ConstraintWarnings.
+	SkipUnknownColumns
+	// RejectUnknownColumns fails the query.
+	RejectUnknownColumns
+)
+
+// UnknownColumnConstraints sets how the plugin handles constraints on columns
+// that the table doesn't declare. Column aliases and the row ID column are
+// declared columns.
+func UnknownColumnConstraints(policy UnknownColumnPolicy) Option {
+	return func(plugin *Plugin) {
+		plugin.unknownColumns = policy
+	}
+}
+
+// LazyColumnImpl computes the value of a column added with WithLazyColumn from a
+// row returned by the table.
+type LazyColumnImpl func(ctx context.Context, row RowDefinition) (string, error)
+
+// WithLazyColumn adds a column with the given name and type to the table, whose
+// value is computed by fn from each row only when the query uses the column,
+// by selecting it or constraining it. This avoids computing expensive values,
+// such as file hashes, for queries which don't need them. The column is left
+// out of the rows when it isn't used. If fn returns an error the query fails.
+// Lazy columns are not parsed from the rows of INSERT or UPDATE statements.
+func WithLazyColumn(name string, columnType ColumnType, fn LazyColumnImpl) Option {
+	return func(plugin *Plugin) {
+		plugin.lazyColumns = append(plugin.lazyColumns, lazyColumn{
+			ColumnDefinition: ColumnDefinition{Name: name, Type: columnType},
+			value:            fn,
+		})
+	}
+}
+
+// WithRowID adds an INTEGER column with the given name to the table, which
+// numbers the rows returned by each query from 1. This gives a stable ID for
+// each row within a single query without adding a field to the row definition.
+// The row ID column is not parsed from the rows of INSERT or UPDATE statements.
+func WithRowID(column string) Option {
+	return func(plugin *Plugin) {
+		plugin.rowIDColumn = column
+	}
+}
+
+// StrictAffinity makes the plugin check that the affinity osquery sends with
+// the constraints on each column matches the column's declared type, failing
+// the query if not. A mismatch means that osquery has a different schema for
+// the table than the plugin, for example after only one of them was upgraded,
+// so constraints may be compared incorrectly.
+func StrictAffinity() Option {
+	return func(plugin *Plugin) {
+		plugin.strictAffinity = true
+	}
+}
+
+// WithJSONDecoder sets the decoder used to parse the query context that
+// osquery sends with each query, in place of encoding/json. Parsing large
+// query contexts can be a measurable cost for tables which are queried very
+// often, so this allows a faster JSON library to be used without this package
+// depending on it. The decoder must behave like json.Unmarshal, including
+// decoding into json.RawMessage and interface{} values. A nil decoder restores
+// the default.
+func WithJSONDecoder(decoder JSONDecoder) Option {
+	return func(plugin *Plugin) {
+		if decoder == nil {
+			decoder = stdJSONDecoder{}
+		}
+		plugin.jsonDecoder = decoder
+	}
+}
+
+// MaxResponseSize limits the size of the response to each query to the given
+// number of bytes, as encoded to be sent to osquery. Queries whose response
+// would be larger fail with an error suggesting that constraints are added to
+// the query, rather than with an opaque error from osquery's transport.
+// osquery has no way of receiving a response in chunks, so tables using
+// StreamRows or GenerateRowsChan stop being generated as soon as the limit is
+// exceeded. A size of zero, the default, means no limit.
+func MaxResponseSize(bytes int) Option {
+	return func(plugin *Plugin) {
+		plugin.maxResponseSize = bytes
+	}
+}
+
+// WithRegistry adds the table to the named registry rather than the "table"
+// registry. This is only useful with builds of osquery which have additional
+// registries for table-like plugins, and the server must be created with
+// osquery.ServerRegistries to accept the registry.
+func WithRegistry(registry string) Option {
+	return func(plugin *Plugin) {
+		plugin.registry = registry
+	}
+}
+
+// WithDescription sets a human readable description of the table, for
+// documentation purposes. osquery does not use the description; it is
+// available from Plugin.Description.
+func WithDescription(description string) Option {
+	return func(plugin *Plugin) {
+		plugin.description = description
+	}
+}
@@ -0,0 +1,119 @@
+package table
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Predicate is the conjunction of the constraints in a QueryContext, in a form
+// which can be forwarded to the store backing a table, such as a database or
+// an API with filters, so that it only returns the matching rows.
+type Predicate []Condition
+
+// Condition is a single constraint of a Predicate. Op is the SQL operator:
+// one of =, >, >=, <, <=, GLOB or REGEXP. Value is the expression the
+// column is compared to, which is an int64, uint64 or float64 for comparisons
+// on columns with an INTEGER or BIGINT, UNSIGNED_BIGINT or DOUBLE affinity
+// respectively, and a string otherwise.
+type Condition struct {
+	Column string
+	Op     string
+	Value  interface{}
+}
+
+var operatorSQL = map[Operator]string{
+	OperatorEquals:              "=",
+	OperatorGreaterThan:         ">",
+	OperatorGreaterThanOrEquals: ">=",
+	OperatorLessThan:            "<",
+	OperatorLessThanOrEquals:    "<=",
+	OperatorGlob:                "GLOB",
+	OperatorRegexp:              "REGEXP",
+}
+
+// ToPredicate translates the constraints into a Predicate, ordered by column
+// name. As osquery filters the rows a table returns, the predicate only needs
+// to narrow down the rows, so constraints which a backing store may evaluate
+// differently to osquery are left out rather than risk dropping rows osquery
+// would keep. These are constraints with operators that have no SQL
+// equivalent, such as MATCH, LIKE constraints, which osquery evaluates case
+// insensitively but many stores don't, and comparisons of numeric columns to
+// expressions which aren't numbers.
+func (q QueryContext) ToPredicate() Predicate {
+	columns := make([]string, 0, len(q.Constraints))
+	for column := range q.Constraints {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+
+	predicate := Predicate{}
+	for _, column := range columns {
+		constraintList := q.Constraints[column]
+		for _, constraint := range constraintList.Constraints {
+			op, ok := operatorSQL[constraint.Operator]
+			if !ok {
+				continue
+			}
+			value, ok := conditionValue(constraint, constraintList.Affinity)
+			if !ok {
+				continue
+			}
+			predicate = append(predicate, Condition{
+				Column: column,
+				Op:     op,
+				Value:  value,
+			})
+		}
+	}
+	return predicate
+}
+
+// conditionValue converts the expression of a comparison on a numeric column
+// to a number, so that it is compared numerically by the backing store. It
+// returns false if the expression isn't a valid number, as SQLite's rules for
+// comparing numbers to text are unlikely to be matched by the backing store.
+func conditionValue(constraint Constraint, affinity ColumnType) (interface{}, bool) {
+	switch constraint.Operator {
+	case OperatorGlob, OperatorRegexp:
+		return constraint.Expression, true
+	}
+
+	var value interface{}
+	var err error
+	switch affinity {
+	case ColumnTypeInteger, ColumnTypeBigInt:
+		value, err = strconv.ParseInt(constraint.Expression, 10, 64)
+	case ColumnTypeUnsignedBigInt:
+		value, err = strconv.ParseUint(constraint.Expression, 10, 64)
+	case ColumnTypeDouble:
+		value, err = strconv.ParseFloat(constraint.Expression, 64)
+	default:
+		return constraint.Expression, true
+	}
+	return value, err == nil
+}
+
+// SQL renders the predicate as the condition of a WHERE clause, with the
+// values replaced by ? placeholders and returned as the arguments to pass
+// alongside the query, for example with database/sql. Column names are quoted
+// as SQL identifiers. An empty predicate renders as an empty string, in which
+// case the WHERE clause should be left out.
+//
+// GLOB and REGEXP are rendered as they are, so backing stores which don't
+// support them should check the Op of each condition first.
+func (p Predicate) SQL() (string, []interface{}) {
+	var clauses []string
+	var args []interface{}
+	for _, condition := range p {
+		clauses = append(clauses, quoteIdentifier(condition.Column)+" "+condition.Op+" ?")
+		args = append(args, condition.Value)
+	}
+	return strings.Join(clauses, " AND "), args
+}
+
+// quoteIdentifier quotes a column name with double quotes, doubling any double
+// quotes within it.
+func quoteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
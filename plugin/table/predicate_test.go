@@ -0,0 +1,41 @@
+package table
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToPredicate(t *testing.T) {
+	queryContext := QueryContext{Constraints: map[string]ConstraintList{
+		"path": {ColumnTypeText, []Constraint{
+			{Operator: OperatorLike, Expression: "/etc/%"},
+			{Operator: OperatorMatch, Expression: "ignored"},
+		}},
+		"size": {ColumnTypeBigInt, []Constraint{
+			{Operator: OperatorGreaterThanOrEquals, Expression: "1024"},
+			{Operator: OperatorLessThan, Expression: "not a number"},
+		}},
+		"inode": {ColumnTypeUnsignedBigInt, []Constraint{{Operator: OperatorEquals, Expression: "18446744073709551615"}}},
+		"ratio": {ColumnTypeDouble, []Constraint{{Operator: OperatorGreaterThan, Expression: "0.5"}}},
+		"mode":  {ColumnTypeInteger, []Constraint{{Operator: OperatorGlob, Expression: "7*"}}},
+		"a\"b":  {ColumnTypeText, []Constraint{{Operator: OperatorEquals, Expression: "x' OR 1=1"}}},
+	}}
+
+	predicate := queryContext.ToPredicate()
+	assert.Equal(t, Predicate{
+		{Column: "a\"b", Op: "=", Value: "x' OR 1=1"},
+		{Column: "inode", Op: "=", Value: uint64(18446744073709551615)},
+		{Column: "mode", Op: "GLOB", Value: "7*"},
+		{Column: "ratio", Op: ">", Value: 0.5},
+		{Column: "size", Op: ">=", Value: int64(1024)},
+	}, predicate)
+
+	sql, args := predicate.SQL()
+	assert.Equal(t, `"a""b" = ? AND "inode" = ? AND "mode" GLOB ? AND "ratio" > ? AND "size" >= ?`, sql)
+	assert.Equal(t, []interface{}{"x' OR 1=1", uint64(18446744073709551615), "7*", 0.5, int64(1024)}, args)
+
+	sql, args = QueryContext{}.ToPredicate().SQL()
+	assert.Equal(t, "", sql)
+	assert.Empty(t, args)
+}
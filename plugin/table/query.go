@@ -0,0 +1,150 @@
+package table
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+
+	"github.com/bradleyjkemp/osquery-go/gen/osquery"
+	"github.com/pkg/errors"
+)
+
+// Query generates the rows of a table plugin in the same way as when osquery
+// queries the table, returning the rows as they would be sent to osquery. The
+// QueryContext is serialized to the JSON format used by osquery, so this can
+// be used to test a plugin's handling of constraints without running osquery.
+// If the table returns a PartialError, the rows are returned with the error.
+func Query(ctx context.Context, plugin *Plugin, queryContext QueryContext) ([]map[string]string, error) {
+	ctxJSON, err := marshalQueryContext(queryContext)
+	if err != nil {
+		return nil, err
+	}
+
+	// The rows generated are returned along with a PartialError
+	return plugin.Call(ctx, osquery.ExtensionPluginRequest{
+		"action":  "generate",
+		"context": ctxJSON,
+	})
+}
+
+// RowsToMaps serializes rows in the same way as a table plugin created with
+// the given row definition, returning the values that would be sent to
+// osquery. This allows the expected output of a table to be written as typed
+// rows in tests. Each row must be of the same type as schema, or a MapRow.
+func RowsToMaps(schema RowDefinition, rows []RowDefinition) ([]map[string]string, error) {
+	columns, fields, err := generateColumnDefinition(schema)
+	if err != nil {
+		return nil, err
+	}
+	plugin := &Plugin{rowType: schema, columns: columns, fields: fields}
+	checked := make([]RowDefinition, len(rows))
+	for i, row := range rows {
+		var err error
+		if checked[i], err = plugin.checkRowType(row); err != nil {
+			return nil, errors.Wrapf(err, "row %d", i)
+		}
+	}
+
+	return rowsToPluginResponse(fields, checked...)
+}
+
+// DecodeRows is the inverse of RowsToMaps. It parses rows of values, such as
+// the results of a query run by osquery, into dest, which must be a pointer to
+// a slice of a row definition struct. The fields are set from the columns with
+// the names in their `column` tags. Columns which are empty or missing from a
+// row leave the field as its zero value, and columns without a field are
+// ignored.
+func DecodeRows(rows []map[string]string, dest interface{}) error {
+	slice := reflect.ValueOf(dest)
+	if slice.Kind() != reflect.Ptr || slice.Elem().Kind() != reflect.Slice {
+		return errors.Errorf("destination must be a pointer to a slice, got %T", dest)
+	}
+	slice = slice.Elem()
+	rowType := slice.Type().Elem()
+	_, fields, err := generateColumnDefinition(reflect.Zero(rowType).Interface())
+	if err != nil {
+		return err
+	}
+
+	decoded := reflect.MakeSlice(slice.Type(), 0, len(rows))
+	for i, cells := range rows {
+		row := reflect.New(rowType).Elem()
+		for _, field := range fields {
+			cell := cells[field.name]
+			if field.rowID || cell == "" {
+				continue
+			}
+			if err := setCellValue(row.FieldByIndex(field.index), cell, field.tag); err != nil {
+				return errors.Wrapf(err, "row %d: column %s", i, field.name)
+			}
+		}
+		decoded = reflect.Append(decoded, row)
+	}
+	slice.Set(decoded)
+	return nil
+}
+
+// setCellValue parses a value as it is sent to osquery into a row field. This
+// differs from the JSON values osquery sends in INSERT and UPDATE statements
+// as JSON columns aren't quoted and "null" is a string rather than NULL.
+func setCellValue(field reflect.Value, cell string, tag string) error {
+	if isJSONField(tag) {
+		return json.Unmarshal([]byte(cell), field.Addr().Interface())
+	}
+	if field.Kind() == reflect.Ptr && field.Type() != bigIntType {
+		value := reflect.New(field.Type().Elem())
+		if err := setFieldValue(value.Elem(), cell, tag); err != nil {
+			return err
+		}
+		field.Set(value)
+		return nil
+	}
+	return setFieldValue(field, cell, tag)
+}
+
+type constraintJSON struct {
+	Operator   Operator `json:"op"`
+	Expression string   `json:"expr"`
+}
+
+// marshalQueryContext is the inverse of parseQueryContext.
+func marshalQueryContext(queryContext QueryContext) (string, error) {
+	names := make([]string, 0, len(queryContext.Constraints))
+	for name := range queryContext.Constraints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parsed := queryContextJSON{
+		Constraints: []constraintListJSON{},
+		ColsUsed:    queryContext.SelectedColumns,
+		Distinct:    queryContext.Distinct,
+	}
+	for _, name := range names {
+		constraintList := queryContext.Constraints[name]
+		constraints := make([]constraintJSON, 0, len(constraintList.Constraints))
+		for _, constraint := range constraintList.Constraints {
+			constraints = append(constraints, constraintJSON{
+				Operator:   constraint.Operator | Operator(constraint.Flags),
+				Expression: constraint.Expression,
+			})
+		}
+
+		list, err := json.Marshal(constraints)
+		if err != nil {
+			return "", errors.Wrap(err, "marshaling constraint list")
+		}
+		parsed.Constraints = append(parsed.Constraints, constraintListJSON{
+			Name:     name,
+			Affinity: string(constraintList.Affinity),
+			List:     list,
+		})
+	}
+
+	ctxJSON, err := json.Marshal(parsed)
+	if err != nil {
+		return "", errors.Wrap(err, "marshaling context JSON")
+	}
+	return string(ctxJSON), nil
+}
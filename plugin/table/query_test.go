@@ -0,0 +1,175 @@
+package table
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/bradleyjkemp/osquery-go/gen/osquery"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuery(t *testing.T) {
+	var calledQueryCtx QueryContext
+	plugin, err := NewPlugin(
+		"mock",
+		ExampleRow{},
+		GenerateRows(func(ctx context.Context, queryCtx QueryContext) ([]RowDefinition, error) {
+			calledQueryCtx = queryCtx
+			return FilterRows(queryCtx, []RowDefinition{
+				ExampleRow{Text: "foo", Integer: 1, BigInt: big.NewInt(10), Double: 0.5},
+				ExampleRow{Text: "bar", Integer: 2, BigInt: big.NewInt(20), Double: 1.5},
+			}), nil
+		}))
+	require.NoError(t, err)
+
+	rows, err := Query(context.Background(), plugin, QueryContext{})
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]string{
+		{"text": "foo", "integer": "1", "big_int": "10", "double": "0.5"},
+		{"text": "bar", "integer": "2", "big_int": "20", "double": "1.5"},
+	}, rows)
+	assert.Equal(t, QueryContext{Constraints: map[string]ConstraintList{}}, calledQueryCtx)
+
+	queryContext := QueryContext{Constraints: map[string]ConstraintList{
+		"integer": {ColumnTypeInteger, []Constraint{{Operator: OperatorGreaterThan, Expression: "1", Flags: ConstraintFlagUnique}}},
+		"text":    {ColumnTypeText, []Constraint{{Operator: OperatorLike, Expression: "b%"}, {Operator: OperatorEquals, Expression: "bar"}}},
+		"double":  {ColumnTypeDouble, []Constraint{}},
+	}}
+	rows, err = Query(context.Background(), plugin, queryContext)
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]string{
+		{"text": "bar", "integer": "2", "big_int": "20", "double": "1.5"},
+	}, rows)
+	assert.Equal(t, queryContext, calledQueryCtx)
+}
+
+func TestQueryErrors(t *testing.T) {
+	plugin, err := NewPlugin(
+		"mock",
+		ExampleRow{},
+		GenerateRows(func(ctx context.Context, queryCtx QueryContext) ([]RowDefinition, error) {
+			return nil, errors.New("foobar")
+		}))
+	require.NoError(t, err)
+
+	_, err = Query(context.Background(), plugin, QueryContext{})
+	assert.EqualError(t, err, "error generating table: foobar")
+}
+
+func TestQueryStatusError(t *testing.T) {
+	plugin, err := NewPlugin(
+		"mock",
+		ExampleRow{},
+		StreamRows(func(ctx context.Context, queryCtx QueryContext, emit func(RowDefinition) error) error {
+			return StatusError{Code: 13, Message: "permission denied"}
+		}))
+	require.NoError(t, err)
+
+	_, err = Query(context.Background(), plugin, QueryContext{})
+	var statusErr StatusError
+	require.True(t, errors.As(err, &statusErr))
+	assert.Equal(t, StatusError{Code: 13, Message: "permission denied"}, statusErr)
+
+	assert.Equal(t, osquery.ExtensionStatus{Code: 1, Message: "failed"}, StatusError{Message: "failed"}.ExtensionStatus())
+}
+
+func TestRowsToMaps(t *testing.T) {
+	rows, err := RowsToMaps(ExampleRow{}, []RowDefinition{
+		ExampleRow{Text: "foo", Integer: 1, BigInt: big.NewInt(10), Double: 0.5},
+		MapRow{"text": "bar"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]string{
+		{"text": "foo", "integer": "1", "big_int": "10", "double": "0.5"},
+		{"text": "bar", "integer": "", "big_int": "", "double": ""},
+	}, rows)
+
+	// The rows match what the plugin sends to osquery
+	plugin, err := NewPlugin(
+		"mock",
+		ExampleRow{},
+		GenerateRows(func(ctx context.Context, queryCtx QueryContext) ([]RowDefinition, error) {
+			return []RowDefinition{
+				ExampleRow{Text: "foo", Integer: 1, BigInt: big.NewInt(10), Double: 0.5},
+				MapRow{"text": "bar"},
+			}, nil
+		}))
+	require.NoError(t, err)
+	queried, err := Query(context.Background(), plugin, QueryContext{})
+	require.NoError(t, err)
+	assert.Equal(t, queried, rows)
+
+	_, err = RowsToMaps(ExampleRow{}, []RowDefinition{ExampleRow{}, UnsignedRow{}})
+	assert.EqualError(t, err, "row 1: row type table.UnsignedRow does not match declared schema table.ExampleRow")
+
+	rows, err = RowsToMaps(ExampleRow{}, []RowDefinition{MapRow{"TEXT": "foo"}})
+	require.NoError(t, err)
+	assert.Equal(t, "foo", rows[0]["text"])
+
+	_, err = RowsToMaps(ExampleRow{}, []RowDefinition{MapRow{"other": "foo"}})
+	assert.EqualError(t, err, `row 0: MapRow has unknown column "other"`)
+
+	_, err = RowsToMaps("not a struct", nil)
+	assert.EqualError(t, err, "row definition must be a struct")
+}
+
+type DecodedRow struct {
+	Name     string            `column:"name"`
+	Count    int               `column:"count"`
+	Size     uint64            `column:"size"`
+	Enabled  bool              `column:"enabled"`
+	Ratio    float64           `column:"ratio"`
+	Total    *big.Int          `column:"total"`
+	Parent   *int64            `column:"parent"`
+	Label    *string           `column:"label"`
+	Modified time.Time         `column:"modified"`
+	Metadata map[string]string `column:"metadata,json"`
+}
+
+func TestDecodeRows(t *testing.T) {
+	parent := int64(-1)
+	label := "null"
+	rows := []RowDefinition{
+		DecodedRow{
+			Name:     "foo",
+			Count:    -3,
+			Size:     18446744073709551615,
+			Enabled:  true,
+			Ratio:    0.25,
+			Total:    big.NewInt(123456789),
+			Parent:   &parent,
+			Label:    &label,
+			Modified: time.Unix(1600000000, 0),
+			Metadata: map[string]string{"a": "b"},
+		},
+		DecodedRow{Name: "bar"},
+	}
+	maps, err := RowsToMaps(DecodedRow{}, rows)
+	require.NoError(t, err)
+
+	var decoded []DecodedRow
+	require.NoError(t, DecodeRows(maps, &decoded))
+	assert.Equal(t, []DecodedRow{rows[0].(DecodedRow), {Name: "bar"}}, decoded)
+
+	// Missing and unknown columns are ignored
+	decoded = nil
+	require.NoError(t, DecodeRows([]map[string]string{{"count": "2", "other": "x"}}, &decoded))
+	assert.Equal(t, []DecodedRow{{Count: 2}}, decoded)
+}
+
+func TestDecodeRowsErrors(t *testing.T) {
+	var decoded []DecodedRow
+	err := DecodeRows(nil, decoded)
+	assert.EqualError(t, err, "destination must be a pointer to a slice, got []table.DecodedRow")
+
+	var notStructs []string
+	err = DecodeRows(nil, &notStructs)
+	assert.EqualError(t, err, "row definition must be a struct")
+
+	err = DecodeRows([]map[string]string{{"count": "1"}, {"count": "many"}}, &decoded)
+	assert.EqualError(t, err, `row 1: column count: strconv.ParseInt: parsing "many": invalid syntax`)
+}
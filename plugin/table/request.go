@@ -0,0 +1,73 @@
+package table
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/bradleyjkemp/osquery-go/gen/osquery"
+	"github.com/bradleyjkemp/osquery-go/logging"
+)
+
+// requestIDKey is the key in the plugin request which may carry an identifier
+// for the query. osquery doesn't currently send one, in which case an
+// identifier is generated for the call.
+const requestIDKey = "request_id"
+
+type requestIDContextKey struct{}
+
+// RequestIDFromContext returns the identifier of the osquery request that
+// caused the table to be called. It can be called with the context passed to
+// the GenerateRows, StreamRows, InsertRow and UpdateRow functions, and is
+// useful for correlating log lines when many queries run concurrently.
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	requestID, ok := ctx.Value(requestIDContextKey{}).(string)
+	return requestID, ok
+}
+
+// withRequestID adds the request's identifier to the context, generating one
+// if the request doesn't include it.
+func withRequestID(ctx context.Context, request osquery.ExtensionPluginRequest) context.Context {
+	requestID := request[requestIDKey]
+	if requestID == "" {
+		requestID = newRequestID()
+	}
+	ctx = logging.With(ctx, "request_id", requestID)
+	return context.WithValue(ctx, requestIDContextKey{}, requestID)
+}
+
+// Logger returns the structured logger set on the server with
+// osquery.ServerLogger, which annotates every line with the registry, table
+// name and request ID of the call. It can be called with the context passed to
+// the GenerateRows, StreamRows, InsertRow and UpdateRow functions. If no
+// logger is set, the returned logger discards everything.
+func Logger(ctx context.Context) logging.Logger {
+	return logging.FromContext(ctx)
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(id)
+}
+
+type responseObserverContextKey struct{}
+
+// WithResponseObserver returns a context which has a table plugin's Call method
+// report the number of rows in, and the size in bytes as sent to osquery of,
+// each response it returns to a generate request, including partial responses
+// returned with an error. The server uses this to notify a ResponseObserver.
+func WithResponseObserver(ctx context.Context, observe func(rows, bytes int)) context.Context {
+	return context.WithValue(ctx, responseObserverContextKey{}, observe)
+}
+
+// observeResponse reports the response to the observer set on ctx, if any.
+func observeResponse(ctx context.Context, response osquery.ExtensionPluginResponse) {
+	observe, ok := ctx.Value(responseObserverContextKey{}).(func(rows, bytes int))
+	if !ok || response == nil {
+		return
+	}
+	observe(len(response), responseSize(response))
+}
@@ -0,0 +1,67 @@
+package table
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bradleyjkemp/osquery-go/gen/osquery"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestIDFromContext(t *testing.T) {
+	var requestIDs []string
+	plugin, err := NewPlugin(
+		"mock",
+		ExampleRow{},
+		GenerateRows(func(ctx context.Context, queryCtx QueryContext) ([]RowDefinition, error) {
+			requestID, ok := RequestIDFromContext(ctx)
+			assert.True(t, ok)
+			requestIDs = append(requestIDs, requestID)
+			return []RowDefinition{}, nil
+		}))
+	require.NoError(t, err)
+
+	_, ok := RequestIDFromContext(context.Background())
+	assert.False(t, ok)
+
+	// The request's identifier is used if it has one
+	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": "{}", "request_id": "abc123"})
+	require.NoError(t, err)
+
+	// Otherwise a unique identifier is generated for each call
+	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	require.NoError(t, err)
+	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	require.NoError(t, err)
+
+	require.Len(t, requestIDs, 3)
+	assert.Equal(t, "abc123", requestIDs[0])
+	assert.Len(t, requestIDs[1], 32)
+	assert.Len(t, requestIDs[2], 32)
+	assert.NotEqual(t, requestIDs[1], requestIDs[2])
+}
+
+func TestWithResponseObserver(t *testing.T) {
+	plugin, err := NewPlugin(
+		"mock",
+		ValueRow{},
+		StreamRows(func(ctx context.Context, queryCtx QueryContext, emit func(RowDefinition) error) error {
+			emit(ValueRow{"aaaaa"})
+			return emit(ValueRow{"bbbbb"})
+		}))
+	require.NoError(t, err)
+
+	type stats struct{ rows, bytes int }
+	var observed []stats
+	ctx := WithResponseObserver(context.Background(), func(rows, bytes int) {
+		observed = append(observed, stats{rows, bytes})
+	})
+
+	// Each row is 24 bytes, and the list of rows adds 5
+	_, err = plugin.Call(ctx, osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	require.NoError(t, err)
+	_, err = plugin.Call(ctx, osquery.ExtensionPluginRequest{"action": "columns"})
+	require.NoError(t, err)
+	assert.Equal(t, []stats{{2, 53}}, observed)
+}
@@ -0,0 +1,69 @@
+package table
+
+import (
+	"fmt"
+
+	"github.com/bradleyjkemp/osquery-go/gen/osquery"
+)
+
+// StatusError is an error which is reported to osquery with a specific status
+// code and message, rather than the generic failure status. It can be returned
+// (or wrapped) from GenerateRows and StreamRows to signal specific conditions,
+// such as permission being denied, to osquery and whatever consumes its logs.
+//
+// Code should be non-zero as zero signals success to osquery. A zero Code is
+// reported as 1.
+type StatusError struct {
+	Code    int
+	Message string
+}
+
+func (e StatusError) Error() string {
+	return e.Message
+}
+
+// ExtensionStatus returns the status reported to osquery for the error.
+func (e StatusError) ExtensionStatus() osquery.ExtensionStatus {
+	code := int32(e.Code)
+	if code == 0 {
+		code = 1
+	}
+	return osquery.ExtensionStatus{Code: code, Message: e.Message}
+}
+
+// PartialError is returned from GenerateRows or StreamRows along with the rows
+// which were generated successfully, when only some of the table could be
+// generated. The rows are still sent to osquery, with a success status whose
+// message is the error, rather than failing the whole query.
+type PartialError struct {
+	Err error
+}
+
+func (e *PartialError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PartialError) Unwrap() error {
+	return e.Err
+}
+
+// ExtensionStatus returns the status reported to osquery for the error, which
+// is a success so that osquery uses the rows.
+func (e *PartialError) ExtensionStatus() osquery.ExtensionStatus {
+	return osquery.ExtensionStatus{Code: 0, Message: e.Err.Error()}
+}
+
+// UnknownActionError is returned from Call when osquery requests an action
+// which the table doesn't handle, such as one added by a newer version of
+// osquery. Use WithUnknownActionHandler to handle such requests instead.
+type UnknownActionError struct {
+	Table  string
+	Action string
+}
+
+func (e *UnknownActionError) Error() string {
+	if e.Action == "" {
+		return fmt.Sprintf("missing action in request to table %s", e.Table)
+	}
+	return fmt.Sprintf("unknown action %q requested from table %s", e.Action, e.Table)
+}
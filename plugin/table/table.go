@@ -2,65 +2,212 @@
 package table
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	stderrors "errors"
 	"fmt"
+	"math"
 	"math/big"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/bradleyjkemp/osquery-go/gen/osquery"
 	"github.com/pkg/errors"
 )
 
 type Plugin struct {
-	name     string
-	rowType  RowDefinition
-	columns  []ColumnDefinition
-	generate GenerateRowsImpl
-	insert   InsertRowImpl
-	update   UpdateRowImpl
+	name        string
+	registry    string
+	description string
+	rowType     RowDefinition
+	columns     []ColumnDefinition
+	fields      []columnField
+	generate    GenerateRowsImpl
+	stream      StreamRowsImpl
+	insert      InsertRowImpl
+	update      UpdateRowImpl
+	rowIDColumn string
+	lazyColumns []lazyColumn
+
+	skipInvalidConstraints bool
+	normalizeConstraints   bool
+	strictAffinity         bool
+	unknownColumns         UnknownColumnPolicy
+	jsonDecoder            JSONDecoder
+	maxResponseSize        int
+	rawActions             map[string]RawActionImpl
+	unknownActionHandler   RawActionImpl
+	columnsHandler         ColumnsImpl
 }
 
 type RowDefinition interface{}
 
+// MapRow is a row of already serialized values, keyed by column name. It can
+// be returned from GenerateRows in place of the table's row definition struct
+// when the data is naturally a map. Every key must be a column of the table,
+// matched case insensitively and by its aliases as in SQLite; columns missing
+// from the map are returned as empty values.
+type MapRow map[string]string
+
 type RowID int
 
 type Option func(*Plugin)
 
 func NewPlugin(name string, rowDefinition RowDefinition, options ...Option) (*Plugin, error) {
-	columns, err := generateColumnDefinition(rowDefinition)
+	columns, fields, err := generateColumnDefinition(rowDefinition)
 	if err != nil {
 		return nil, err
 	}
+	return newPlugin(name, rowDefinition, columns, fields, options)
+}
+
+// NewPluginDynamic creates a table whose columns are only known at runtime, such
+// as tables with columns read from a configuration file. The columns are given
+// explicitly rather than by a row definition struct, and generate returns each
+// row as a map from column name to value. Columns missing from a row are
+// returned as empty values, and columns without a type are TEXT columns.
+//
+// Any of the options for a table generated from MapRows can be used. Tables
+// created this way don't support INSERT or UPDATE.
+func NewPluginDynamic(name string, columns []ColumnDefinition, generate GenerateMapsImpl, options ...Option) (*Plugin, error) {
+	var declared []ColumnDefinition
+	fields := make([]columnField, 0, len(columns))
+	for _, col := range columns {
+		if col.Name == "" {
+			return nil, fmt.Errorf("column with empty name")
+		}
+		if columnNameUsed(declared, col.Name) {
+			return nil, fmt.Errorf("duplicate column %s", col.Name)
+		}
+		for _, alias := range col.Aliases {
+			if columnNameUsed(declared, alias) || strings.EqualFold(alias, col.Name) {
+				return nil, fmt.Errorf("column %s: duplicate column %s", col.Name, alias)
+			}
+		}
+		if col.Type == "" {
+			col.Type = ColumnTypeText
+		}
+		declared = append(declared, col)
+		fields = append(fields, columnField{name: col.Name})
+	}
 
+	options = append([]Option{GenerateRows(func(ctx context.Context, queryContext QueryContext) ([]RowDefinition, error) {
+		maps, err := generate(ctx, queryContext)
+		rows := make([]RowDefinition, 0, len(maps))
+		for _, m := range maps {
+			rows = append(rows, MapRow(m))
+		}
+		return rows, err
+	})}, options...)
+	return newPlugin(name, MapRow{}, declared, fields, options)
+}
+
+func newPlugin(name string, rowDefinition RowDefinition, columns []ColumnDefinition, fields []columnField, options []Option) (*Plugin, error) {
 	plugin := &Plugin{
-		name:    name,
-		rowType: rowDefinition,
-		columns: columns,
+		name:        name,
+		rowType:     rowDefinition,
+		columns:     columns,
+		fields:      fields,
+		jsonDecoder: stdJSONDecoder{},
 	}
 
 	for _, option := range options {
 		option(plugin)
 	}
 
+	if plugin.rowIDColumn != "" {
+		if columnNameUsed(plugin.columns, plugin.rowIDColumn) {
+			return nil, fmt.Errorf("row ID column: duplicate column %s", plugin.rowIDColumn)
+		}
+		plugin.columns = append(plugin.columns, ColumnDefinition{Name: plugin.rowIDColumn, Type: ColumnTypeInteger})
+	}
+	for i, col := range plugin.lazyColumns {
+		if col.Name == "" {
+			return nil, fmt.Errorf("lazy column with empty name")
+		}
+		if columnNameUsed(plugin.columns, col.Name) {
+			return nil, fmt.Errorf("lazy column: duplicate column %s", col.Name)
+		}
+		if col.Type == "" {
+			plugin.lazyColumns[i].Type = ColumnTypeText
+		}
+		plugin.columns = append(plugin.columns, plugin.lazyColumns[i].ColumnDefinition)
+	}
+
 	return plugin, nil
 }
 
-func generateColumnDefinition(rowDefinition RowDefinition) ([]ColumnDefinition, error) {
+// lazyColumn is a column added with WithLazyColumn.
+type lazyColumn struct {
+	ColumnDefinition
+	value LazyColumnImpl
+}
+
+// columnField holds the reflection metadata needed to serialize a single field
+// of a row definition. These are computed once when the plugin is created so
+// that generating rows doesn't need to inspect the struct tags again.
+type columnField struct {
+	name   string
+	index  []int // See reflect.Value.FieldByIndex
+	tag    string
+	rowID  bool // The implicit rowid field, which isn't a column
+	format func(reflect.Value) string
+	// marshal is used in place of format for fields with the "json" tag
+	// option and CellMarshaler fields, as marshaling the value can fail.
+	marshal func(reflect.Value) (string, error)
+}
+
+var (
+	rowIDType  = reflect.TypeOf(RowID(0))
+	bigIntType = reflect.TypeOf(&big.Int{})
+	timeType   = reflect.TypeOf(time.Time{})
+	bytesType  = reflect.TypeOf([]byte(nil))
+)
+
+func generateColumnDefinition(rowDefinition RowDefinition) ([]ColumnDefinition, []columnField, error) {
 	row := reflect.ValueOf(rowDefinition)
 	if row.Kind() != reflect.Struct {
-		return nil, fmt.Errorf("row definition must be a struct")
+		return nil, nil, fmt.Errorf("row definition must be a struct")
 	}
 
 	var columns []ColumnDefinition
-	for i := 0; i < row.Type().NumField(); i++ {
-		field := row.Type().Field(i)
+	var fields []columnField
+	if err := appendColumns(row.Type(), nil, &columns, &fields); err != nil {
+		return nil, nil, err
+	}
+	return columns, fields, nil
+}
+
+// appendColumns adds the columns for each field of the struct type, flattening
+// the fields of embedded structs into the parent in declaration order. index
+// is the index sequence of the struct within the row definition.
+func appendColumns(structType reflect.Type, index []int, columns *[]ColumnDefinition, fields *[]columnField) error {
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		fieldIndex := append(append([]int{}, index...), i)
 
 		fieldTag, fieldTagExists := field.Tag.Lookup("column")
+		fieldTag, description := splitDescription(fieldTag)
 
-		if field.Type == reflect.TypeOf(RowID(0)) && !fieldTagExists {
+		if field.Anonymous && !fieldTagExists && field.Type.Kind() == reflect.Struct && field.Type != timeType {
+			if err := appendColumns(field.Type, fieldIndex, columns, fields); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if field.Type == rowIDType && !fieldTagExists {
+			*fields = append(*fields, columnField{
+				name:   "rowid", // magic string that makes osquery pass this value back as the identifier for "update" calls
+				index:  fieldIndex,
+				rowID:  true,
+				format: fieldFormatter(field.Type, fieldTag),
+			})
 			continue
 		}
 
@@ -68,62 +215,390 @@ func generateColumnDefinition(rowDefinition RowDefinition) ([]ColumnDefinition,
 		if fieldTagExists {
 			columnName = strings.Split(fieldTag, ",")[0]
 		}
+		aliases := tagOptionValues(fieldTag, "alias")
+		for _, name := range append([]string{columnName}, aliases...) {
+			if columnNameUsed(*columns, name) {
+				return fmt.Errorf("field %s: duplicate column %s", field.Name, name)
+			}
+		}
+
+		var columnOptions ColumnOptions
+		for option, flag := range columnOptionTags {
+			if hasTagOption(fieldTag, option) {
+				columnOptions |= flag
+			}
+		}
+
+		if isJSONField(fieldTag) {
+			*columns = append(*columns, ColumnDefinition{
+				Name:        columnName,
+				Type:        ColumnTypeText,
+				Options:     columnOptions,
+				Aliases:     aliases,
+				Description: description,
+			})
+			*fields = append(*fields, columnField{
+				name:    columnName,
+				index:   fieldIndex,
+				tag:     fieldTag,
+				marshal: jsonMarshaler(fieldTag),
+			})
+			continue
+		}
+
+		if marshal := cellMarshaler(field.Type); marshal != nil {
+			columnType := ColumnTypeText
+			if types := tagOptionValues(fieldTag, "type"); len(types) > 0 {
+				columnType = ColumnType(strings.ToUpper(types[0]))
+				if !validColumnTypes[columnType] {
+					return fmt.Errorf("field %s has unknown column type %s", field.Name, types[0])
+				}
+			}
+			*columns = append(*columns, ColumnDefinition{
+				Name:        columnName,
+				Type:        columnType,
+				Options:     columnOptions,
+				Aliases:     aliases,
+				Description: description,
+			})
+			*fields = append(*fields, columnField{
+				name:    columnName,
+				index:   fieldIndex,
+				tag:     fieldTag,
+				marshal: marshal,
+			})
+			continue
+		}
+		if len(tagOptionValues(fieldTag, "type")) > 0 {
+			return fmt.Errorf("field %s: the type option is only supported for CellMarshaler fields", field.Name)
+		}
+
+		// Optional columns are represented by pointer fields and have the
+		// same affinity as the type they point to.
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Ptr && fieldType != bigIntType {
+			fieldType = fieldType.Elem()
+		}
 
 		var columnType ColumnType
-		switch field.Type.Kind() {
+		switch fieldType.Kind() {
 		case reflect.String:
 			columnType = ColumnTypeText
-		case reflect.Int:
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+			reflect.Uint8, reflect.Uint16, reflect.Bool:
 			columnType = ColumnTypeInteger
-		case reflect.Float64:
+		case reflect.Int64, reflect.Uint32:
+			columnType = ColumnTypeBigInt
+		case reflect.Uint, reflect.Uint64, reflect.Uintptr:
+			columnType = ColumnTypeUnsignedBigInt
+		case reflect.Float32, reflect.Float64:
 			columnType = ColumnTypeDouble
 		default:
-			if field.Type == reflect.TypeOf(&big.Int{}) {
+			if fieldType == bigIntType {
+				columnType = ColumnTypeBigInt
+				if hasTagOption(fieldTag, "unsigned") {
+					columnType = ColumnTypeUnsignedBigInt
+				}
+				break
+			}
+			if fieldType == timeType {
 				columnType = ColumnTypeBigInt
 				break
 			}
-			return nil, fmt.Errorf("field %s has unsupported type %s", field.Name, field.Type.Kind())
+			if fieldType == bytesType {
+				columnType = ColumnTypeBlob
+				break
+			}
+			return fmt.Errorf("field %s has unsupported type %s", field.Name, field.Type.Kind())
 		}
 
-		columns = append(columns, ColumnDefinition{
-			Name: columnName,
-			Type: columnType,
+		*columns = append(*columns, ColumnDefinition{
+			Name:        columnName,
+			Type:        columnType,
+			Options:     columnOptions,
+			Aliases:     aliases,
+			Description: description,
+		})
+		*fields = append(*fields, columnField{
+			name:   columnName,
+			index:  fieldIndex,
+			tag:    fieldTag,
+			format: fieldFormatter(field.Type, fieldTag),
 		})
 	}
-	return columns, nil
+	return nil
+}
+
+// columnNameUsed reports whether name is already the name or alias of one of
+// the columns. Names are compared case insensitively, as they are in SQLite.
+func columnNameUsed(columns []ColumnDefinition, name string) bool {
+	for _, column := range columns {
+		if strings.EqualFold(column.Name, name) {
+			return true
+		}
+		for _, alias := range column.Aliases {
+			if strings.EqualFold(alias, name) {
+				return true
+			}
+		}
+	}
+	return false
 }
 
-func rowsToPluginResponse(rows ...RowDefinition) osquery.ExtensionPluginResponse {
-	var response osquery.ExtensionPluginResponse
+// bigIntBuffers holds scratch buffers for formatting big.Int values. A pool is
+// used as rows may be generated concurrently.
+var bigIntBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, 64)
+		return &buf
+	},
+}
 
-	for _, rowDefinition := range rows {
-		row := reflect.ValueOf(rowDefinition)
-		result := map[string]string{}
-		for i := 0; i < row.Type().NumField(); i++ {
-			field := row.Type().Field(i)
-
-			columnName := field.Name
-			fieldTag, fieldTagExists := field.Tag.Lookup("column")
-			if fieldTagExists {
-				columnName = strings.Split(fieldTag, ",")[0]
+// fieldFormatter returns a function which renders values of the given field
+// type as osquery cell values. Nil pointers are rendered as empty cells, which
+// osquery treats as NULL.
+func fieldFormatter(fieldType reflect.Type, tag string) func(reflect.Value) string {
+	switch fieldType {
+	case bigIntType:
+		return func(value reflect.Value) string {
+			if value.IsNil() {
+				return ""
 			}
-			if field.Type == reflect.TypeOf(RowID(0)) && !fieldTagExists {
-				columnName = "rowid" // magic string that makes osquery pass this value back as the identifier for "update" calls
+			// Most values fit in 64 bits, so they can be formatted into
+			// a pooled buffer without the intermediate allocations made
+			// by big.Int.String.
+			x := value.Interface().(*big.Int)
+			buf := bigIntBuffers.Get().(*[]byte)
+			switch {
+			case x.IsInt64():
+				*buf = strconv.AppendInt((*buf)[:0], x.Int64(), 10)
+			case x.IsUint64():
+				*buf = strconv.AppendUint((*buf)[:0], x.Uint64(), 10)
+			default:
+				*buf = x.Append((*buf)[:0], 10)
+			}
+			formatted := string(*buf)
+			bigIntBuffers.Put(buf)
+			return formatted
+		}
+	case timeType:
+		unit := timeUnit(tag)
+		return func(value reflect.Value) string {
+			return formatTime(value.Interface().(time.Time), unit)
+		}
+	case bytesType:
+		return func(value reflect.Value) string {
+			return string(value.Bytes())
+		}
+	}
+
+	switch fieldType.Kind() {
+	case reflect.Ptr:
+		formatElem := fieldFormatter(fieldType.Elem(), tag)
+		return func(value reflect.Value) string {
+			if value.IsNil() {
+				return ""
+			}
+			return formatElem(value.Elem())
+		}
+	case reflect.String:
+		return func(value reflect.Value) string {
+			return value.String()
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return func(value reflect.Value) string {
+			return strconv.FormatInt(value.Int(), 10)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return func(value reflect.Value) string {
+			return strconv.FormatUint(value.Uint(), 10)
+		}
+	case reflect.Bool:
+		return func(value reflect.Value) string {
+			if value.Bool() {
+				return "1"
+			}
+			return "0"
+		}
+	case reflect.Float32, reflect.Float64:
+		// Format with the precision of the field so that float32 values
+		// aren't given spurious digits by the conversion to float64.
+		bitSize := fieldType.Bits()
+		// SQLite can't parse NaN or infinities, so they are returned as
+		// NULL unless the "nonfinite" tag option asks for them as text.
+		keepNonFinite := hasTagOption(tag, "nonfinite")
+		return func(value reflect.Value) string {
+			f := value.Float()
+			if !keepNonFinite && (math.IsNaN(f) || math.IsInf(f, 0)) {
+				return ""
+			}
+			return strconv.FormatFloat(f, 'g', -1, bitSize)
+		}
+	default:
+		return func(value reflect.Value) string {
+			return fmt.Sprint(value.Interface())
+		}
+	}
+}
+
+// CellMarshaler is implemented by types which serialize themselves to osquery
+// cell values. It is used in place of the built in serialization of a row
+// field, so that types the package doesn't otherwise support (such as enums or
+// addresses) can be returned. The column is TEXT unless set with the "type" tag
+// option, for example `column:"port,type=INTEGER"`. A nil pointer to a
+// CellMarshaler is returned as an empty cell.
+type CellMarshaler interface {
+	MarshalCell() (string, error)
+}
+
+var cellMarshalerType = reflect.TypeOf((*CellMarshaler)(nil)).Elem()
+
+// cellMarshaler returns a function which serializes values of the field type
+// with MarshalCell, or nil if neither the type nor a pointer to it implements
+// CellMarshaler.
+func cellMarshaler(fieldType reflect.Type) func(reflect.Value) (string, error) {
+	switch {
+	case fieldType.Implements(cellMarshalerType):
+		return func(value reflect.Value) (string, error) {
+			if value.Kind() == reflect.Ptr && value.IsNil() {
+				return "", nil
+			}
+			return value.Interface().(CellMarshaler).MarshalCell()
+		}
+	case reflect.PtrTo(fieldType).Implements(cellMarshalerType):
+		return func(value reflect.Value) (string, error) {
+			// Row fields aren't addressable, so call the method on a
+			// copy.
+			ptr := reflect.New(fieldType)
+			ptr.Elem().Set(value)
+			return ptr.Interface().(CellMarshaler).MarshalCell()
+		}
+	default:
+		return nil
+	}
+}
+
+// isJSONField reports whether the column tag has the "json" option, which
+// serializes the field as a JSON encoded TEXT column.
+func isJSONField(tag string) bool {
+	return hasTagOption(tag, "json") || len(tagOptionValues(tag, "json")) > 0
+}
+
+// jsonMarshaler returns a function which JSON encodes the value of a field. Nil
+// maps, slices and pointers are encoded as an empty string, or as "null" with
+// the "json=null" tag option.
+func jsonMarshaler(tag string) func(reflect.Value) (string, error) {
+	nilValue := ""
+	for _, value := range tagOptionValues(tag, "json") {
+		if value == "null" {
+			nilValue = "null"
+		}
+	}
+
+	return func(value reflect.Value) (string, error) {
+		switch value.Kind() {
+		case reflect.Map, reflect.Slice, reflect.Ptr, reflect.Interface:
+			if value.IsNil() {
+				return nilValue, nil
+			}
+		}
+		encoded, err := json.Marshal(value.Interface())
+		if err != nil {
+			return "", err
+		}
+		return string(encoded), nil
+	}
+}
+
+func rowsToPluginResponse(fields []columnField, rows ...RowDefinition) (osquery.ExtensionPluginResponse, error) {
+	response := make(osquery.ExtensionPluginResponse, 0, len(rows))
+
+	for _, rowDefinition := range rows {
+		result := make(map[string]string, len(fields))
+		if mapRow, ok := rowDefinition.(MapRow); ok {
+			for _, field := range fields {
+				result[field.name] = mapRow[field.name]
 			}
+			response = append(response, result)
+			continue
+		}
 
-			result[columnName] = fmt.Sprint(row.Field(i).Interface())
+		row := reflect.ValueOf(rowDefinition)
+		for _, field := range fields {
+			value := row.FieldByIndex(field.index)
+			if field.marshal != nil {
+				cell, err := field.marshal(value)
+				if err != nil {
+					return nil, fmt.Errorf("column %s: %w", field.name, err)
+				}
+				result[field.name] = cell
+				continue
+			}
+			result[field.name] = field.format(value)
 		}
 		response = append(response, result)
 	}
-	return response
+	return response, nil
 }
 
 func (t *Plugin) Name() string {
 	return t.name
 }
 
+// Registry is the name of the osquery registry for table plugins.
+const Registry = "table"
+
+// RegistryName returns the registry the table is added to, which is Registry
+// unless changed with WithRegistry.
 func (t *Plugin) RegistryName() string {
-	return "table"
+	if t.registry != "" {
+		return t.registry
+	}
+	return Registry
+}
+
+// Description returns the human readable description of the table set with
+// WithDescription. It is not sent to osquery.
+func (t *Plugin) Description() string {
+	return t.description
+}
+
+// Columns returns the definitions of the columns this table advertises to
+// osquery, as derived from the row definition.
+func (t *Plugin) Columns() []ColumnDefinition {
+	columns := make([]ColumnDefinition, len(t.columns))
+	copy(columns, t.columns)
+	return columns
+}
+
+// LookupColumn returns the definition of the named column, which may also be
+// one of its aliases. As in SQLite, column names are case-insensitive.
+func (t *Plugin) LookupColumn(name string) (ColumnDefinition, bool) {
+	for _, col := range t.columns {
+		if strings.EqualFold(col.Name, name) {
+			return col, true
+		}
+		for _, alias := range col.Aliases {
+			if strings.EqualFold(alias, name) {
+				return col, true
+			}
+		}
+	}
+	return ColumnDefinition{}, false
+}
+
+// Column returns the canonical name of the named column, panicking if the
+// table doesn't have the column. It can be used when looking up constraints so
+// that a misspelt column name fails loudly rather than matching no
+// constraints:
+//
+//	paths := queryContext.GetConstraintValues(plugin.Column("path"), table.OperatorEquals)
+func (t *Plugin) Column(name string) string {
+	col, ok := t.LookupColumn(name)
+	if !ok {
+		panic(fmt.Sprintf("table %s has no column %s", t.name, name))
+	}
+	return col.Name
 }
 
 func (t *Plugin) Routes() osquery.ExtensionPluginResponse {
@@ -133,18 +608,38 @@ func (t *Plugin) Routes() osquery.ExtensionPluginResponse {
 			"id":   "column",
 			"name": col.Name,
 			"type": string(col.Type),
-			"op":   "0",
+			"op":   strconv.Itoa(int(col.Options)),
 		})
 	}
+	// osquery expects a route for each alias, naming the column it
+	// refers to as the target.
+	for _, col := range t.columns {
+		for _, alias := range col.Aliases {
+			routes = append(routes, map[string]string{
+				"id":     "columnAlias",
+				"name":   alias,
+				"target": col.Name,
+			})
+		}
+	}
 	return routes
 }
 
 func (t *Plugin) Call(ctx context.Context, request osquery.ExtensionPluginRequest) (osquery.ExtensionPluginResponse, error) {
+	ctx = withRequestID(ctx, request)
+
+	if handler, ok := t.rawActions[request["action"]]; ok {
+		return handler(ctx, request)
+	}
+
 	switch request["action"] {
 	case "generate":
 		resp, err := t.generateRows(ctx, request)
+		observeResponse(ctx, resp)
 		if err != nil {
-			return nil, err
+			// The response holds the rows which were generated
+			// if the error is a PartialError.
+			return resp, err
 		}
 		return resp, nil
 
@@ -175,12 +670,17 @@ func (t *Plugin) Call(ctx context.Context, request osquery.ExtensionPluginReques
 		return resp, nil
 
 	case "columns":
+		if t.columnsHandler != nil {
+			return t.columnsHandler(ctx), nil
+		}
 		return t.Routes(), nil
 
 	default:
-		return nil, fmt.Errorf("unknown action: %s", request["action"])
+		if t.unknownActionHandler != nil {
+			return t.unknownActionHandler(ctx, request)
+		}
+		return nil, &UnknownActionError{Table: t.name, Action: request["action"]}
 	}
-
 }
 
 func (t *Plugin) Ping(ctx context.Context) osquery.ExtensionStatus {
@@ -190,20 +690,383 @@ func (t *Plugin) Ping(ctx context.Context) osquery.ExtensionStatus {
 func (t *Plugin) Shutdown() {}
 
 func (t *Plugin) generateRows(ctx context.Context, request osquery.ExtensionPluginRequest) (osquery.ExtensionPluginResponse, error) {
-	if t.generate == nil {
+	if t.generate == nil && t.stream == nil {
 		return nil, fmt.Errorf("unsupported operation \"generate\"")
 	}
-	queryContext, err := parseQueryContext(request["context"])
+	queryContext, warnings, err := parseQueryContextWarnings(t.jsonDecoder, request["context"], t.skipInvalidConstraints)
 	if err != nil {
 		return nil, fmt.Errorf("error parsing context JSON: %w", err)
 	}
+	skipped, err := t.checkUnknownColumns(queryContext)
+	if err != nil {
+		return nil, fmt.Errorf("error checking constraints: %w", err)
+	}
+	warnings = append(warnings, skipped...)
+	if t.strictAffinity {
+		if err := t.checkAffinities(queryContext); err != nil {
+			return nil, fmt.Errorf("error checking constraints: %w", err)
+		}
+	}
+	t.resolveAliases(queryContext)
+	if t.normalizeConstraints {
+		for name, constraintList := range queryContext.Constraints {
+			constraintList.Constraints = normalizeConstraints(constraintList.Constraints)
+			queryContext.Constraints[name] = constraintList
+		}
+	}
+	if len(warnings) > 0 {
+		ctx = context.WithValue(ctx, constraintWarningsKey{}, warnings)
+	}
+
+	if t.stream != nil {
+		return t.streamRows(ctx, *queryContext)
+	}
+
+	rows, genErr := t.generate(ctx, *queryContext)
+	if genErr != nil && !isPartial(genErr) {
+		return nil, fmt.Errorf("error generating table: %w", genErr)
+	}
+
+	// There is no point serializing the rows if osquery has given up waiting
+	// for them.
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("error generating table: %w", err)
+	}
+
+	for i, row := range rows {
+		checked, err := t.checkRowType(row)
+		if err != nil {
+			return nil, fmt.Errorf("error generating table: %w", err)
+		}
+		rows[i] = checked
+	}
+
+	response, err := rowsToPluginResponse(t.fields, rows...)
+	if err != nil {
+		return nil, fmt.Errorf("error generating table: %w", err)
+	}
+	if err := t.computeLazyColumns(ctx, *queryContext, rows, response); err != nil {
+		return nil, fmt.Errorf("error generating table: %w", err)
+	}
+	t.numberRows(response, 0)
+	if err := t.checkResponseSize(responseSize(response)); err != nil {
+		return nil, fmt.Errorf("error generating table: %w", err)
+	}
+	if genErr != nil {
+		return response, fmt.Errorf("error generating table: %w", genErr)
+	}
+	return response, nil
+}
+
+func (t *Plugin) streamRows(ctx context.Context, queryContext QueryContext) (osquery.ExtensionPluginResponse, error) {
+	// emit may be called from several goroutines, so the response is
+	// guarded by mutex.
+	var mutex sync.Mutex
+	response := osquery.ExtensionPluginResponse{}
+	size := emptyResponseSize
+	var sizeErr error
+	finished := false
+	emit := func(row RowDefinition) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		row, err := t.checkRowType(row)
+		if err != nil {
+			return err
+		}
+		rowResponse, err := rowsToPluginResponse(t.fields, row)
+		if err != nil {
+			return err
+		}
+		if err := t.computeLazyColumns(ctx, queryContext, []RowDefinition{row}, rowResponse); err != nil {
+			return err
+		}
 
-	rows, err := t.generate(ctx, *queryContext)
+		mutex.Lock()
+		defer mutex.Unlock()
+		if finished {
+			return ErrEmitAfterReturn
+		}
+		if sizeErr != nil {
+			return sizeErr
+		}
+		t.numberRows(rowResponse, len(response))
+		for _, r := range rowResponse {
+			size += rowSize(r)
+		}
+		// Stop generating as soon as the response is too large, rather
+		// than holding rows which can't be returned.
+		if sizeErr = t.checkResponseSize(size); sizeErr != nil {
+			response = nil
+			return sizeErr
+		}
+		response = append(response, rowResponse...)
+		return nil
+	}
+
+	err := t.stream(ctx, queryContext, emit)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	finished = true
+	if sizeErr != nil {
+		return nil, fmt.Errorf("error generating table: %w", sizeErr)
+	}
 	if err != nil {
+		if isPartial(err) {
+			return response, fmt.Errorf("error generating table: %w", err)
+		}
 		return nil, fmt.Errorf("error generating table: %w", err)
 	}
 
-	return rowsToPluginResponse(rows...), nil
+	return response, nil
+}
+
+// ErrEmitAfterReturn is returned by the emit function passed to a StreamRows
+// function if it is called after the stream function has returned, such as by
+// a worker which wasn't waited for. The row is dropped.
+var ErrEmitAfterReturn = stderrors.New("emit called after stream function returned")
+
+// The size of a response encoded with thrift's binary protocol is the list
+// header, then for each row a map header and for each cell the length of the
+// key and value strings followed by the strings themselves.
+const (
+	emptyResponseSize = 5
+	emptyRowSize      = 6
+	cellOverhead      = 8
+)
+
+// responseSize returns the size in bytes of the response when encoded by
+// thrift to be sent to osquery.
+func responseSize(response osquery.ExtensionPluginResponse) int {
+	size := emptyResponseSize
+	for _, row := range response {
+		size += rowSize(row)
+	}
+	return size
+}
+
+func rowSize(row map[string]string) int {
+	size := emptyRowSize
+	for k, v := range row {
+		size += cellOverhead + len(k) + len(v)
+	}
+	return size
+}
+
+// checkResponseSize returns an error if a response of the given size exceeds
+// the plugin's maximum response size.
+func (t *Plugin) checkResponseSize(size int) error {
+	if t.maxResponseSize > 0 && size > t.maxResponseSize {
+		return fmt.Errorf("response exceeds %d bytes, consider adding constraints to the query", t.maxResponseSize)
+	}
+	return nil
+}
+
+// isPartial reports whether an error from generating a table is a
+// PartialError, so the rows generated should still be returned.
+func isPartial(err error) bool {
+	var partial *PartialError
+	return stderrors.As(err, &partial)
+}
+
+// checkAffinities checks that the affinity of each constrained column matches
+// the declared type of the column. A mismatch means that osquery has a
+// different schema for the table than the plugin.
+func (t *Plugin) checkAffinities(queryContext *QueryContext) error {
+	names := make([]string, 0, len(queryContext.Constraints))
+	for name := range queryContext.Constraints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		col, ok := t.LookupColumn(name)
+		if !ok {
+			return fmt.Errorf("constraint on undeclared column %s", name)
+		}
+		affinity := queryContext.Constraints[name].Affinity
+		if affinity != col.Type {
+			return fmt.Errorf("column %s: constraint affinity %s does not match declared type %s", name, affinity, col.Type)
+		}
+	}
+	return nil
+}
+
+// checkUnknownColumns applies the plugin's UnknownColumnPolicy to constraints
+// on columns that the table doesn't declare, returning warnings for any
+// constraints which are skipped.
+func (t *Plugin) checkUnknownColumns(queryContext *QueryContext) ([]error, error) {
+	if t.unknownColumns == KeepUnknownColumns {
+		return nil, nil
+	}
+
+	names := make([]string, 0, len(queryContext.Constraints))
+	for name := range queryContext.Constraints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var warnings []error
+	for _, name := range names {
+		if _, ok := t.LookupColumn(name); ok {
+			continue
+		}
+		if t.unknownColumns == RejectUnknownColumns {
+			return nil, fmt.Errorf("constraint on undeclared column %s", name)
+		}
+		delete(queryContext.Constraints, name)
+		warnings = append(warnings, fmt.Errorf("skipped constraints on undeclared column %s", name))
+	}
+	return warnings, nil
+}
+
+// computeLazyColumns sets the values of the lazy columns that the query uses in
+// the serialized rows.
+func (t *Plugin) computeLazyColumns(ctx context.Context, queryContext QueryContext, rows []RowDefinition, response osquery.ExtensionPluginResponse) error {
+	for _, col := range t.lazyColumns {
+		if !queryContext.IsColumnSelected(col.Name) && !queryContext.HasConstraint(col.Name) {
+			continue
+		}
+		for i, row := range rows {
+			value, err := col.value(ctx, row)
+			if err != nil {
+				return fmt.Errorf("column %s: %w", col.Name, err)
+			}
+			response[i][col.Name] = value
+		}
+	}
+	return nil
+}
+
+// numberRows sets the row ID column, if the table has one, numbering the rows
+// from offset+1.
+func (t *Plugin) numberRows(response osquery.ExtensionPluginResponse, offset int) {
+	if t.rowIDColumn == "" {
+		return
+	}
+	for i, row := range response {
+		row[t.rowIDColumn] = strconv.Itoa(offset + i + 1)
+	}
+}
+
+// resolveAliases moves the constraints on any column aliases to the column they
+// are an alias of, so that the table implementation only needs to handle the
+// canonical column names.
+func (t *Plugin) resolveAliases(queryContext *QueryContext) {
+	for _, col := range t.columns {
+		for _, alias := range col.Aliases {
+			aliased, ok := queryContext.Constraints[alias]
+			if !ok {
+				continue
+			}
+			delete(queryContext.Constraints, alias)
+
+			constraints := queryContext.Constraints[col.Name]
+			constraints.Affinity = col.Type
+			constraints.Constraints = append(constraints.Constraints, aliased.Constraints...)
+			queryContext.Constraints[col.Name] = constraints
+		}
+	}
+
+	// Aliases in the selected columns are replaced with the column they alias,
+	// leaving out any column which is already selected.
+	if len(queryContext.SelectedColumns) == 0 {
+		return
+	}
+	selected := make([]string, 0, len(queryContext.SelectedColumns))
+	seen := map[string]bool{}
+	for _, name := range queryContext.SelectedColumns {
+		if col, ok := t.aliasedColumn(name); ok {
+			name = col
+		}
+		if !seen[name] {
+			seen[name] = true
+			selected = append(selected, name)
+		}
+	}
+	queryContext.SelectedColumns = selected
+}
+
+// aliasedColumn returns the name of the column with the given alias.
+func (t *Plugin) aliasedColumn(alias string) (string, bool) {
+	for _, col := range t.columns {
+		for _, a := range col.Aliases {
+			if a == alias {
+				return col.Name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// checkRowType ensures that a row returned by the table implementation is of
+// the same type as the RowDefinition the plugin was created with, or is a
+// MapRow containing only the table's columns. A MapRow is returned keyed by
+// the canonical column names, as its keys may be aliases or differently cased.
+func (t *Plugin) checkRowType(row RowDefinition) (RowDefinition, error) {
+	if mapRow, ok := row.(MapRow); ok {
+		return t.resolveMapRow(mapRow)
+	}
+	if reflect.TypeOf(row) != reflect.TypeOf(t.rowType) {
+		return nil, fmt.Errorf("row type %T does not match declared schema %T", row, t.rowType)
+	}
+	return row, nil
+}
+
+// resolveMapRow returns the MapRow keyed by the names of the table's columns.
+// Keys are matched case insensitively and may be a column's alias, as column
+// names are in SQLite.
+func (t *Plugin) resolveMapRow(row MapRow) (MapRow, error) {
+	canonical := true
+	for key := range row {
+		if !t.hasField(key) {
+			canonical = false
+			break
+		}
+	}
+	if canonical {
+		return row, nil
+	}
+
+	resolved := make(MapRow, len(row))
+	for key, value := range row {
+		name, ok := t.mapRowColumn(key)
+		if !ok {
+			return nil, fmt.Errorf("MapRow has unknown column %q", key)
+		}
+		if _, ok := resolved[name]; ok {
+			return nil, fmt.Errorf("MapRow has more than one value for column %q", name)
+		}
+		resolved[name] = value
+	}
+	return resolved, nil
+}
+
+// mapRowColumn returns the name of the column which a MapRow key refers to.
+func (t *Plugin) mapRowColumn(key string) (string, bool) {
+	for _, field := range t.fields {
+		if strings.EqualFold(field.name, key) {
+			return field.name, true
+		}
+	}
+	for _, col := range t.columns {
+		for _, alias := range col.Aliases {
+			if strings.EqualFold(alias, key) {
+				return col.Name, true
+			}
+		}
+	}
+	return "", false
+}
+
+func (t *Plugin) hasField(name string) bool {
+	for _, field := range t.fields {
+		if field.name == name {
+			return true
+		}
+	}
+	return false
 }
 
 func (t *Plugin) insertRow(ctx context.Context, request osquery.ExtensionPluginRequest) (osquery.ExtensionPluginResponse, error) {
@@ -261,59 +1124,214 @@ func parseRowValues(rowJSON string, definition RowDefinition) (RowDefinition, er
 		return nil, err
 	}
 
-	row := reflect.New(reflect.TypeOf(definition)).Elem()
-	offset := 0
-	for i := 0; i < row.Type().NumField(); i++ {
-		field := row.Type().Field(i)
+	_, fields, err := generateColumnDefinition(definition)
+	if err != nil {
+		return nil, err
+	}
 
-		_, fieldTagExists := field.Tag.Lookup("column")
-		if field.Type == reflect.TypeOf(RowID(0)) && !fieldTagExists {
+	row := reflect.New(reflect.TypeOf(definition)).Elem()
+	i := 0
+	for _, field := range fields {
+		if field.rowID {
 			// This is just a row ID field that isn't an actual column
-			offset--
 			continue
 		}
+		if i >= len(rowValues) {
+			return nil, fmt.Errorf("expected a value for column %s but only got %d values", field.name, len(rowValues))
+		}
 
-		rowValue := rowValues[i+offset]
-		switch field.Type.Kind() {
-		case reflect.String:
-			row.Field(i).SetString(string(rowValue))
+		if err := setFieldValue(row.FieldByIndex(field.index), string(rowValues[i]), field.tag); err != nil {
+			return nil, fmt.Errorf("column %s: %w", field.name, err)
+		}
+		i++
+	}
 
-		case reflect.Int:
-			intValue, err := strconv.Atoi(string(rowValue))
-			if err != nil {
-				return nil, err
-			}
-			row.Field(i).SetInt(int64(intValue))
+	return row.Interface(), nil
+}
 
-		case reflect.Float64:
-			floatValue, err := strconv.ParseFloat(string(rowValue), 64)
+// setFieldValue parses a single JSON value sent by osquery into a row field.
+func setFieldValue(field reflect.Value, rowValue string, tag string) error {
+	if isJSONField(tag) {
+		if rowValue == "null" {
+			return nil
+		}
+		// The column is TEXT so osquery sends the JSON encoded as a string
+		var encoded string
+		if err := json.Unmarshal([]byte(rowValue), &encoded); err != nil {
+			return err
+		}
+		if encoded == "" || encoded == "null" {
+			return nil
+		}
+		return json.Unmarshal([]byte(encoded), field.Addr().Interface())
+	}
+
+	if field.Type() == bigIntType {
+		if rowValue == "null" {
+			return nil
+		}
+		bigIntValue, ok := big.NewInt(0).SetString(rowValue, 10)
+		if !ok {
+			return fmt.Errorf("invalid big.Int %s", rowValue)
+		}
+		field.Set(reflect.ValueOf(bigIntValue))
+		return nil
+	}
+
+	if field.Kind() == reflect.Ptr {
+		if rowValue == "null" {
+			return nil
+		}
+		value := reflect.New(field.Type().Elem())
+		if err := setFieldValue(value.Elem(), rowValue, tag); err != nil {
+			return err
+		}
+		field.Set(value)
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(rowValue)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		intValue, err := strconv.ParseInt(rowValue, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(intValue)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		uintValue, err := strconv.ParseUint(rowValue, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetUint(uintValue)
+
+	case reflect.Bool:
+		boolValue, err := strconv.ParseBool(rowValue)
+		if err != nil {
+			return err
+		}
+		field.SetBool(boolValue)
+
+	case reflect.Float32, reflect.Float64:
+		floatValue, err := strconv.ParseFloat(rowValue, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetFloat(floatValue)
+
+	default:
+		if field.Type() == bytesType {
+			if rowValue != "null" {
+				field.SetBytes([]byte(rowValue))
+			}
+			return nil
+		}
+		if field.Type() == timeType {
+			timeValue, err := parseTime(rowValue, timeUnit(tag))
 			if err != nil {
-				return nil, err
+				return err
 			}
-			row.Field(i).SetFloat(floatValue)
+			field.Set(reflect.ValueOf(timeValue))
+			return nil
+		}
+		return fmt.Errorf("unsupported type %s", field.Kind())
+	}
 
-		default:
-			if field.Type == reflect.TypeOf(&big.Int{}) {
-				bigIntValue, ok := big.NewInt(0).SetString(string(rowValue), 10)
-				if !ok {
-					return nil, fmt.Errorf("invalid big.Int %s", string(rowValue))
-				}
-				row.Field(i).Set(reflect.ValueOf(bigIntValue))
-				break
-			}
-			return nil, fmt.Errorf("field %s has unsupported type %s", field.Name, field.Type.Kind())
+	return nil
+}
+
+// splitDescription separates the "desc=..." option from a column tag. The
+// description runs to the end of the tag so that it may contain commas, which
+// means it must be the last option.
+func splitDescription(tag string) (string, string) {
+	i := strings.Index(tag, ",desc=")
+	if i < 0 {
+		return tag, ""
+	}
+	return tag[:i], strings.TrimSpace(tag[i+len(",desc="):])
+}
+
+// tagOptionValues returns the values of every "option=value" option in the
+// column tag.
+func tagOptionValues(tag string, option string) []string {
+	var values []string
+	for _, tagOption := range strings.Split(tag, ",")[1:] {
+		tagOption = strings.TrimSpace(tagOption)
+		if strings.HasPrefix(tagOption, option+"=") {
+			values = append(values, strings.TrimPrefix(tagOption, option+"="))
+		}
+	}
+	return values
+}
+
+// hasTagOption reports whether the comma-separated options following the
+// column name in a `column:"..."` struct tag contain the given option.
+func hasTagOption(tag string, option string) bool {
+	for _, tagOption := range strings.Split(tag, ",")[1:] {
+		if strings.TrimSpace(tagOption) == option {
+			return true
 		}
 	}
+	return false
+}
 
-	return row.Interface(), nil
+// timeUnit returns the precision of a time.Time column as a Unix timestamp.
+// This defaults to seconds and can be changed with the "unixmilli" or
+// "unixnano" tag options.
+func timeUnit(tag string) time.Duration {
+	switch {
+	case hasTagOption(tag, "unixnano"):
+		return time.Nanosecond
+	case hasTagOption(tag, "unixmilli"):
+		return time.Millisecond
+	default:
+		return time.Second
+	}
+}
+
+// formatTime renders a time.Time column as a Unix timestamp in the given unit.
+// A zero time.Time is rendered as an empty cell.
+func formatTime(t time.Time, unit time.Duration) string {
+	if t.IsZero() {
+		return ""
+	}
+	// Build the timestamp from whole seconds rather than t.UnixNano so that
+	// millisecond timestamps don't overflow outside the years 1678-2262.
+	perSecond := int64(time.Second / unit)
+	return strconv.FormatInt(t.Unix()*perSecond+int64(t.Nanosecond())/int64(unit), 10)
+}
+
+// parseTime is the inverse of formatTime.
+func parseTime(value string, unit time.Duration) (time.Time, error) {
+	if value == "" || value == `""` {
+		return time.Time{}, nil
+	}
+
+	timestamp, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %s: %w", value, err)
+	}
+
+	perSecond := int64(time.Second / unit)
+	return time.Unix(timestamp/perSecond, (timestamp%perSecond)*int64(unit)), nil
 }
 
 // ColumnDefinition defines the relevant information for a column in a table
-// plugin. Both values are mandatory. Prefer using the *Column helpers to
+// plugin. Name and Type are mandatory. Prefer using the *Column helpers to
 // create ColumnDefinition structs.
 type ColumnDefinition struct {
-	Name string
-	Type ColumnType
+	Name    string
+	Type    ColumnType
+	Options ColumnOptions
+	// Aliases are alternative names for the column, such as a name it has
+	// been renamed from. They are set with the "alias=name" tag option.
+	Aliases []string
+	// Description is a human readable description of the column, set with
+	// the "desc=..." tag option. It is not sent to osquery.
+	Description string
 }
 
 // ColumnType is a strongly typed representation of the data type string for a
@@ -322,12 +1340,59 @@ type ColumnType string
 
 // The following column types are defined in osquery tables.h.
 const (
-	ColumnTypeText    ColumnType = "TEXT"
-	ColumnTypeInteger ColumnType = "INTEGER"
-	ColumnTypeBigInt  ColumnType = "BIGINT"
-	ColumnTypeDouble  ColumnType = "DOUBLE"
+	ColumnTypeText           ColumnType = "TEXT"
+	ColumnTypeInteger        ColumnType = "INTEGER"
+	ColumnTypeBigInt         ColumnType = "BIGINT"
+	ColumnTypeUnsignedBigInt ColumnType = "UNSIGNED_BIGINT"
+	ColumnTypeDouble         ColumnType = "DOUBLE"
+	ColumnTypeBlob           ColumnType = "BLOB"
 )
 
+// validColumnTypes is the set of column types that can be set with the "type"
+// tag option.
+var validColumnTypes = map[ColumnType]bool{
+	ColumnTypeText:           true,
+	ColumnTypeInteger:        true,
+	ColumnTypeBigInt:         true,
+	ColumnTypeUnsignedBigInt: true,
+	ColumnTypeDouble:         true,
+	ColumnTypeBlob:           true,
+}
+
+// ColumnOptions is a bitmask of the options osquery supports for a column.
+// They are set on a row definition field using the column struct tag, for
+// example `column:"pid,index"` or `column:"path,required"`.
+type ColumnOptions int
+
+// The following column options are defined in osquery tables.h.
+const (
+	// ColumnOptionDefault is a plain column with no special behaviour.
+	ColumnOptionDefault ColumnOptions = 0
+	// ColumnOptionIndex marks a column as able to efficiently look up rows.
+	ColumnOptionIndex ColumnOptions = 1
+	// ColumnOptionRequired means osquery will refuse to query the table
+	// unless the query constrains this column.
+	ColumnOptionRequired ColumnOptions = 2
+	// ColumnOptionAdditional means the column may be used to generate
+	// additional rows.
+	ColumnOptionAdditional ColumnOptions = 4
+	// ColumnOptionOptimized marks a column as able to take advantage of
+	// constraints to optimize generation.
+	ColumnOptionOptimized ColumnOptions = 8
+	// ColumnOptionHidden hides the column from SELECT * queries.
+	ColumnOptionHidden ColumnOptions = 16
+)
+
+// columnOptionTags maps the column struct tag options to the column option
+// they set.
+var columnOptionTags = map[string]ColumnOptions{
+	"index":      ColumnOptionIndex,
+	"required":   ColumnOptionRequired,
+	"additional": ColumnOptionAdditional,
+	"optimized":  ColumnOptionOptimized,
+	"hidden":     ColumnOptionHidden,
+}
+
 // QueryContext contains the constraints from the WHERE clause of the query,
 // that can optionally be used to optimize the table generation. Note that the
 // osquery SQLite engine will perform the filtering with these constraints, so
@@ -336,6 +1401,82 @@ type QueryContext struct {
 	// Constraints is a map from column name to the details of the
 	// constraints on that column.
 	Constraints map[string]ConstraintList
+	// SelectedColumns are the columns used by the query, when osquery
+	// provides them. An empty slice means that all columns should be
+	// generated. Columns which are not selected can be left out of the rows,
+	// so expensive columns only need to be computed when they are used.
+	SelectedColumns []string
+	// Distinct is set when the query only needs distinct rows, as for
+	// SELECT DISTINCT. Duplicate rows can then be left out, which together
+	// with SelectedColumns allows a single column to be listed without
+	// building whole rows. osquery itself doesn't currently signal this, so
+	// generate functions must still work when it is not set.
+	Distinct bool
+}
+
+// IsColumnSelected reports whether the given column is used by the query and
+// so needs to be generated.
+func (q QueryContext) IsColumnSelected(columnName string) bool {
+	if len(q.SelectedColumns) == 0 {
+		return true
+	}
+	for _, name := range q.SelectedColumns {
+		if strings.EqualFold(name, columnName) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetConstraints returns all of the constraints on the given column. An empty
+// slice is returned if the column is unconstrained.
+func (q QueryContext) GetConstraints(columnName string) []Constraint {
+	constraintList, ok := q.Constraints[columnName]
+	if !ok || constraintList.Constraints == nil {
+		return []Constraint{}
+	}
+	return constraintList.Constraints
+}
+
+// HasConstraint reports whether the query has at least one constraint on the
+// given column.
+func (q QueryContext) HasConstraint(columnName string) bool {
+	return len(q.GetConstraints(columnName)) > 0
+}
+
+// RequireConstraints returns an error naming any of the given columns that the
+// query has no constraints on. osquery won't query a table without constraints
+// on its required columns, but this lets generate functions check for the
+// constraints they depend on before using them.
+func (q QueryContext) RequireConstraints(columnNames ...string) error {
+	var missing []string
+	for _, name := range columnNames {
+		if !q.HasConstraint(name) {
+			missing = append(missing, name)
+		}
+	}
+	switch len(missing) {
+	case 0:
+		return nil
+	case 1:
+		return errors.Errorf("missing required constraint on column %s", missing[0])
+	default:
+		return errors.Errorf("missing required constraints on columns %s", strings.Join(missing, ", "))
+	}
+}
+
+// GetConstraintValues returns the expressions of all the constraints on the
+// given column that use the provided operator. For example, the values of an
+// OperatorEquals constraint on a column are the values that the query is
+// looking for. An empty slice is returned if there are no such constraints.
+func (q QueryContext) GetConstraintValues(columnName string, op Operator) []string {
+	values := []string{}
+	for _, constraint := range q.GetConstraints(columnName) {
+		if constraint.Operator == op {
+			values = append(values, constraint.Expression)
+		}
+	}
+	return values
 }
 
 // ConstraintList contains the details of the constraints for the given column.
@@ -349,12 +1490,61 @@ type ConstraintList struct {
 type Constraint struct {
 	Operator   Operator
 	Expression string
+	// Flags holds any bits of the operator code sent by osquery that were
+	// set in addition to a comparison operator. It is usually zero.
+	Flags ConstraintFlags
+}
+
+// IsUnique reports whether osquery marked the constraint as being on a unique
+// column, either with OperatorUnique on its own or as ConstraintFlagUnique
+// alongside a comparison operator.
+func (c Constraint) IsUnique() bool {
+	return c.Operator == OperatorUnique || c.Flags&ConstraintFlagUnique != 0
+}
+
+// ConstraintFlags are bits that osquery may set in an operator code alongside
+// one of the comparison operators.
+type ConstraintFlags int
+
+// ConstraintFlagUnique is set in addition to a comparison operator when the
+// constrained column is unique.
+const ConstraintFlagUnique = ConstraintFlags(OperatorUnique)
+
+// comparisonOperators are the operators which are distinct bits and so may be
+// combined with flags.
+var comparisonOperators = []Operator{
+	OperatorEquals,
+	OperatorGreaterThan,
+	OperatorLessThanOrEquals,
+	OperatorLessThan,
+	OperatorGreaterThanOrEquals,
+}
+
+// splitOperator separates an operator code sent by osquery into the operator
+// and any flag bits set alongside it. Known codes, including the MATCH family
+// which share the MATCH bit, are returned as they are. Otherwise if the code
+// contains a comparison operator bit, the remaining bits are returned as
+// flags.
+func splitOperator(code int) (Operator, ConstraintFlags) {
+	op := Operator(code)
+	if _, known := operatorNames[op]; known || op >= OperatorMatch {
+		return op, 0
+	}
+	for _, comparison := range comparisonOperators {
+		if op&comparison != 0 {
+			return comparison, ConstraintFlags(op &^ comparison)
+		}
+	}
+	return op, 0
 }
 
 // Operator is an enum of the osquery operators.
 type Operator int
 
-// The following operators are dfined in osquery tables.h.
+// The following operators are defined in osquery tables.h. Note that the
+// comparison operators are distinct bits, but MATCH, LIKE, GLOB and REGEXP all
+// share the MATCH bit (64) and are distinguished by the low bits, so operators
+// must be compared for equality rather than tested as a bitmask.
 const (
 	OperatorEquals              Operator = 2
 	OperatorGreaterThan         Operator = 4
@@ -368,10 +1558,34 @@ const (
 	OperatorUnique              Operator = 1
 )
 
+var operatorNames = map[Operator]string{
+	OperatorEquals:              "EQUALS",
+	OperatorGreaterThan:         "GREATER_THAN",
+	OperatorLessThanOrEquals:    "LESS_THAN_OR_EQUALS",
+	OperatorLessThan:            "LESS_THAN",
+	OperatorGreaterThanOrEquals: "GREATER_THAN_OR_EQUALS",
+	OperatorMatch:               "MATCH",
+	OperatorLike:                "LIKE",
+	OperatorGlob:                "GLOB",
+	OperatorRegexp:              "REGEXP",
+	OperatorUnique:              "UNIQUE",
+}
+
+// String returns the name of the operator, such as "EQUALS" or "LIKE", or
+// "UNKNOWN(n)" for operator codes that aren't defined above.
+func (o Operator) String() string {
+	if name, ok := operatorNames[o]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", int(o))
+}
+
 // The following types and functions exist for parsing of the queryContext
 // JSON and are not made public.
 type queryContextJSON struct {
 	Constraints []constraintListJSON `json:"constraints"`
+	ColsUsed    []string             `json:"colsUsed,omitempty"`
+	Distinct    bool                 `json:"distinct,omitempty"`
 }
 
 type constraintListJSON struct {
@@ -380,19 +1594,64 @@ type constraintListJSON struct {
 	List     json.RawMessage `json:"list"`
 }
 
+// JSONDecoder decodes JSON into a Go value in the same way as json.Unmarshal.
+// It allows a faster JSON library to be used for parsing query contexts.
+type JSONDecoder interface {
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// stdJSONDecoder is the default JSONDecoder, using encoding/json.
+type stdJSONDecoder struct{}
+
+func (stdJSONDecoder) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type constraintWarningsKey struct{}
+
+// ConstraintWarnings returns the reasons that constraints were skipped when
+// parsing the query context of a plugin created with SkipInvalidConstraints or
+// with UnknownColumnConstraints(SkipUnknownColumns).
+// It should be called with the context passed to the GenerateRows or
+// StreamRows function and returns nil if no constraints were skipped.
+func ConstraintWarnings(ctx context.Context) []error {
+	warnings, _ := ctx.Value(constraintWarningsKey{}).([]error)
+	return warnings
+}
+
 func parseQueryContext(ctxJSON string) (*QueryContext, error) {
+	ctx, _, err := parseQueryContextWarnings(stdJSONDecoder{}, ctxJSON, false)
+	return ctx, err
+}
+
+// parseQueryContextWarnings parses the query context using decoder. If
+// skipInvalid is set then constraints which can't be parsed are left out of
+// the context and the errors parsing them are returned as warnings.
+func parseQueryContextWarnings(decoder JSONDecoder, ctxJSON string, skipInvalid bool) (*QueryContext, []error, error) {
 	var parsed queryContextJSON
 
-	err := json.Unmarshal([]byte(ctxJSON), &parsed)
+	err := decoder.Unmarshal([]byte(ctxJSON), &parsed)
 	if err != nil {
-		return nil, errors.Wrap(err, "unmarshaling context JSON")
+		return nil, nil, errors.Wrap(err, "unmarshaling context JSON")
 	}
 
-	ctx := QueryContext{map[string]ConstraintList{}}
+	var warnings []error
+	ctx := QueryContext{
+		Constraints:     map[string]ConstraintList{},
+		SelectedColumns: parsed.ColsUsed,
+		Distinct:        parsed.Distinct,
+	}
 	for _, cList := range parsed.Constraints {
-		constraints, err := parseConstraintList(cList.List)
+		constraints, invalid, err := parseConstraints(decoder, cList.List, skipInvalid)
+		if err != nil && !skipInvalid {
+			return nil, nil, err
+		}
 		if err != nil {
-			return nil, err
+			warnings = append(warnings, errors.Wrapf(err, "column %s", cList.Name))
+			continue
+		}
+		for _, err := range invalid {
+			warnings = append(warnings, errors.Wrapf(err, "column %s", cList.Name))
 		}
 
 		ctx.Constraints[cList.Name] = ConstraintList{
@@ -401,49 +1660,103 @@ func parseQueryContext(ctxJSON string) (*QueryContext, error) {
 		}
 	}
 
-	return &ctx, nil
+	return &ctx, warnings, nil
+}
+
+// normalizeConstraints sorts the constraints by operator, expression and flags,
+// leaving out any which are identical to another.
+func normalizeConstraints(constraints []Constraint) []Constraint {
+	sorted := make([]Constraint, len(constraints))
+	copy(sorted, constraints)
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.Operator != b.Operator {
+			return a.Operator < b.Operator
+		}
+		if a.Expression != b.Expression {
+			return a.Expression < b.Expression
+		}
+		return a.Flags < b.Flags
+	})
+
+	normalized := sorted[:0]
+	for _, constraint := range sorted {
+		if len(normalized) > 0 && constraint == normalized[len(normalized)-1] {
+			continue
+		}
+		normalized = append(normalized, constraint)
+	}
+	return normalized
 }
 
 func parseConstraintList(constraints json.RawMessage) ([]Constraint, error) {
+	cl, _, err := parseConstraints(stdJSONDecoder{}, constraints, false)
+	return cl, err
+}
+
+// parseConstraints parses a list of constraints. If skipInvalid is set then
+// constraints which can't be parsed are skipped and their errors returned in
+// invalid, rather than failing the whole list.
+func parseConstraints(decoder JSONDecoder, constraints json.RawMessage, skipInvalid bool) (cl []Constraint, invalid []error, err error) {
+	// Columns without constraints have an empty string as the list in older
+	// versions of osquery, and an empty list or null in newer versions.
+	trimmed := bytes.TrimSpace(constraints)
+	if len(trimmed) == 0 || bytes.Equal(trimmed, []byte("null")) {
+		return []Constraint{}, nil, nil
+	}
 	var str string
-	err := json.Unmarshal(constraints, &str)
+	err = decoder.Unmarshal(constraints, &str)
 	if err == nil {
 		// string indicates empty list
-		return []Constraint{}, nil
+		return []Constraint{}, nil, nil
 	}
 
 	var cList []map[string]interface{}
-	err = json.Unmarshal(constraints, &cList)
+	err = decoder.Unmarshal(constraints, &cList)
 	if err != nil {
 		// cannot do anything with other types
-		return nil, errors.Errorf("unexpected context list: %s", string(constraints))
+		return nil, nil, errors.Errorf("unexpected context list: %s", string(constraints))
 	}
 
-	cl := []Constraint{}
+	cl = []Constraint{}
 	for _, c := range cList {
-		var op Operator
-		switch opVal := c["op"].(type) {
-		case string: // osquery < 3.0 with stringy types
-			opInt, err := strconv.Atoi(opVal)
-			if err != nil {
-				return nil, errors.Errorf("parsing operator int: %s", c["op"])
-			}
-			op = Operator(opInt)
-		case float64: // osquery > 3.0 with strong types
-			op = Operator(opVal)
-		default:
-			return nil, errors.Errorf("cannot parse type %T", opVal)
+		constraint, err := parseConstraint(c)
+		if err != nil && !skipInvalid {
+			return nil, nil, err
+		}
+		if err != nil {
+			invalid = append(invalid, err)
+			continue
 		}
+		cl = append(cl, constraint)
+	}
+	return cl, invalid, nil
+}
 
-		expr, ok := c["expr"].(string)
-		if !ok {
-			return nil, errors.Errorf("expr should be string: %s", c["expr"])
+func parseConstraint(c map[string]interface{}) (Constraint, error) {
+	var code int
+	switch opVal := c["op"].(type) {
+	case string: // osquery < 3.0 with stringy types
+		opInt, err := strconv.Atoi(opVal)
+		if err != nil {
+			return Constraint{}, errors.Errorf("parsing operator int: %s", c["op"])
 		}
+		code = opInt
+	case float64: // osquery > 3.0 with strong types
+		code = int(opVal)
+	default:
+		return Constraint{}, errors.Errorf("cannot parse type %T", opVal)
+	}
 
-		cl = append(cl, Constraint{
-			Operator:   op,
-			Expression: expr,
-		})
+	expr, ok := c["expr"].(string)
+	if !ok {
+		return Constraint{}, errors.Errorf("expr should be string: %s", c["expr"])
 	}
-	return cl, nil
+
+	op, flags := splitOperator(code)
+	return Constraint{
+		Operator:   op,
+		Expression: expr,
+		Flags:      flags,
+	}, nil
 }
@@ -1,11 +1,19 @@
 package table
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"math"
 	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/bradleyjkemp/osquery-go/gen/osquery"
 	"github.com/stretchr/testify/assert"
@@ -39,7 +47,7 @@ func TestTablePlugin(t *testing.T) {
 	require.NoError(t, err)
 
 	// Basic methods
-	assert.Equal(t, "table", plugin.RegistryName())
+	assert.Equal(t, Registry, plugin.RegistryName())
 	assert.Equal(t, "mock", plugin.Name())
 	assert.Equal(t, StatusOK, plugin.Ping(context.Background()))
 	assert.Equal(t, osquery.ExtensionPluginResponse{
@@ -61,7 +69,7 @@ func TestTablePlugin(t *testing.T) {
 
 	// Call with good action and context
 	resp, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
-	assert.Equal(t, QueryContext{map[string]ConstraintList{}}, calledQueryCtx)
+	assert.Equal(t, QueryContext{Constraints: map[string]ConstraintList{}}, calledQueryCtx)
 	assert.NoError(t, err)
 	assert.Equal(t, osquery.ExtensionPluginResponse{
 		{
@@ -73,37 +81,1540 @@ func TestTablePlugin(t *testing.T) {
 	}, resp)
 }
 
+func BenchmarkGenerateRows(b *testing.B) {
+	rows := make([]RowDefinition, 1000)
+	for i := range rows {
+		rows[i] = ExampleRow{
+			Text:    "hello world",
+			Integer: i,
+			BigInt:  big.NewInt(int64(i) * 1234567890),
+			Double:  float64(i) / 3,
+		}
+	}
+
+	plugin, err := NewPlugin(
+		"mock",
+		ExampleRow{},
+		GenerateRows(func(ctx context.Context, queryCtx QueryContext) ([]RowDefinition, error) {
+			return rows, nil
+		}))
+	require.NoError(b, err)
+
+	request := osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := plugin.Call(context.Background(), request); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+type BigIntRow struct {
+	A *big.Int `column:"a"`
+	B *big.Int `column:"b"`
+	C *big.Int `column:"c"`
+	D *big.Int `column:"d,unsigned"`
+}
+
+func BenchmarkGenerateBigIntRows(b *testing.B) {
+	large, _ := new(big.Int).SetString("18446744073709551615", 10)
+	rows := make([]RowDefinition, 1000)
+	for i := range rows {
+		rows[i] = BigIntRow{
+			A: big.NewInt(int64(i)),
+			B: big.NewInt(-int64(i) * 1234567890),
+			C: new(big.Int).Mul(large, big.NewInt(int64(i))),
+			D: large,
+		}
+	}
+
+	plugin, err := NewPlugin(
+		"mock",
+		BigIntRow{},
+		GenerateRows(func(ctx context.Context, queryCtx QueryContext) ([]RowDefinition, error) {
+			return rows, nil
+		}))
+	require.NoError(b, err)
+
+	request := osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := plugin.Call(context.Background(), request); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestBigIntColumns(t *testing.T) {
+	values := []string{"0", "1", "-1", "-9223372036854775808", "18446744073709551615", "-340282366920938463463374607431768211456"}
+	for _, value := range values {
+		expected, _ := new(big.Int).SetString(value, 10)
+		plugin, err := NewPlugin(
+			"mock",
+			BigIntRow{},
+			GenerateRows(func(ctx context.Context, queryCtx QueryContext) ([]RowDefinition, error) {
+				return []RowDefinition{BigIntRow{A: expected, B: expected, C: expected}}, nil
+			}))
+		require.NoError(t, err)
+
+		resp, err := plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+		require.NoError(t, err)
+		assert.Equal(t, osquery.ExtensionPluginResponse{
+			{"a": expected.String(), "b": expected.String(), "c": expected.String(), "d": ""},
+		}, resp)
+		assert.Equal(t, value, resp[0]["a"])
+	}
+}
+
 func TestTablePluginErrors(t *testing.T) {
 	var called bool
 	plugin, err := NewPlugin(
 		"mock",
-		ExampleRow{},
+		ExampleRow{},
+		GenerateRows(func(ctx context.Context, queryCtx QueryContext) ([]RowDefinition, error) {
+			called = true
+			return nil, errors.New("foobar")
+		},
+		))
+	require.NoError(t, err)
+
+	// Call with bad actions
+	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{})
+	assert.EqualError(t, err, "missing action in request to table mock")
+	assert.False(t, called)
+	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "bad"})
+	assert.EqualError(t, err, `unknown action "bad" requested from table mock`)
+	var unknownErr *UnknownActionError
+	require.True(t, errors.As(err, &unknownErr))
+	assert.Equal(t, "bad", unknownErr.Action)
+	assert.False(t, called)
+
+	// Call with good action but generate fails
+	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": "{[]}"})
+	assert.Error(t, err)
+	assert.False(t, called)
+
+	// Call with good action but generate fails
+	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	assert.True(t, called)
+	assert.Error(t, err)
+	assert.Equal(t, "error generating table: foobar", err.Error())
+
+	// Call with good action but generate returns the wrong row type
+	plugin, err = NewPlugin(
+		"mock",
+		ExampleRow{},
+		GenerateRows(func(ctx context.Context, queryCtx QueryContext) ([]RowDefinition, error) {
+			return []RowDefinition{ExampleRow{}, &ExampleRow{}}, nil
+		},
+		))
+	require.NoError(t, err)
+
+	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	assert.Error(t, err)
+	assert.Equal(t, "error generating table: row type *table.ExampleRow does not match declared schema table.ExampleRow", err.Error())
+
+	// Call with good action but stream emits the wrong row type
+	plugin, err = NewPlugin(
+		"mock",
+		ExampleRow{},
+		StreamRows(func(ctx context.Context, queryCtx QueryContext, emit func(RowDefinition) error) error {
+			return emit(TimeRow{})
+		},
+		))
+	require.NoError(t, err)
+
+	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	assert.Error(t, err)
+	assert.Equal(t, "error generating table: row type table.TimeRow does not match declared schema table.ExampleRow", err.Error())
+}
+
+func TestStreamRows(t *testing.T) {
+	var calledQueryCtx QueryContext
+	plugin, err := NewPlugin(
+		"mock",
+		ExampleRow{},
+		StreamRows(func(ctx context.Context, queryCtx QueryContext, emit func(RowDefinition) error) error {
+			calledQueryCtx = queryCtx
+			for i := 0; i < 3; i++ {
+				if err := emit(ExampleRow{Text: "row", Integer: i, BigInt: big.NewInt(int64(i))}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+	require.NoError(t, err)
+
+	resp, err := plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	assert.Equal(t, QueryContext{Constraints: map[string]ConstraintList{}}, calledQueryCtx)
+	assert.NoError(t, err)
+	assert.Equal(t, osquery.ExtensionPluginResponse{
+		{"text": "row", "integer": "0", "big_int": "0", "double": "0"},
+		{"text": "row", "integer": "1", "big_int": "1", "double": "0"},
+		{"text": "row", "integer": "2", "big_int": "2", "double": "0"},
+	}, resp)
+
+	// Errors from the stream function are returned
+	plugin, err = NewPlugin(
+		"mock",
+		ExampleRow{},
+		StreamRows(func(ctx context.Context, queryCtx QueryContext, emit func(RowDefinition) error) error {
+			return errors.New("foobar")
+		}))
+	require.NoError(t, err)
+
+	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	assert.Error(t, err)
+	assert.Equal(t, "error generating table: foobar", err.Error())
+}
+
+func TestStreamRowsConcurrentEmit(t *testing.T) {
+	var lateEmit func(RowDefinition) error
+	plugin, err := NewPlugin(
+		"mock",
+		ExampleRow{},
+		StreamRows(func(ctx context.Context, queryCtx QueryContext, emit func(RowDefinition) error) error {
+			lateEmit = emit
+			var wg sync.WaitGroup
+			errs := make(chan error, 10)
+			for worker := 0; worker < 10; worker++ {
+				wg.Add(1)
+				go func(worker int) {
+					defer wg.Done()
+					for i := 0; i < 100; i++ {
+						row := ExampleRow{Text: strconv.Itoa(worker), Integer: i, BigInt: big.NewInt(0)}
+						if err := emit(row); err != nil {
+							errs <- err
+							return
+						}
+					}
+				}(worker)
+			}
+			wg.Wait()
+			close(errs)
+			return <-errs
+		}))
+	require.NoError(t, err)
+
+	resp, err := plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	require.NoError(t, err)
+	assert.Len(t, resp, 1000)
+	seen := make(map[string]bool)
+	for _, row := range resp {
+		seen[row["text"]+"/"+row["integer"]] = true
+	}
+	assert.Len(t, seen, 1000)
+
+	// Rows emitted once the stream function has returned are rejected
+	assert.Equal(t, ErrEmitAfterReturn, lateEmit(ExampleRow{BigInt: big.NewInt(0)}))
+}
+
+func TestGenerateRowsChan(t *testing.T) {
+	plugin, err := NewPlugin(
+		"mock",
+		ExampleRow{},
+		GenerateRowsChan(func(ctx context.Context, queryCtx QueryContext) (<-chan RowDefinition, <-chan error) {
+			rows := make(chan RowDefinition)
+			go func() {
+				defer close(rows)
+				for i := 0; i < 3; i++ {
+					select {
+					case rows <- ExampleRow{Text: "row", Integer: i, BigInt: big.NewInt(int64(i))}:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}()
+			return rows, nil
+		}))
+	require.NoError(t, err)
+
+	resp, err := plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	assert.NoError(t, err)
+	assert.Equal(t, osquery.ExtensionPluginResponse{
+		{"text": "row", "integer": "0", "big_int": "0", "double": "0"},
+		{"text": "row", "integer": "1", "big_int": "1", "double": "0"},
+		{"text": "row", "integer": "2", "big_int": "2", "double": "0"},
+	}, resp)
+
+	// An error stops generation, and the producer is told to stop
+	stopped := make(chan struct{})
+	plugin, err = NewPlugin(
+		"mock",
+		ExampleRow{},
+		GenerateRowsChan(func(ctx context.Context, queryCtx QueryContext) (<-chan RowDefinition, <-chan error) {
+			rows := make(chan RowDefinition)
+			errs := make(chan error, 1)
+			go func() {
+				defer close(stopped)
+				rows <- ExampleRow{}
+				errs <- errors.New("foobar")
+				for {
+					select {
+					case rows <- ExampleRow{}:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}()
+			return rows, errs
+		}))
+	require.NoError(t, err)
+
+	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	assert.EqualError(t, err, "error generating table: foobar")
+	<-stopped
+
+	// An error sent before the rows channel is closed isn't missed
+	plugin, err = NewPlugin(
+		"mock",
+		ExampleRow{},
+		GenerateRowsChan(func(ctx context.Context, queryCtx QueryContext) (<-chan RowDefinition, <-chan error) {
+			rows := make(chan RowDefinition)
+			errs := make(chan error, 1)
+			errs <- errors.New("foobar")
+			close(rows)
+			return rows, errs
+		}))
+	require.NoError(t, err)
+
+	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	assert.EqualError(t, err, "error generating table: foobar")
+
+	// Cancelling the call stops generation
+	ctx, cancel := context.WithCancel(context.Background())
+	plugin, err = NewPlugin(
+		"mock",
+		ExampleRow{},
+		GenerateRowsChan(func(ctx context.Context, queryCtx QueryContext) (<-chan RowDefinition, <-chan error) {
+			cancel()
+			return make(chan RowDefinition), make(chan error)
+		}))
+	require.NoError(t, err)
+
+	_, err = plugin.Call(ctx, osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	assert.True(t, errors.Is(err, context.Canceled))
+}
+
+func TestPartialError(t *testing.T) {
+	plugin, err := NewPlugin(
+		"mock",
+		AliasRow{},
+		GenerateRows(func(ctx context.Context, queryCtx QueryContext) ([]RowDefinition, error) {
+			return []RowDefinition{AliasRow{Name: "foo", Size: 1}}, &PartialError{Err: errors.New("bar: permission denied")}
+		}))
+	require.NoError(t, err)
+
+	rows, err := Query(context.Background(), plugin, QueryContext{})
+	assert.Equal(t, []map[string]string{{"name": "foo", "size": "1"}}, rows)
+	assert.EqualError(t, err, "error generating table: bar: permission denied")
+	var partial *PartialError
+	require.True(t, errors.As(err, &partial))
+	assert.Equal(t, osquery.ExtensionStatus{Code: 0, Message: "bar: permission denied"}, partial.ExtensionStatus())
+
+	// Streamed rows are kept too
+	plugin, err = NewPlugin(
+		"mock",
+		AliasRow{},
+		StreamRows(func(ctx context.Context, queryCtx QueryContext, emit func(RowDefinition) error) error {
+			if err := emit(AliasRow{Name: "foo", Size: 1}); err != nil {
+				return err
+			}
+			return fmt.Errorf("listing bar: %w", &PartialError{Err: errors.New("permission denied")})
+		}))
+	require.NoError(t, err)
+
+	rows, err = Query(context.Background(), plugin, QueryContext{})
+	assert.Equal(t, []map[string]string{{"name": "foo", "size": "1"}}, rows)
+	assert.EqualError(t, err, "error generating table: listing bar: permission denied")
+
+	// Other errors still discard the rows
+	plugin, err = NewPlugin(
+		"mock",
+		AliasRow{},
+		GenerateRows(func(ctx context.Context, queryCtx QueryContext) ([]RowDefinition, error) {
+			return []RowDefinition{AliasRow{Name: "foo", Size: 1}}, errors.New("boom")
+		}))
+	require.NoError(t, err)
+
+	rows, err = Query(context.Background(), plugin, QueryContext{})
+	assert.Nil(t, rows)
+	assert.EqualError(t, err, "error generating table: boom")
+}
+
+func TestGenerateCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	plugin, err := NewPlugin(
+		"mock",
+		ExampleRow{},
+		GenerateRows(func(ctx context.Context, queryCtx QueryContext) ([]RowDefinition, error) {
+			cancel()
+			return []RowDefinition{ExampleRow{}}, nil
+		}))
+	require.NoError(t, err)
+
+	_, err = plugin.Call(ctx, osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	assert.True(t, errors.Is(err, context.Canceled))
+
+	ctx, cancel = context.WithCancel(context.Background())
+	var emitted int
+	plugin, err = NewPlugin(
+		"mock",
+		ExampleRow{},
+		StreamRows(func(ctx context.Context, queryCtx QueryContext, emit func(RowDefinition) error) error {
+			for {
+				if err := emit(ExampleRow{}); err != nil {
+					return err
+				}
+				emitted++
+				if emitted == 2 {
+					cancel()
+				}
+			}
+		}))
+	require.NoError(t, err)
+
+	_, err = plugin.Call(ctx, osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Equal(t, 2, emitted)
+}
+
+type OptionsRow struct {
+	PID     int    `column:"pid,index"`
+	Path    string `column:"path,required"`
+	Extra   string `column:"extra,additional,hidden"`
+	Default string `column:"default"`
+}
+
+func TestColumnOptions(t *testing.T) {
+	plugin, err := NewPlugin("mock", OptionsRow{})
+	require.NoError(t, err)
+
+	assert.Equal(t, []ColumnDefinition{
+		{Name: "pid", Type: ColumnTypeInteger, Options: ColumnOptionIndex},
+		{Name: "path", Type: ColumnTypeText, Options: ColumnOptionRequired},
+		{Name: "extra", Type: ColumnTypeText, Options: ColumnOptionAdditional | ColumnOptionHidden},
+		{Name: "default", Type: ColumnTypeText, Options: ColumnOptionDefault},
+	}, plugin.Columns())
+
+	resp, err := plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "columns"})
+	assert.NoError(t, err)
+	assert.Equal(t, osquery.ExtensionPluginResponse{
+		{"id": "column", "name": "pid", "type": "INTEGER", "op": "1"},
+		{"id": "column", "name": "path", "type": "TEXT", "op": "2"},
+		{"id": "column", "name": "extra", "type": "TEXT", "op": "20"},
+		{"id": "column", "name": "default", "type": "TEXT", "op": "0"},
+	}, resp)
+}
+
+type AliasRow struct {
+	Name string `column:"name,alias=old_name,alias=older_name"`
+	Size int    `column:"size"`
+}
+
+func TestColumnAliases(t *testing.T) {
+	var calledQueryCtx QueryContext
+	plugin, err := NewPlugin(
+		"mock",
+		AliasRow{},
+		GenerateRows(func(ctx context.Context, queryCtx QueryContext) ([]RowDefinition, error) {
+			calledQueryCtx = queryCtx
+			return []RowDefinition{AliasRow{Name: "foo", Size: 1}}, nil
+		}))
+	require.NoError(t, err)
+
+	assert.Equal(t, []ColumnDefinition{
+		{Name: "name", Type: ColumnTypeText, Aliases: []string{"old_name", "older_name"}},
+		{Name: "size", Type: ColumnTypeInteger},
+	}, plugin.Columns())
+	assert.Equal(t, osquery.ExtensionPluginResponse{
+		{"id": "column", "name": "name", "type": "TEXT", "op": "0"},
+		{"id": "column", "name": "size", "type": "INTEGER", "op": "0"},
+		{"id": "columnAlias", "name": "old_name", "target": "name"},
+		{"id": "columnAlias", "name": "older_name", "target": "name"},
+	}, plugin.Routes())
+
+	// Constraints on the aliases are passed to the table on the canonical column
+	_, err = Query(context.Background(), plugin, QueryContext{Constraints: map[string]ConstraintList{
+		"name":     {ColumnTypeText, []Constraint{{Operator: OperatorLike, Expression: "f%"}}},
+		"old_name": {ColumnTypeText, []Constraint{{Operator: OperatorEquals, Expression: "foo"}}},
+		"size":     {ColumnTypeInteger, []Constraint{{Operator: OperatorGreaterThan, Expression: "0"}}},
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, QueryContext{Constraints: map[string]ConstraintList{
+		"name": {ColumnTypeText, []Constraint{{Operator: OperatorLike, Expression: "f%"}, {Operator: OperatorEquals, Expression: "foo"}}},
+		"size": {ColumnTypeInteger, []Constraint{{Operator: OperatorGreaterThan, Expression: "0"}}},
+	}}, calledQueryCtx)
+
+	_, err = Query(context.Background(), plugin, QueryContext{Constraints: map[string]ConstraintList{
+		"older_name": {ColumnTypeText, []Constraint{{Operator: OperatorEquals, Expression: "foo"}}},
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, QueryContext{Constraints: map[string]ConstraintList{
+		"name": {ColumnTypeText, []Constraint{{Operator: OperatorEquals, Expression: "foo"}}},
+	}}, calledQueryCtx)
+
+	_, err = NewPlugin("mock", struct {
+		Name    string `column:"name"`
+		NewName string `column:"new_name,alias=name"`
+	}{})
+	assert.EqualError(t, err, "field NewName: duplicate column name")
+}
+
+func TestSelectedColumns(t *testing.T) {
+	var calledQueryCtx QueryContext
+	plugin, err := NewPlugin(
+		"mock",
+		AliasRow{},
+		GenerateRows(func(ctx context.Context, queryCtx QueryContext) ([]RowDefinition, error) {
+			calledQueryCtx = queryCtx
+			row := AliasRow{Name: "foo"}
+			if queryCtx.IsColumnSelected("size") {
+				row.Size = 1
+			}
+			return []RowDefinition{row}, nil
+		}))
+	require.NoError(t, err)
+
+	resp, err := plugin.Call(context.Background(), osquery.ExtensionPluginRequest{
+		"action":  "generate",
+		"context": `{"colsUsed":["name","old_name"],"colsUsedBitset":1,"constraints":[]}`,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, osquery.ExtensionPluginResponse{{"name": "foo", "size": "0"}}, resp)
+	assert.Equal(t, []string{"name"}, calledQueryCtx.SelectedColumns)
+	assert.False(t, calledQueryCtx.IsColumnSelected("size"))
+
+	// Without colsUsed, all columns are selected
+	rows, err := Query(context.Background(), plugin, QueryContext{})
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]string{{"name": "foo", "size": "1"}}, rows)
+	assert.Empty(t, calledQueryCtx.SelectedColumns)
+	assert.True(t, calledQueryCtx.IsColumnSelected("size"))
+
+	_, err = Query(context.Background(), plugin, QueryContext{SelectedColumns: []string{"size", "older_name"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"size", "name"}, calledQueryCtx.SelectedColumns)
+}
+
+func TestDistinct(t *testing.T) {
+	var calledQueryCtx QueryContext
+	plugin, err := NewPlugin(
+		"mock",
+		ValueRow{},
+		GenerateRows(func(ctx context.Context, queryCtx QueryContext) ([]RowDefinition, error) {
+			calledQueryCtx = queryCtx
+			if queryCtx.Distinct {
+				return []RowDefinition{ValueRow{Value: "a"}}, nil
+			}
+			return []RowDefinition{ValueRow{Value: "a"}, ValueRow{Value: "a"}}, nil
+		}))
+	require.NoError(t, err)
+
+	resp, err := plugin.Call(context.Background(), osquery.ExtensionPluginRequest{
+		"action":  "generate",
+		"context": `{"colsUsed":["value"],"distinct":true,"constraints":[]}`,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, osquery.ExtensionPluginResponse{{"value": "a"}}, resp)
+	assert.True(t, calledQueryCtx.Distinct)
+
+	// osquery doesn't send the flag, so it is usually unset
+	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{
+		"action":  "generate",
+		"context": `{"colsUsed":["value"],"constraints":[]}`,
+	})
+	require.NoError(t, err)
+	assert.False(t, calledQueryCtx.Distinct)
+
+	rows, err := Query(context.Background(), plugin, QueryContext{Distinct: true})
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]string{{"value": "a"}}, rows)
+	assert.True(t, calledQueryCtx.Distinct)
+}
+
+type ValueRow struct {
+	Value string `column:"value"`
+}
+
+func TestMaxResponseSize(t *testing.T) {
+	rows := []RowDefinition{ValueRow{"aaaaa"}, ValueRow{"bbbbb"}, ValueRow{"ccccc"}}
+	request := osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"}
+
+	// Each row is 24 bytes, and the list of rows adds 5
+	generate := GenerateRows(func(ctx context.Context, queryCtx QueryContext) ([]RowDefinition, error) {
+		return rows, nil
+	})
+	plugin, err := NewPlugin("mock", ValueRow{}, generate, MaxResponseSize(77))
+	require.NoError(t, err)
+	resp, err := plugin.Call(context.Background(), request)
+	require.NoError(t, err)
+	assert.Len(t, resp, 3)
+
+	plugin, err = NewPlugin("mock", ValueRow{}, generate, MaxResponseSize(76))
+	require.NoError(t, err)
+	resp, err = plugin.Call(context.Background(), request)
+	assert.EqualError(t, err, "error generating table: response exceeds 76 bytes, consider adding constraints to the query")
+	assert.Nil(t, resp)
+
+	// Streaming stops as soon as the limit is exceeded
+	emitted := 0
+	stream := StreamRows(func(ctx context.Context, queryCtx QueryContext, emit func(RowDefinition) error) error {
+		for _, row := range rows {
+			if err := emit(row); err != nil {
+				return err
+			}
+			emitted++
+		}
+		return nil
+	})
+	plugin, err = NewPlugin("mock", ValueRow{}, stream, MaxResponseSize(60))
+	require.NoError(t, err)
+	resp, err = plugin.Call(context.Background(), request)
+	assert.EqualError(t, err, "error generating table: response exceeds 60 bytes, consider adding constraints to the query")
+	assert.Nil(t, resp)
+	assert.Equal(t, 2, emitted)
+
+	plugin, err = NewPlugin("mock", ValueRow{}, stream, MaxResponseSize(77))
+	require.NoError(t, err)
+	resp, err = plugin.Call(context.Background(), request)
+	require.NoError(t, err)
+	assert.Len(t, resp, 3)
+}
+
+func TestColumnsHandler(t *testing.T) {
+	request := osquery.ExtensionPluginRequest{"action": "columns"}
+
+	plugin, err := NewPlugin("mock", ExampleRow{})
+	require.NoError(t, err)
+	resp, err := plugin.Call(context.Background(), request)
+	require.NoError(t, err)
+	assert.Equal(t, plugin.Routes(), resp)
+
+	filtered := osquery.ExtensionPluginResponse{{"id": "column", "name": "text", "type": "TEXT", "op": "0"}}
+	var calledRequestID string
+	plugin, err = NewPlugin("mock", ExampleRow{}, WithColumnsHandler(func(ctx context.Context) osquery.ExtensionPluginResponse {
+		calledRequestID, _ = RequestIDFromContext(ctx)
+		return filtered
+	}))
+	require.NoError(t, err)
+	resp, err = plugin.Call(context.Background(), request)
+	require.NoError(t, err)
+	assert.Equal(t, filtered, resp)
+	assert.NotEmpty(t, calledRequestID)
+
+	// The declared columns are still registered with osquery
+	assert.Len(t, plugin.Routes(), 4)
+}
+
+func TestRawActionHandler(t *testing.T) {
+	var rawRequest osquery.ExtensionPluginRequest
+	raw := func(ctx context.Context, request osquery.ExtensionPluginRequest) (osquery.ExtensionPluginResponse, error) {
+		rawRequest = request
+		return osquery.ExtensionPluginResponse{{"result": request["argument"]}}, nil
+	}
+	failing := func(ctx context.Context, request osquery.ExtensionPluginRequest) (osquery.ExtensionPluginResponse, error) {
+		return nil, errors.New("boom")
+	}
+	generate := GenerateRows(func(ctx context.Context, queryCtx QueryContext) ([]RowDefinition, error) {
+		return []RowDefinition{ValueRow{"generated"}}, nil
+	})
+
+	plugin, err := NewPlugin("mock", ValueRow{}, generate,
+		WithRawActionHandler("custom", raw),
+		WithRawActionHandler("fail", failing),
+	)
+	require.NoError(t, err)
+
+	request := osquery.ExtensionPluginRequest{"action": "custom", "argument": "foo"}
+	resp, err := plugin.Call(context.Background(), request)
+	require.NoError(t, err)
+	assert.Equal(t, osquery.ExtensionPluginResponse{{"result": "foo"}}, resp)
+	assert.Equal(t, request, rawRequest)
+
+	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "fail"})
+	assert.EqualError(t, err, "boom")
+
+	// Other actions are handled as usual
+	resp, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	require.NoError(t, err)
+	assert.Equal(t, osquery.ExtensionPluginResponse{{"value": "generated"}}, resp)
+
+	// Built in actions can be replaced
+	plugin, err = NewPlugin("mock", ValueRow{}, generate, WithRawActionHandler("generate", raw))
+	require.NoError(t, err)
+	resp, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "argument": "bar"})
+	require.NoError(t, err)
+	assert.Equal(t, osquery.ExtensionPluginResponse{{"result": "bar"}}, resp)
+}
+
+func TestUnknownActionHandler(t *testing.T) {
+	var actions []string
+	plugin, err := NewPlugin("mock", ValueRow{},
+		GenerateRows(func(ctx context.Context, queryCtx QueryContext) ([]RowDefinition, error) {
+			return []RowDefinition{ValueRow{"generated"}}, nil
+		}),
+		WithRawActionHandler("custom", func(ctx context.Context, request osquery.ExtensionPluginRequest) (osquery.ExtensionPluginResponse, error) {
+			return osquery.ExtensionPluginResponse{{"handled": "custom"}}, nil
+		}),
+		WithUnknownActionHandler(func(ctx context.Context, request osquery.ExtensionPluginRequest) (osquery.ExtensionPluginResponse, error) {
+			actions = append(actions, request["action"])
+			return osquery.ExtensionPluginResponse{}, nil
+		}),
+	)
+	require.NoError(t, err)
+
+	resp, err := plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "delete", "id": "1"})
+	require.NoError(t, err)
+	assert.Equal(t, osquery.ExtensionPluginResponse{}, resp)
+	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{})
+	require.NoError(t, err)
+
+	// Known actions don't reach the fallback
+	resp, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "custom"})
+	require.NoError(t, err)
+	assert.Equal(t, osquery.ExtensionPluginResponse{{"handled": "custom"}}, resp)
+	resp, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	require.NoError(t, err)
+	assert.Equal(t, osquery.ExtensionPluginResponse{{"value": "generated"}}, resp)
+
+	assert.Equal(t, []string{"delete", ""}, actions)
+}
+
+func TestNewPluginDynamic(t *testing.T) {
+	columns := []ColumnDefinition{
+		{Name: "name"},
+		{Name: "size", Type: ColumnTypeBigInt, Aliases: []string{"bytes"}},
+	}
+	var calledQueryCtx QueryContext
+	plugin, err := NewPluginDynamic("dynamic", columns, func(ctx context.Context, queryCtx QueryContext) ([]map[string]string, error) {
+		calledQueryCtx = queryCtx
+		return []map[string]string{
+			{"name": "foo", "size": "10"},
+			{"name": "bar"},
+		}, nil
+	}, WithRowID("n"))
+	require.NoError(t, err)
+
+	assert.Equal(t, []ColumnDefinition{
+		{Name: "name", Type: ColumnTypeText},
+		{Name: "size", Type: ColumnTypeBigInt, Aliases: []string{"bytes"}},
+		{Name: "n", Type: ColumnTypeInteger},
+	}, plugin.Columns())
+
+	resp, err := plugin.Call(context.Background(), osquery.ExtensionPluginRequest{
+		"action":  "generate",
+		"context": `{"constraints":[{"name":"bytes","affinity":"BIGINT","list":[{"op":4,"expr":"5"}]}]}`,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, osquery.ExtensionPluginResponse{
+		{"name": "foo", "size": "10", "n": "1"},
+		{"name": "bar", "size": "", "n": "2"},
+	}, resp)
+	assert.Equal(t, []string{"5"}, calledQueryCtx.GetConstraintValues("size", OperatorGreaterThan))
+
+	// Rows with undeclared columns are rejected
+	plugin, err = NewPluginDynamic("dynamic", columns, func(ctx context.Context, queryCtx QueryContext) ([]map[string]string, error) {
+		return []map[string]string{{"other": "foo"}}, nil
+	})
+	require.NoError(t, err)
+	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	assert.EqualError(t, err, `error generating table: MapRow has unknown column "other"`)
+}
+
+func TestNewPluginDynamicErrors(t *testing.T) {
+	generate := func(ctx context.Context, queryCtx QueryContext) ([]map[string]string, error) {
+		return nil, nil
+	}
+	_, err := NewPluginDynamic("dynamic", []ColumnDefinition{{Name: ""}}, generate)
+	assert.EqualError(t, err, "column with empty name")
+	_, err = NewPluginDynamic("dynamic", []ColumnDefinition{{Name: "a"}, {Name: "A"}}, generate)
+	assert.EqualError(t, err, "duplicate column A")
+	_, err = NewPluginDynamic("dynamic", []ColumnDefinition{{Name: "a"}, {Name: "b", Aliases: []string{"a"}}}, generate)
+	assert.EqualError(t, err, "column b: duplicate column a")
+}
+
+func TestWithRegistry(t *testing.T) {
+	plugin, err := NewPlugin("mock", ExampleRow{}, WithRegistry("custom_table"))
+	require.NoError(t, err)
+	assert.Equal(t, "custom_table", plugin.RegistryName())
+	assert.Equal(t, "mock", plugin.Name())
+}
+
+func TestColumnLookup(t *testing.T) {
+	plugin, err := NewPlugin("mock", AliasRow{})
+	require.NoError(t, err)
+
+	col, ok := plugin.LookupColumn("size")
+	assert.True(t, ok)
+	assert.Equal(t, ColumnDefinition{Name: "size", Type: ColumnTypeInteger}, col)
+	col, ok = plugin.LookupColumn("Older_Name")
+	assert.True(t, ok)
+	assert.Equal(t, "name", col.Name)
+	_, ok = plugin.LookupColumn("missing")
+	assert.False(t, ok)
+
+	assert.Equal(t, "name", plugin.Column("name"))
+	assert.Equal(t, "name", plugin.Column("old_name"))
+	assert.Equal(t, "size", plugin.Column("SIZE"))
+	assert.PanicsWithValue(t, "table mock has no column nmae", func() { plugin.Column("nmae") })
+}
+
+func TestRowIDColumn(t *testing.T) {
+	plugin, err := NewPlugin(
+		"mock",
+		AliasRow{},
+		WithRowID("rowid"),
+		GenerateRows(func(ctx context.Context, queryCtx QueryContext) ([]RowDefinition, error) {
+			return []RowDefinition{AliasRow{Name: "foo", Size: 3}, AliasRow{Name: "bar", Size: 4}}, nil
+		}))
+	require.NoError(t, err)
+
+	assert.Equal(t, osquery.ExtensionPluginResponse{
+		{"id": "column", "name": "name", "type": "TEXT", "op": "0"},
+		{"id": "column", "name": "size", "type": "INTEGER", "op": "0"},
+		{"id": "column", "name": "rowid", "type": "INTEGER", "op": "0"},
+		{"id": "columnAlias", "name": "old_name", "target": "name"},
+		{"id": "columnAlias", "name": "older_name", "target": "name"},
+	}, plugin.Routes())
+
+	rows, err := Query(context.Background(), plugin, QueryContext{})
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]string{
+		{"name": "foo", "size": "3", "rowid": "1"},
+		{"name": "bar", "size": "4", "rowid": "2"},
+	}, rows)
+
+	// Streamed rows are numbered across calls to emit
+	plugin, err = NewPlugin(
+		"mock",
+		AliasRow{},
+		WithRowID("rowid"),
+		StreamRows(func(ctx context.Context, queryCtx QueryContext, emit func(RowDefinition) error) error {
+			for i := 0; i < 3; i++ {
+				if err := emit(AliasRow{Size: i}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+	require.NoError(t, err)
+
+	rows, err = Query(context.Background(), plugin, QueryContext{})
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]string{
+		{"name": "", "size": "0", "rowid": "1"},
+		{"name": "", "size": "1", "rowid": "2"},
+		{"name": "", "size": "2", "rowid": "3"},
+	}, rows)
+
+	_, err = NewPlugin("mock", AliasRow{}, WithRowID("Old_Name"))
+	assert.EqualError(t, err, "row ID column: duplicate column Old_Name")
+}
+
+func TestLazyColumn(t *testing.T) {
+	var hashed []string
+	hash := func(ctx context.Context, row RowDefinition) (string, error) {
+		name := row.(AliasRow).Name
+		if name == "" {
+			return "", errors.New("no name")
+		}
+		hashed = append(hashed, name)
+		return "hash of " + name, nil
+	}
+	rows := []RowDefinition{AliasRow{Name: "foo", Size: 3}, AliasRow{Name: "bar", Size: 4}}
+	plugin, err := NewPlugin(
+		"mock",
+		AliasRow{},
+		WithLazyColumn("hash", ColumnTypeText, hash),
+		GenerateRows(func(ctx context.Context, queryCtx QueryContext) ([]RowDefinition, error) {
+			return rows, nil
+		}))
+	require.NoError(t, err)
+
+	col, ok := plugin.LookupColumn("hash")
+	require.True(t, ok)
+	assert.Equal(t, ColumnTypeText, col.Type)
+
+	// The column is only computed when the query uses it
+	result, err := Query(context.Background(), plugin, QueryContext{SelectedColumns: []string{"name"}})
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]string{{"name": "foo", "size": "3"}, {"name": "bar", "size": "4"}}, result)
+	assert.Empty(t, hashed)
+
+	result, err = Query(context.Background(), plugin, QueryContext{SelectedColumns: []string{"name", "hash"}})
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]string{
+		{"name": "foo", "size": "3", "hash": "hash of foo"},
+		{"name": "bar", "size": "4", "hash": "hash of bar"},
+	}, result)
+	assert.Equal(t, []string{"foo", "bar"}, hashed)
+
+	hashed = nil
+	_, err = Query(context.Background(), plugin, QueryContext{
+		SelectedColumns: []string{"name"},
+		Constraints: map[string]ConstraintList{
+			"hash": {Affinity: ColumnTypeText, Constraints: []Constraint{{Operator: OperatorEquals, Expression: "hash of foo"}}},
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"foo", "bar"}, hashed)
+
+	// Without selected columns every column is computed, including for
+	// streamed rows
+	plugin, err = NewPlugin(
+		"mock",
+		AliasRow{},
+		WithLazyColumn("hash", "", hash),
+		StreamRows(func(ctx context.Context, queryCtx QueryContext, emit func(RowDefinition) error) error {
+			for _, row := range rows {
+				if err := emit(row); err != nil {
+					return err
+				}
+			}
+			return emit(AliasRow{})
+		}))
+	require.NoError(t, err)
+	_, err = Query(context.Background(), plugin, QueryContext{})
+	assert.EqualError(t, err, "error generating table: column hash: no name")
+
+	_, err = NewPlugin("mock", AliasRow{}, WithLazyColumn("older_name", ColumnTypeText, hash))
+	assert.EqualError(t, err, "lazy column: duplicate column older_name")
+}
+
+func TestStrictAffinity(t *testing.T) {
+	var called bool
+	plugin, err := NewPlugin(
+		"mock",
+		AliasRow{},
+		StrictAffinity(),
+		GenerateRows(func(ctx context.Context, queryCtx QueryContext) ([]RowDefinition, error) {
+			called = true
+			return nil, nil
+		}))
+	require.NoError(t, err)
+
+	generate := func(ctxJSON string) error {
+		called = false
+		_, err := plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": ctxJSON})
+		return err
+	}
+
+	assert.NoError(t, generate(`{"constraints":[{"name":"old_name","list":[{"op":2,"expr":"foo"}],"affinity":"TEXT"},{"name":"size","list":[],"affinity":"INTEGER"}]}`))
+	assert.True(t, called)
+
+	err = generate(`{"constraints":[{"name":"size","list":[{"op":2,"expr":"1"}],"affinity":"BIGINT"}]}`)
+	assert.EqualError(t, err, "error checking constraints: column size: constraint affinity BIGINT does not match declared type INTEGER")
+	assert.False(t, called)
+
+	err = generate(`{"constraints":[{"name":"removed","list":[],"affinity":"TEXT"}]}`)
+	assert.EqualError(t, err, "error checking constraints: constraint on undeclared column removed")
+
+	// Without strict mode the declared type is trusted
+	plugin, err = NewPlugin("mock", AliasRow{}, GenerateRows(func(ctx context.Context, queryCtx QueryContext) ([]RowDefinition, error) {
+		return nil, nil
+	}))
+	require.NoError(t, err)
+	assert.NoError(t, generate(`{"constraints":[{"name":"size","list":[{"op":2,"expr":"1"}],"affinity":"BIGINT"}]}`))
+}
+
+func TestUnknownColumnConstraints(t *testing.T) {
+	var calledQueryCtx QueryContext
+	var warnings []error
+	generate := func(ctx context.Context, queryCtx QueryContext) ([]RowDefinition, error) {
+		calledQueryCtx = queryCtx
+		warnings = ConstraintWarnings(ctx)
+		return nil, nil
+	}
+	ctxJSON := `{"constraints":[
+		{"name":"old_name","affinity":"TEXT","list":[{"op":2,"expr":"foo"}]},
+		{"name":"row","affinity":"INTEGER","list":[{"op":2,"expr":"1"}]},
+		{"name":"removed","affinity":"TEXT","list":[{"op":2,"expr":"bar"}]}
+	]}`
+	call := func(plugin *Plugin) error {
+		_, err := plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": ctxJSON})
+		return err
+	}
+
+	// By default the constraints are passed through
+	plugin, err := NewPlugin("mock", AliasRow{}, GenerateRows(generate), WithRowID("row"))
+	require.NoError(t, err)
+	require.NoError(t, call(plugin))
+	assert.True(t, calledQueryCtx.HasConstraint("removed"))
+	assert.Empty(t, warnings)
+
+	plugin, err = NewPlugin("mock", AliasRow{}, GenerateRows(generate), WithRowID("row"), UnknownColumnConstraints(SkipUnknownColumns))
+	require.NoError(t, err)
+	require.NoError(t, call(plugin))
+	assert.False(t, calledQueryCtx.HasConstraint("removed"))
+	assert.True(t, calledQueryCtx.HasConstraint("name"))
+	assert.True(t, calledQueryCtx.HasConstraint("row"))
+	require.Len(t, warnings, 1)
+	assert.EqualError(t, warnings[0], "skipped constraints on undeclared column removed")
+
+	calledQueryCtx = QueryContext{}
+	plugin, err = NewPlugin("mock", AliasRow{}, GenerateRows(generate), WithRowID("row"), UnknownColumnConstraints(RejectUnknownColumns))
+	require.NoError(t, err)
+	assert.EqualError(t, call(plugin), "error checking constraints: constraint on undeclared column removed")
+	assert.Nil(t, calledQueryCtx.Constraints)
+}
+
+type DescribedRow struct {
+	Path  string `column:"path,required,desc=Path of the file, relative to the root"`
+	Size  int    `column:"size,desc=Size in bytes"`
+	Notes string `column:"notes,desc=Free text, hidden"`
+	Plain string `column:"plain"`
+}
+
+func TestDescriptions(t *testing.T) {
+	plugin, err := NewPlugin("mock", DescribedRow{}, WithDescription("Files on disk"))
+	require.NoError(t, err)
+
+	assert.Equal(t, "Files on disk", plugin.Description())
+	assert.Equal(t, []ColumnDefinition{
+		{Name: "path", Type: ColumnTypeText, Options: ColumnOptionRequired, Description: "Path of the file, relative to the root"},
+		{Name: "size", Type: ColumnTypeInteger, Description: "Size in bytes"},
+		{Name: "notes", Type: ColumnTypeText, Description: "Free text, hidden"},
+		{Name: "plain", Type: ColumnTypeText},
+	}, plugin.Columns())
+
+	// Descriptions aren't sent to osquery
+	assert.Equal(t, osquery.ExtensionPluginResponse{
+		{"id": "column", "name": "path", "type": "TEXT", "op": "2"},
+		{"id": "column", "name": "size", "type": "INTEGER", "op": "0"},
+		{"id": "column", "name": "notes", "type": "TEXT", "op": "0"},
+		{"id": "column", "name": "plain", "type": "TEXT", "op": "0"},
+	}, plugin.Routes())
+
+	plugin, err = NewPlugin("mock", DescribedRow{})
+	require.NoError(t, err)
+	assert.Equal(t, "", plugin.Description())
+}
+
+type TimeRow struct {
+	Seconds time.Time `column:"seconds"`
+	Millis  time.Time `column:"millis,unixmilli"`
+	Nanos   time.Time `column:"nanos,unixnano"`
+	Unset   time.Time `column:"unset"`
+}
+
+func TestTimeColumns(t *testing.T) {
+	timestamp := time.Unix(1610894602, 123456789)
+	plugin, err := NewPlugin(
+		"mock",
+		TimeRow{},
+		GenerateRows(func(ctx context.Context, queryCtx QueryContext) ([]RowDefinition, error) {
+			return []RowDefinition{
+				TimeRow{
+					Seconds: timestamp,
+					Millis:  timestamp,
+					Nanos:   timestamp,
+				},
+			}, nil
+		}))
+	require.NoError(t, err)
+
+	assert.Equal(t, osquery.ExtensionPluginResponse{
+		{"id": "column", "name": "seconds", "type": "BIGINT", "op": "0"},
+		{"id": "column", "name": "millis", "type": "BIGINT", "op": "0"},
+		{"id": "column", "name": "nanos", "type": "BIGINT", "op": "0"},
+		{"id": "column", "name": "unset", "type": "BIGINT", "op": "0"},
+	}, plugin.Routes())
+
+	resp, err := plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	assert.NoError(t, err)
+	assert.Equal(t, osquery.ExtensionPluginResponse{
+		{
+			"seconds": "1610894602",
+			"millis":  "1610894602123",
+			"nanos":   "1610894602123456789",
+			"unset":   "",
+		},
+	}, resp)
+
+	row, err := parseRowValues(`[1610894602, 1610894602123, 1610894602123456789, ""]`, TimeRow{})
+	require.NoError(t, err)
+	assert.Equal(t, time.Unix(1610894602, 0), row.(TimeRow).Seconds)
+	assert.Equal(t, time.Unix(1610894602, 123000000), row.(TimeRow).Millis)
+	assert.Equal(t, timestamp, row.(TimeRow).Nanos)
+	assert.True(t, row.(TimeRow).Unset.IsZero())
+}
+
+func TestTimeColumnsOutsideNanosecondRange(t *testing.T) {
+	for _, timestamp := range []time.Time{
+		time.Date(1600, 1, 1, 0, 0, 0, 500000000, time.UTC),
+		time.Date(3000, 1, 1, 0, 0, 0, 500000000, time.UTC),
+	} {
+		t.Run(strconv.Itoa(timestamp.Year()), func(t *testing.T) {
+			millis := formatTime(timestamp, time.Millisecond)
+			assert.Equal(t, strconv.FormatInt(timestamp.Unix()*1000+500, 10), millis)
+
+			parsed, err := parseTime(millis, time.Millisecond)
+			require.NoError(t, err)
+			assert.True(t, timestamp.Equal(parsed), "got %v", parsed)
+		})
+	}
+}
+
+type BlobRow struct {
+	Hash []byte `column:"hash"`
+	Cert []byte `column:"cert"`
+}
+
+func TestBlobColumns(t *testing.T) {
+	plugin, err := NewPlugin(
+		"mock",
+		BlobRow{},
+		GenerateRows(func(ctx context.Context, queryCtx QueryContext) ([]RowDefinition, error) {
+			return []RowDefinition{
+				BlobRow{Hash: []byte{0xde, 0xad, 0xbe, 0xef}},
+			}, nil
+		}))
+	require.NoError(t, err)
+
+	assert.Equal(t, osquery.ExtensionPluginResponse{
+		{"id": "column", "name": "hash", "type": "BLOB", "op": "0"},
+		{"id": "column", "name": "cert", "type": "BLOB", "op": "0"},
+	}, plugin.Routes())
+
+	resp, err := plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	assert.NoError(t, err)
+	assert.Equal(t, osquery.ExtensionPluginResponse{
+		{
+			"hash": "\xde\xad\xbe\xef",
+			"cert": "",
+		},
+	}, resp)
+}
+
+type UnsignedRow struct {
+	Inode   uint64   `column:"inode"`
+	Counter *big.Int `column:"counter,unsigned"`
+}
+
+func TestUnsignedBigIntColumns(t *testing.T) {
+	counter, _ := big.NewInt(0).SetString("18446744073709551615", 10)
+	plugin, err := NewPlugin(
+		"mock",
+		UnsignedRow{},
+		GenerateRows(func(ctx context.Context, queryCtx QueryContext) ([]RowDefinition, error) {
+			return []RowDefinition{
+				UnsignedRow{
+					Inode:   18446744073709551615,
+					Counter: counter,
+				},
+			}, nil
+		}))
+	require.NoError(t, err)
+
+	resp, err := plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "columns"})
+	assert.NoError(t, err)
+	assert.Equal(t, osquery.ExtensionPluginResponse{
+		{"id": "column", "name": "inode", "type": "UNSIGNED_BIGINT", "op": "0"},
+		{"id": "column", "name": "counter", "type": "UNSIGNED_BIGINT", "op": "0"},
+	}, resp)
+
+	resp, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	assert.NoError(t, err)
+	assert.Equal(t, osquery.ExtensionPluginResponse{
+		{
+			"inode":   "18446744073709551615",
+			"counter": "18446744073709551615",
+		},
+	}, resp)
+}
+
+type AddressRow struct {
+	Address uintptr `column:"address"`
+	Bytes   *uint64 `column:"bytes"`
+	Small   uint16  `column:"small"`
+}
+
+func TestUnsignedColumnsKeepFullRange(t *testing.T) {
+	bytes := uint64(math.MaxUint64)
+	plugin, err := NewPlugin(
+		"mock",
+		AddressRow{},
+		GenerateRows(func(ctx context.Context, queryCtx QueryContext) ([]RowDefinition, error) {
+			return []RowDefinition{
+				AddressRow{Address: ^uintptr(0), Bytes: &bytes, Small: math.MaxUint16},
+			}, nil
+		}))
+	require.NoError(t, err)
+
+	assert.Equal(t, []ColumnDefinition{
+		{Name: "address", Type: ColumnTypeUnsignedBigInt},
+		{Name: "bytes", Type: ColumnTypeUnsignedBigInt},
+		{Name: "small", Type: ColumnTypeInteger},
+	}, plugin.Columns())
+
+	rows, err := Query(context.Background(), plugin, QueryContext{})
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]string{{
+		"address": strconv.FormatUint(uint64(^uintptr(0)), 10),
+		"bytes":   "18446744073709551615",
+		"small":   "65535",
+	}}, rows)
+
+	row, err := parseRowValues(`[4096, 18446744073709551615, 65535]`, AddressRow{})
+	require.NoError(t, err)
+	assert.Equal(t, uintptr(4096), row.(AddressRow).Address)
+	assert.Equal(t, uint64(math.MaxUint64), *row.(AddressRow).Bytes)
+}
+
+func TestMapRows(t *testing.T) {
+	plugin, err := NewPlugin(
+		"mock",
+		ExampleRow{},
+		GenerateRows(func(ctx context.Context, queryCtx QueryContext) ([]RowDefinition, error) {
+			return []RowDefinition{
+				MapRow{"text": "hi", "integer": "1"},
+				ExampleRow{Text: "struct", Integer: 2, BigInt: big.NewInt(3), Double: 4.5},
+				MapRow{"text": "all", "integer": "5", "big_int": "6", "double": "7.5"},
+			}, nil
+		}))
+	require.NoError(t, err)
+
+	resp, err := plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	assert.NoError(t, err)
+	assert.Equal(t, osquery.ExtensionPluginResponse{
+		{"text": "hi", "integer": "1", "big_int": "", "double": ""},
+		{"text": "struct", "integer": "2", "big_int": "3", "double": "4.5"},
+		{"text": "all", "integer": "5", "big_int": "6", "double": "7.5"},
+	}, resp)
+
+	plugin, err = NewPlugin(
+		"mock",
+		ExampleRow{},
+		GenerateRows(func(ctx context.Context, queryCtx QueryContext) ([]RowDefinition, error) {
+			return []RowDefinition{MapRow{"text": "hi", "missing": "1"}}, nil
+		}))
+	require.NoError(t, err)
+
+	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	assert.EqualError(t, err, `error generating table: MapRow has unknown column "missing"`)
+
+	// Keys are matched case insensitively, and may be aliases
+	var mapRows []RowDefinition
+	plugin, err = NewPlugin(
+		"mock",
+		AliasRow{},
+		GenerateRows(func(ctx context.Context, queryCtx QueryContext) ([]RowDefinition, error) {
+			return mapRows, nil
+		}))
+	require.NoError(t, err)
+
+	mapRows = []RowDefinition{
+		MapRow{"old_name": "foo", "size": "1"},
+		MapRow{"NAME": "bar", "Size": "2"},
+	}
+	resp, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	assert.NoError(t, err)
+	assert.Equal(t, osquery.ExtensionPluginResponse{
+		{"name": "foo", "size": "1"},
+		{"name": "bar", "size": "2"},
+	}, resp)
+
+	mapRows = []RowDefinition{MapRow{"name": "foo", "older_name": "bar"}}
+	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	assert.EqualError(t, err, `error generating table: MapRow has more than one value for column "name"`)
+}
+
+type CommonColumns struct {
+	Hostname    string    `column:"hostname"`
+	CollectedAt time.Time `column:"collected_at"`
+}
+
+type EmbeddingRow struct {
+	Name string `column:"name"`
+	CommonColumns
+	Size int `column:"size"`
+}
+
+type CollidingRow struct {
+	CommonColumns
+	Hostname string `column:"hostname"`
+}
+
+func TestEmbeddedColumns(t *testing.T) {
+	collected := time.Unix(1600000000, 0)
+	plugin, err := NewPlugin(
+		"mock",
+		EmbeddingRow{},
+		GenerateRows(func(ctx context.Context, queryCtx QueryContext) ([]RowDefinition, error) {
+			return []RowDefinition{
+				EmbeddingRow{
+					Name:          "foo",
+					CommonColumns: CommonColumns{Hostname: "host", CollectedAt: collected},
+					Size:          10,
+				},
+			}, nil
+		}))
+	require.NoError(t, err)
+
+	assert.Equal(t, osquery.ExtensionPluginResponse{
+		{"id": "column", "name": "name", "type": "TEXT", "op": "0"},
+		{"id": "column", "name": "hostname", "type": "TEXT", "op": "0"},
+		{"id": "column", "name": "collected_at", "type": "BIGINT", "op": "0"},
+		{"id": "column", "name": "size", "type": "INTEGER", "op": "0"},
+	}, plugin.Routes())
+
+	resp, err := plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	assert.NoError(t, err)
+	assert.Equal(t, osquery.ExtensionPluginResponse{
+		{"name": "foo", "hostname": "host", "collected_at": "1600000000", "size": "10"},
+	}, resp)
+
+	row, err := parseRowValues(`[null, null, 1600000000, 10]`, EmbeddingRow{})
+	require.NoError(t, err)
+	assert.Equal(t, collected.Unix(), row.(EmbeddingRow).CollectedAt.Unix())
+	assert.Equal(t, 10, row.(EmbeddingRow).Size)
+
+	_, err = NewPlugin("mock", CollidingRow{})
+	assert.EqualError(t, err, "field Hostname: duplicate column hostname")
+}
+
+func TestDuplicateColumns(t *testing.T) {
+	_, err := NewPlugin("mock", struct {
+		Path    string `column:"path"`
+		OldPath string `column:"path"`
+	}{})
+	assert.EqualError(t, err, "field OldPath: duplicate column path")
+
+	// SQLite column names are case insensitive
+	_, err = NewPlugin("mock", struct {
+		Name      string
+		LowerName string `column:"name"`
+	}{})
+	assert.EqualError(t, err, "field LowerName: duplicate column name")
+
+	_, err = NewPlugin("mock", struct {
+		Path string `column:"path"`
+		Dir  string `column:"dir,alias=PATH"`
+	}{})
+	assert.EqualError(t, err, "field Dir: duplicate column PATH")
+}
+
+type NumericRow struct {
+	Int8    int8    `column:"int8"`
+	Int16   int16   `column:"int16"`
+	Int32   int32   `column:"int32"`
+	Int64   int64   `column:"int64"`
+	Uint8   uint8   `column:"uint8"`
+	Uint16  uint16  `column:"uint16"`
+	Uint32  uint32  `column:"uint32"`
+	Uint    uint    `column:"uint"`
+	Float32 float32 `column:"float32"`
+}
+
+func TestNumericColumns(t *testing.T) {
+	plugin, err := NewPlugin(
+		"mock",
+		NumericRow{},
+		GenerateRows(func(ctx context.Context, queryCtx QueryContext) ([]RowDefinition, error) {
+			return []RowDefinition{
+				NumericRow{
+					Int8:    -128,
+					Int16:   -32768,
+					Int32:   -2147483648,
+					Int64:   -9223372036854775808,
+					Uint8:   255,
+					Uint16:  65535,
+					Uint32:  4294967295,
+					Uint:    42,
+					Float32: 0.1,
+				},
+			}, nil
+		}))
+	require.NoError(t, err)
+
+	assert.Equal(t, osquery.ExtensionPluginResponse{
+		{"id": "column", "name": "int8", "type": "INTEGER", "op": "0"},
+		{"id": "column", "name": "int16", "type": "INTEGER", "op": "0"},
+		{"id": "column", "name": "int32", "type": "INTEGER", "op": "0"},
+		{"id": "column", "name": "int64", "type": "BIGINT", "op": "0"},
+		{"id": "column", "name": "uint8", "type": "INTEGER", "op": "0"},
+		{"id": "column", "name": "uint16", "type": "INTEGER", "op": "0"},
+		{"id": "column", "name": "uint32", "type": "BIGINT", "op": "0"},
+		{"id": "column", "name": "uint", "type": "UNSIGNED_BIGINT", "op": "0"},
+		{"id": "column", "name": "float32", "type": "DOUBLE", "op": "0"},
+	}, plugin.Routes())
+
+	resp, err := plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	assert.NoError(t, err)
+	assert.Equal(t, osquery.ExtensionPluginResponse{
+		{
+			"int8":    "-128",
+			"int16":   "-32768",
+			"int32":   "-2147483648",
+			"int64":   "-9223372036854775808",
+			"uint8":   "255",
+			"uint16":  "65535",
+			"uint32":  "4294967295",
+			"uint":    "42",
+			"float32": "0.1",
+		},
+	}, resp)
+
+	row, err := parseRowValues(`[-128, -32768, -2147483648, -9223372036854775808, 255, 65535, 4294967295, 42, 0.1]`, NumericRow{})
+	require.NoError(t, err)
+	assert.Equal(t, NumericRow{
+		Int8:    -128,
+		Int16:   -32768,
+		Int32:   -2147483648,
+		Int64:   -9223372036854775808,
+		Uint8:   255,
+		Uint16:  65535,
+		Uint32:  4294967295,
+		Uint:    42,
+		Float32: 0.1,
+	}, row)
+
+	// Values which overflow the field are rejected
+	_, err = parseRowValues(`[128, 0, 0, 0, 0, 0, 0, 0, 0]`, NumericRow{})
+	assert.Error(t, err)
+	_, err = parseRowValues(`[0, 0, 0, 0, 256, 0, 0, 0, 0]`, NumericRow{})
+	assert.Error(t, err)
+}
+
+type FloatRow struct {
+	Ratio    float64  `column:"ratio"`
+	Optional *float64 `column:"optional"`
+	Raw      float32  `column:"raw,nonfinite"`
+}
+
+func TestNonFiniteFloats(t *testing.T) {
+	var rows []RowDefinition
+	plugin, err := NewPlugin(
+		"mock",
+		FloatRow{},
 		GenerateRows(func(ctx context.Context, queryCtx QueryContext) ([]RowDefinition, error) {
-			called = true
-			return nil, errors.New("foobar")
+			return rows, nil
+		}))
+	require.NoError(t, err)
+
+	inf := math.Inf(-1)
+	rows = []RowDefinition{
+		FloatRow{Ratio: math.NaN(), Optional: &inf, Raw: float32(math.Inf(1))},
+		FloatRow{Ratio: 1.5, Raw: float32(math.NaN())},
+	}
+	resp, err := plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	require.NoError(t, err)
+	assert.Equal(t, osquery.ExtensionPluginResponse{
+		{"ratio": "", "optional": "", "raw": "+Inf"},
+		{"ratio": "1.5", "optional": "", "raw": "NaN"},
+	}, resp)
+}
+
+type BoolRow struct {
+	Enabled  bool  `column:"enabled"`
+	Disabled bool  `column:"disabled"`
+	Present  *bool `column:"present"`
+	Unknown  *bool `column:"unknown"`
+}
+
+func TestBoolColumns(t *testing.T) {
+	present := true
+	plugin, err := NewPlugin(
+		"mock",
+		BoolRow{},
+		GenerateRows(func(ctx context.Context, queryCtx QueryContext) ([]RowDefinition, error) {
+			return []RowDefinition{
+				BoolRow{
+					Enabled: true,
+					Present: &present,
+				},
+			}, nil
+		}))
+	require.NoError(t, err)
+
+	assert.Equal(t, osquery.ExtensionPluginResponse{
+		{"id": "column", "name": "enabled", "type": "INTEGER", "op": "0"},
+		{"id": "column", "name": "disabled", "type": "INTEGER", "op": "0"},
+		{"id": "column", "name": "present", "type": "INTEGER", "op": "0"},
+		{"id": "column", "name": "unknown", "type": "INTEGER", "op": "0"},
+	}, plugin.Routes())
+
+	resp, err := plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	assert.NoError(t, err)
+	assert.Equal(t, osquery.ExtensionPluginResponse{
+		{
+			"enabled":  "1",
+			"disabled": "0",
+			"present":  "1",
+			"unknown":  "",
 		},
-		))
+	}, resp)
+
+	row, err := parseRowValues(`[1, 0, 0, null]`, BoolRow{})
 	require.NoError(t, err)
+	assert.True(t, row.(BoolRow).Enabled)
+	assert.False(t, row.(BoolRow).Disabled)
+	require.NotNil(t, row.(BoolRow).Present)
+	assert.False(t, *row.(BoolRow).Present)
+	assert.Nil(t, row.(BoolRow).Unknown)
+}
 
-	// Call with bad actions
-	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{})
-	assert.Error(t, err)
-	assert.False(t, called)
-	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "bad"})
-	assert.Error(t, err)
-	assert.False(t, called)
+type OptionalRow struct {
+	Text    *string  `column:"text"`
+	Integer *int     `column:"integer"`
+	BigInt  *big.Int `column:"big_int"`
+	Double  *float64 `column:"double"`
+}
 
-	// Call with good action but generate fails
-	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": "{[]}"})
-	assert.Error(t, err)
-	assert.False(t, called)
+func TestNilPointerColumns(t *testing.T) {
+	text, integer, double := "hello world", 123, 3.14159
+	plugin, err := NewPlugin(
+		"mock",
+		OptionalRow{},
+		GenerateRows(func(ctx context.Context, queryCtx QueryContext) ([]RowDefinition, error) {
+			return []RowDefinition{
+				OptionalRow{
+					Text:    &text,
+					Integer: &integer,
+					BigInt:  big.NewInt(-1234567890),
+					Double:  &double,
+				},
+				OptionalRow{},
+			}, nil
+		}))
+	require.NoError(t, err)
 
-	// Call with good action but generate fails
-	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
-	assert.True(t, called)
-	assert.Error(t, err)
-	assert.Equal(t, "error generating table: foobar", err.Error())
+	assert.Equal(t, osquery.ExtensionPluginResponse{
+		{"id": "column", "name": "text", "type": "TEXT", "op": "0"},
+		{"id": "column", "name": "integer", "type": "INTEGER", "op": "0"},
+		{"id": "column", "name": "big_int", "type": "BIGINT", "op": "0"},
+		{"id": "column", "name": "double", "type": "DOUBLE", "op": "0"},
+	}, plugin.Routes())
+
+	resp, err := plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	assert.NoError(t, err)
+	assert.Equal(t, osquery.ExtensionPluginResponse{
+		{
+			"text":    "hello world",
+			"integer": "123",
+			"big_int": "-1234567890",
+			"double":  "3.14159",
+		},
+		{
+			"text":    "",
+			"integer": "",
+			"big_int": "",
+			"double":  "",
+		},
+	}, resp)
 
+	row, err := parseRowValues(`[null, 123, null, 3.14159]`, OptionalRow{})
+	require.NoError(t, err)
+	assert.Nil(t, row.(OptionalRow).Text)
+	require.NotNil(t, row.(OptionalRow).Integer)
+	assert.Equal(t, 123, *row.(OptionalRow).Integer)
+	assert.Nil(t, row.(OptionalRow).BigInt)
+	require.NotNil(t, row.(OptionalRow).Double)
+	assert.Equal(t, 3.14159, *row.(OptionalRow).Double)
 }
 
 func TestParseConstraintList(t *testing.T) {
@@ -124,17 +1635,29 @@ func TestParseConstraintList(t *testing.T) {
 			json:        `""`,
 			constraints: []Constraint{},
 		},
+		{
+			json:        `null`,
+			constraints: []Constraint{},
+		},
+		{
+			json:        `[]`,
+			constraints: []Constraint{},
+		},
+		{
+			json:        ``,
+			constraints: []Constraint{},
+		},
 		{
 			json: `[{"op":"2","expr":"foo"}]`,
 			constraints: []Constraint{
-				Constraint{OperatorEquals, "foo"},
+				Constraint{Operator: OperatorEquals, Expression: "foo"},
 			},
 		},
 		{
 			json: `[{"op":"4","expr":"3"},{"op":"16","expr":"4"}]`,
 			constraints: []Constraint{
-				Constraint{OperatorGreaterThan, "3"},
-				Constraint{OperatorLessThan, "4"},
+				Constraint{Operator: OperatorGreaterThan, Expression: "3"},
+				Constraint{Operator: OperatorLessThan, Expression: "4"},
 			},
 		},
 	}
@@ -145,6 +1668,7 @@ func TestParseConstraintList(t *testing.T) {
 			if tt.shouldErr {
 				assert.NotNil(t, err)
 			} else {
+				assert.NoError(t, err)
 				assert.Equal(t, tt.constraints, constraints)
 			}
 		})
@@ -192,11 +1716,11 @@ func TestParseQueryContext(t *testing.T) {
     }
   ]
 }`,
-			context: QueryContext{map[string]ConstraintList{
+			context: QueryContext{Constraints: map[string]ConstraintList{
 				"big_int": ConstraintList{ColumnTypeBigInt, []Constraint{}},
 				"double":  ConstraintList{ColumnTypeDouble, []Constraint{}},
 				"integer": ConstraintList{ColumnTypeInteger, []Constraint{}},
-				"text":    ConstraintList{ColumnTypeText, []Constraint{{OperatorEquals, "foo"}}},
+				"text":    ConstraintList{ColumnTypeText, []Constraint{{Operator: OperatorEquals, Expression: "foo"}}},
 			}},
 		},
 		{
@@ -236,11 +1760,11 @@ func TestParseQueryContext(t *testing.T) {
   ]
 }
 `,
-			context: QueryContext{map[string]ConstraintList{
+			context: QueryContext{Constraints: map[string]ConstraintList{
 				"big_int": ConstraintList{ColumnTypeBigInt, []Constraint{}},
-				"double":  ConstraintList{ColumnTypeDouble, []Constraint{{OperatorGreaterThanOrEquals, "3.1"}}},
+				"double":  ConstraintList{ColumnTypeDouble, []Constraint{{Operator: OperatorGreaterThanOrEquals, Expression: "3.1"}}},
 				"integer": ConstraintList{ColumnTypeInteger, []Constraint{}},
-				"text":    ConstraintList{ColumnTypeText, []Constraint{{OperatorEquals, "foobar"}}},
+				"text":    ConstraintList{ColumnTypeText, []Constraint{{Operator: OperatorEquals, Expression: "foobar"}}},
 			}},
 		},
 	}
@@ -256,6 +1780,56 @@ func TestParseQueryContext(t *testing.T) {
 	}
 }
 
+func TestQueryContextAccessors(t *testing.T) {
+	queryContext := QueryContext{Constraints: map[string]ConstraintList{
+		"path": ConstraintList{ColumnTypeText, []Constraint{
+			{Operator: OperatorEquals, Expression: "/etc/hosts"},
+			{Operator: OperatorLike, Expression: "/etc/%"},
+			{Operator: OperatorEquals, Expression: "/etc/passwd"},
+		}},
+		"size": ConstraintList{ColumnTypeBigInt, []Constraint{}},
+	}}
+
+	assert.Equal(t, []Constraint{
+		{Operator: OperatorEquals, Expression: "/etc/hosts"},
+		{Operator: OperatorLike, Expression: "/etc/%"},
+		{Operator: OperatorEquals, Expression: "/etc/passwd"},
+	}, queryContext.GetConstraints("path"))
+	assert.Equal(t, []string{"/etc/hosts", "/etc/passwd"}, queryContext.GetConstraintValues("path", OperatorEquals))
+	assert.Equal(t, []string{"/etc/%"}, queryContext.GetConstraintValues("path", OperatorLike))
+	assert.Equal(t, []string{}, queryContext.GetConstraintValues("path", OperatorGreaterThan))
+
+	assert.Equal(t, []Constraint{}, queryContext.GetConstraints("size"))
+	assert.Equal(t, []Constraint{}, queryContext.GetConstraints("missing"))
+	assert.Equal(t, []string{}, queryContext.GetConstraintValues("missing", OperatorEquals))
+	assert.Equal(t, []Constraint{}, QueryContext{}.GetConstraints("missing"))
+
+	assert.True(t, queryContext.HasConstraint("path"))
+	assert.False(t, queryContext.HasConstraint("size"))
+	assert.False(t, queryContext.HasConstraint("missing"))
+	assert.False(t, QueryContext{}.HasConstraint("missing"))
+
+	assert.NoError(t, queryContext.RequireConstraints())
+	assert.NoError(t, queryContext.RequireConstraints("path"))
+	assert.EqualError(t, queryContext.RequireConstraints("path", "size"), "missing required constraint on column size")
+	assert.EqualError(t, queryContext.RequireConstraints("size", "path", "missing"), "missing required constraints on columns size, missing")
+}
+
+func TestConstraintIsUnique(t *testing.T) {
+	assert.True(t, Constraint{Operator: OperatorUnique}.IsUnique())
+	assert.True(t, Constraint{Operator: OperatorEquals, Flags: ConstraintFlagUnique}.IsUnique())
+	assert.False(t, Constraint{Operator: OperatorEquals}.IsUnique())
+	assert.False(t, Constraint{Operator: OperatorLike}.IsUnique())
+}
+
+func TestOperatorString(t *testing.T) {
+	assert.Equal(t, "EQUALS", OperatorEquals.String())
+	assert.Equal(t, "GREATER_THAN_OR_EQUALS", OperatorGreaterThanOrEquals.String())
+	assert.Equal(t, "LIKE", OperatorLike.String())
+	assert.Equal(t, "UNKNOWN(3)", Operator(3).String())
+	assert.Equal(t, "[{LESS_THAN 10 0}]", fmt.Sprint([]Constraint{{Operator: OperatorLessThan, Expression: "10"}}))
+}
+
 func TestParseVaryingQueryContexts(t *testing.T) {
 	var testCases = []struct {
 		json            string
@@ -272,6 +1846,17 @@ func TestParseVaryingQueryContexts(t *testing.T) {
 			},
 			false,
 		},
+		{ // Every encoding of an empty list, including null
+			`{"constraints":[{"name":"domain","list":"","affinity":"TEXT"},{"name":"email","list":[],"affinity":"TEXT"},{"name":"name","list":null,"affinity":"TEXT"}]}`,
+			&QueryContext{
+				Constraints: map[string]ConstraintList{
+					"domain": ConstraintList{Affinity: "TEXT", Constraints: []Constraint{}},
+					"email":  ConstraintList{Affinity: "TEXT", Constraints: []Constraint{}},
+					"name":   ConstraintList{Affinity: "TEXT", Constraints: []Constraint{}},
+				},
+			},
+			false,
+		},
 		{ // Strongly typed JSON from osquery version > 3
 			`{"constraints":[{"name":"domain","list":[{"op":2,"expr":"kolide.co"}],"affinity":"TEXT"},{"name":"email","list":[],"affinity":"TEXT"}]}`,
 			&QueryContext{
@@ -302,6 +1887,52 @@ func TestParseVaryingQueryContexts(t *testing.T) {
 			},
 			false,
 		},
+		{ // Pattern matching operators (stringy and strong)
+			`{"constraints":[{"name":"path","list":[{"op":"64","expr":"foo"},{"op":"66","expr":"/etc/*"},{"op":"67","expr":"^/etc/.*$"}],"affinity":"TEXT"},{"name":"query","list":[{"op":64,"expr":"bar"},{"op":66,"expr":"*.conf"},{"op":67,"expr":"\\.conf$"}],"affinity":"TEXT"}]}`,
+			&QueryContext{
+				Constraints: map[string]ConstraintList{
+					"path": ConstraintList{Affinity: "TEXT", Constraints: []Constraint{
+						Constraint{Operator: OperatorMatch, Expression: "foo"},
+						Constraint{Operator: OperatorGlob, Expression: "/etc/*"},
+						Constraint{Operator: OperatorRegexp, Expression: "^/etc/.*$"},
+					}},
+					"query": ConstraintList{Affinity: "TEXT", Constraints: []Constraint{
+						Constraint{Operator: OperatorMatch, Expression: "bar"},
+						Constraint{Operator: OperatorGlob, Expression: "*.conf"},
+						Constraint{Operator: OperatorRegexp, Expression: "\\.conf$"},
+					}},
+				},
+			},
+			false,
+		},
+
+		{ // Flags set alongside a comparison operator are split out
+			`{"constraints":[{"name":"pid","list":[{"op":3,"expr":"1"},{"op":"17","expr":"10"},{"op":65,"expr":"%foo"},{"op":68,"expr":"2"}],"affinity":"INTEGER"}]}`,
+			&QueryContext{
+				Constraints: map[string]ConstraintList{
+					"pid": ConstraintList{Affinity: "INTEGER", Constraints: []Constraint{
+						Constraint{Operator: OperatorEquals, Expression: "1", Flags: ConstraintFlagUnique},
+						Constraint{Operator: OperatorLessThan, Expression: "10", Flags: ConstraintFlagUnique},
+						Constraint{Operator: OperatorLike, Expression: "%foo"},
+						Constraint{Operator: Operator(68), Expression: "2"},
+					}},
+				},
+			},
+			false,
+		},
+
+		{ // The unique operator is sent on its own for unique columns
+			`{"constraints":[{"name":"pid","list":[{"op":1,"expr":""},{"op":"1","expr":"5"}],"affinity":"INTEGER"}]}`,
+			&QueryContext{
+				Constraints: map[string]ConstraintList{
+					"pid": ConstraintList{Affinity: "INTEGER", Constraints: []Constraint{
+						Constraint{Operator: OperatorUnique, Expression: ""},
+						Constraint{Operator: OperatorUnique, Expression: "5"},
+					}},
+				},
+			},
+			false,
+		},
 
 		// Error cases
 		{`{bad json}`, nil, true},
@@ -321,3 +1952,303 @@ func TestParseVaryingQueryContexts(t *testing.T) {
 		})
 	}
 }
+
+func TestNormalizeConstraints(t *testing.T) {
+	var calledQueryCtx QueryContext
+	generate := GenerateRows(func(ctx context.Context, queryCtx QueryContext) ([]RowDefinition, error) {
+		calledQueryCtx = queryCtx
+		return nil, nil
+	})
+	ctxJSON := `{"constraints":[
+		{"name":"size","list":[{"op":16,"expr":"10"},{"op":4,"expr":"1"},{"op":16,"expr":"10"},{"op":4,"expr":"1"}],"affinity":"INTEGER"},
+		{"name":"name","list":[{"op":2,"expr":"foo"},{"op":65,"expr":"b%"}],"affinity":"TEXT"},
+		{"name":"old_name","list":[{"op":2,"expr":"foo"},{"op":2,"expr":"bar"}],"affinity":"TEXT"}
+	]}`
+
+	plugin, err := NewPlugin("mock", AliasRow{}, generate, NormalizeConstraints())
+	require.NoError(t, err)
+	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": ctxJSON})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]ConstraintList{
+		"size": {ColumnTypeInteger, []Constraint{
+			{Operator: OperatorGreaterThan, Expression: "1"},
+			{Operator: OperatorLessThan, Expression: "10"},
+		}},
+		// Duplicates from the alias are collapsed too
+		"name": {ColumnTypeText, []Constraint{
+			{Operator: OperatorEquals, Expression: "bar"},
+			{Operator: OperatorEquals, Expression: "foo"},
+			{Operator: OperatorLike, Expression: "b%"},
+		}},
+	}, calledQueryCtx.Constraints)
+
+	// Without the option the constraints are passed as osquery sent them
+	plugin, err = NewPlugin("mock", AliasRow{}, generate)
+	require.NoError(t, err)
+	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": ctxJSON})
+	require.NoError(t, err)
+	assert.Len(t, calledQueryCtx.Constraints["size"].Constraints, 4)
+	assert.Len(t, calledQueryCtx.Constraints["name"].Constraints, 4)
+}
+
+func TestSkipInvalidConstraints(t *testing.T) {
+	var calledQueryCtx QueryContext
+	var warnings []error
+	generate := func(ctx context.Context, queryCtx QueryContext) ([]RowDefinition, error) {
+		calledQueryCtx = queryCtx
+		warnings = ConstraintWarnings(ctx)
+		return []RowDefinition{}, nil
+	}
+
+	ctxJSON := `{"constraints":[
+		{"name":"text","affinity":"TEXT","list":[{"op":2,"expr":"foo"},{"op":"bad","expr":"bar"}]},
+		{"name":"integer","affinity":"INTEGER","list":[{"op":4,"expr":1}]},
+		{"name":"double","affinity":"DOUBLE","list":{"op":2}},
+		{"name":"big_int","affinity":"BIGINT","list":[{"op":16,"expr":"10"}]}
+	]}`
+
+	// By default the whole query fails
+	plugin, err := NewPlugin("mock", ExampleRow{}, GenerateRows(generate))
+	require.NoError(t, err)
+	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": ctxJSON})
+	assert.EqualError(t, err, "error parsing context JSON: parsing operator int: bad")
+
+	plugin, err = NewPlugin("mock", ExampleRow{}, GenerateRows(generate), SkipInvalidConstraints())
+	require.NoError(t, err)
+	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": ctxJSON})
+	require.NoError(t, err)
+	assert.Equal(t, QueryContext{Constraints: map[string]ConstraintList{
+		"text":    {ColumnTypeText, []Constraint{{Operator: OperatorEquals, Expression: "foo"}}},
+		"integer": {ColumnTypeInteger, []Constraint{}},
+		"big_int": {ColumnTypeBigInt, []Constraint{{Operator: OperatorLessThan, Expression: "10"}}},
+	}}, calledQueryCtx)
+
+	var messages []string
+	for _, warning := range warnings {
+		messages = append(messages, warning.Error())
+	}
+	assert.Equal(t, []string{
+		"column text: parsing operator int: bad",
+		"column integer: expr should be string: %!s(float64=1)",
+		`column double: unexpected context list: {"op":2}`,
+	}, messages)
+
+	// No warnings are reported for valid contexts
+	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	require.NoError(t, err)
+	assert.Nil(t, warnings)
+}
+
+// quickStringDecoder is a JSONDecoder which rejects values that can't be
+// strings without going through encoding/json, which allocates an error for
+// every constraint list that isn't the legacy empty string.
+type quickStringDecoder struct {
+	calls int
+}
+
+func (d *quickStringDecoder) Unmarshal(data []byte, v interface{}) error {
+	d.calls++
+	if _, ok := v.(*string); ok && !bytes.HasPrefix(bytes.TrimSpace(data), []byte(`"`)) {
+		return errors.New("not a string")
+	}
+	return json.Unmarshal(data, v)
+}
+
+func TestWithJSONDecoder(t *testing.T) {
+	var calledQueryCtx QueryContext
+	generate := func(ctx context.Context, queryCtx QueryContext) ([]RowDefinition, error) {
+		calledQueryCtx = queryCtx
+		return []RowDefinition{}, nil
+	}
+
+	decoder := &quickStringDecoder{}
+	plugin, err := NewPlugin("mock", ExampleRow{}, GenerateRows(generate), WithJSONDecoder(decoder))
+	require.NoError(t, err)
+
+	ctxJSON := `{"constraints":[
+		{"name":"text","affinity":"TEXT","list":[{"op":2,"expr":"foo"}]},
+		{"name":"integer","affinity":"INTEGER","list":""}
+	]}`
+	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": ctxJSON})
+	require.NoError(t, err)
+	assert.Equal(t, QueryContext{Constraints: map[string]ConstraintList{
+		"text":    {ColumnTypeText, []Constraint{{Operator: OperatorEquals, Expression: "foo"}}},
+		"integer": {ColumnTypeInteger, []Constraint{}},
+	}}, calledQueryCtx)
+	// The context, both attempts at the text list and the integer list
+	assert.Equal(t, 4, decoder.calls)
+
+	// A nil decoder uses encoding/json
+	plugin, err = NewPlugin("mock", ExampleRow{}, GenerateRows(generate), WithJSONDecoder(nil))
+	require.NoError(t, err)
+	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": ctxJSON})
+	require.NoError(t, err)
+	assert.Len(t, calledQueryCtx.Constraints, 2)
+}
+
+// BenchmarkParseQueryContext compares parsing with encoding/json directly and
+// through quickStringDecoder. Both end up using encoding/json, so this only
+// measures the overhead of plugging in a decoder and the failed string decodes
+// quickStringDecoder skips, not a faster JSON implementation.
+func BenchmarkParseQueryContext(b *testing.B) {
+	var ctxJSON strings.Builder
+	ctxJSON.WriteString(`{"constraints":[`)
+	for i := 0; i < 50; i++ {
+		if i > 0 {
+			ctxJSON.WriteString(",")
+		}
+		fmt.Fprintf(&ctxJSON, `{"name":"column%d","affinity":"TEXT","list":[{"op":2,"expr":"value%d"},{"op":65,"expr":"%%%d%%"}]}`, i, i, i)
+	}
+	ctxJSON.WriteString(`]}`)
+
+	for _, bm := range []struct {
+		name    string
+		decoder JSONDecoder
+	}{
+		{"encoding/json", stdJSONDecoder{}},
+		{"quickStringDecoder", &quickStringDecoder{}},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := parseQueryContextWarnings(bm.decoder, ctxJSON.String(), false); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+type JSONRow struct {
+	Metadata map[string]string `column:"metadata,json"`
+	Tags     []string          `column:"tags,json=null"`
+	Nested   *CommonColumns    `column:"nested,json"`
+}
+
+func TestJSONColumns(t *testing.T) {
+	rows := []RowDefinition{
+		JSONRow{
+			Metadata: map[string]string{"b": "2", "a": "1"},
+			Tags:     []string{"x", "y"},
+			Nested:   &CommonColumns{Hostname: "host", CollectedAt: time.Unix(0, 0).UTC()},
+		},
+		JSONRow{},
+	}
+	plugin, err := NewPlugin(
+		"mock",
+		JSONRow{},
+		GenerateRows(func(ctx context.Context, queryCtx QueryContext) ([]RowDefinition, error) {
+			return rows, nil
+		}))
+	require.NoError(t, err)
+
+	assert.Equal(t, osquery.ExtensionPluginResponse{
+		{"id": "column", "name": "metadata", "type": "TEXT", "op": "0"},
+		{"id": "column", "name": "tags", "type": "TEXT", "op": "0"},
+		{"id": "column", "name": "nested", "type": "TEXT", "op": "0"},
+	}, plugin.Routes())
+
+	resp, err := plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	assert.NoError(t, err)
+	assert.Equal(t, osquery.ExtensionPluginResponse{
+		{
+			"metadata": `{"a":"1","b":"2"}`,
+			"tags":     `["x","y"]`,
+			"nested":   `{"Hostname":"host","CollectedAt":"1970-01-01T00:00:00Z"}`,
+		},
+		{"metadata": "", "tags": "null", "nested": ""},
+	}, resp)
+
+	row, err := parseRowValues(`["{\"a\":\"1\"}", "[\"x\"]", null]`, JSONRow{})
+	require.NoError(t, err)
+	assert.Equal(t, JSONRow{Metadata: map[string]string{"a": "1"}, Tags: []string{"x"}}, row)
+
+	_, err = parseRowValues(`["{", "[]", null]`, JSONRow{})
+	assert.Error(t, err)
+}
+
+type BadJSONRow struct {
+	Value interface{} `column:"value,json"`
+}
+
+func TestJSONColumnErrors(t *testing.T) {
+	plugin, err := NewPlugin(
+		"mock",
+		BadJSONRow{},
+		GenerateRows(func(ctx context.Context, queryCtx QueryContext) ([]RowDefinition, error) {
+			return []RowDefinition{BadJSONRow{Value: make(chan int)}}, nil
+		}))
+	require.NoError(t, err)
+
+	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	assert.EqualError(t, err, "error generating table: column value: json: unsupported type: chan int")
+}
+
+type Protocol int
+
+func (p Protocol) MarshalCell() (string, error) {
+	switch p {
+	case 6:
+		return "6", nil
+	case 17:
+		return "17", nil
+	default:
+		return "", fmt.Errorf("unknown protocol %d", int(p))
+	}
+}
+
+type Address struct {
+	IP net.IP
+}
+
+func (a *Address) MarshalCell() (string, error) {
+	return a.IP.String(), nil
+}
+
+type MarshalerRow struct {
+	Protocol Protocol `column:"protocol,type=integer"`
+	Address  Address  `column:"address"`
+	Remote   *Address `column:"remote"`
+}
+
+func TestCellMarshalerColumns(t *testing.T) {
+	var rows []RowDefinition
+	plugin, err := NewPlugin(
+		"mock",
+		MarshalerRow{},
+		GenerateRows(func(ctx context.Context, queryCtx QueryContext) ([]RowDefinition, error) {
+			return rows, nil
+		}))
+	require.NoError(t, err)
+
+	assert.Equal(t, osquery.ExtensionPluginResponse{
+		{"id": "column", "name": "protocol", "type": "INTEGER", "op": "0"},
+		{"id": "column", "name": "address", "type": "TEXT", "op": "0"},
+		{"id": "column", "name": "remote", "type": "TEXT", "op": "0"},
+	}, plugin.Routes())
+
+	rows = []RowDefinition{
+		MarshalerRow{Protocol: 6, Address: Address{net.IPv4(10, 0, 0, 1)}, Remote: &Address{net.IPv6loopback}},
+		MarshalerRow{Protocol: 17, Address: Address{net.IPv4(10, 0, 0, 2)}},
+	}
+	resp, err := plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	require.NoError(t, err)
+	assert.Equal(t, osquery.ExtensionPluginResponse{
+		{"protocol": "6", "address": "10.0.0.1", "remote": "::1"},
+		{"protocol": "17", "address": "10.0.0.2", "remote": ""},
+	}, resp)
+
+	rows = []RowDefinition{MarshalerRow{Protocol: 1}}
+	_, err = plugin.Call(context.Background(), osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	assert.EqualError(t, err, "error generating table: column protocol: unknown protocol 1")
+
+	_, err = NewPlugin("mock", struct {
+		Protocol Protocol `column:"protocol,type=number"`
+	}{})
+	assert.EqualError(t, err, "field Protocol has unknown column type number")
+
+	_, err = NewPlugin("mock", struct {
+		Port int `column:"port,type=TEXT"`
+	}{})
+	assert.EqualError(t, err, "field Port: the type option is only supported for CellMarshaler fields")
+}
@@ -2,13 +2,20 @@ package osquery
 
 import (
 	"context"
+	stderrors "errors"
 	"fmt"
+	"os"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/apache/thrift/lib/go/thrift"
 
 	"github.com/bradleyjkemp/osquery-go/gen/osquery"
+	"github.com/bradleyjkemp/osquery-go/logging"
+	"github.com/bradleyjkemp/osquery-go/plugin/table"
 	"github.com/bradleyjkemp/osquery-go/transport"
 	"github.com/pkg/errors"
 )
@@ -18,7 +25,8 @@ type OsqueryPlugin interface {
 	// table the plugin implements).
 	Name() string
 	// RegistryName is which "registry" the plugin should be added to.
-	// Valid names are ["config", "logger", "table"].
+	// Valid names are ["config", "distributed", "logger", "table"], plus
+	// any added with ServerRegistries.
 	RegistryName() string
 	// Routes returns the detailed information about the interface exposed
 	// by the plugin. See the example plugins for samples.
@@ -29,12 +37,30 @@ type OsqueryPlugin interface {
 	// Call requests the plugin to perform its defined behavior, returning
 	// a response containing the result.
 	Call(context.Context, osquery.ExtensionPluginRequest) (osquery.ExtensionPluginResponse, error)
-	// Shutdown alerts the plugin to stop.
+	// Shutdown alerts the plugin to stop. It is called when the extension
+	// manager shuts down and may be called more than once.
 	Shutdown()
 }
 
 const defaultTimeout = 1 * time.Second
 const defaultPingInterval = 5 * time.Second
+const defaultLivenessTimeout = 10 * time.Second
+
+// serverVersioner is implemented by clients which can report the version of
+// osquery they are connected to, such as ExtensionManagerClient.
+type serverVersioner interface {
+	ServerVersion(ctx context.Context) (string, error)
+}
+
+type serverVersionKey struct{}
+
+// ServerVersionFromContext returns the version of the osquery process that
+// made a plugin call, as reported when the extension registered. It can be
+// called with the context passed to OsqueryPlugin.Call.
+func ServerVersionFromContext(ctx context.Context) (string, bool) {
+	version, ok := ctx.Value(serverVersionKey{}).(string)
+	return version, ok
+}
 
 // ExtensionManagerServer is an implementation of the full ExtensionManager
 // API. Plugins can register with an extension manager, which handles the
@@ -47,13 +73,52 @@ type ExtensionManagerServer struct {
 	server       thrift.TServer
 	transport    thrift.TServerTransport
 	timeout      time.Duration
-	lastPing     time.Time
-	mutex        sync.Mutex
+	pingInterval time.Duration
+	// lastRequest holds the time.Time when osquery last pinged or called
+	// the extension. It is updated on every request, so is kept out of the
+	// mutex.
+	lastRequest atomic.Value
+	// mutex guards the registry and server state. Plugin calls only take
+	// the read lock, so they can run concurrently with each other.
+	mutex        sync.RWMutex
 	started      bool // Used to ensure tests wait until the server is actually started
+	shuttingDown bool
+	inFlight     sync.WaitGroup
+	callObserver CallObserver
+	listenOpts   []transport.ListenOption
+	kind         transport.Kind
+	errorHandler ErrorHandler
+	callTimeout  time.Duration
+	version      string // Version of the osquery process, if known
+	uuid         osquery.ExtensionRouteUUID
+	listenPath   string // Path the extension listens on once registered
+	middleware   []Middleware
+	logger       logging.Logger
+	// livenessTimeout is how long to wait for a request from osquery
+	// before Run assumes it has gone away.
+	livenessTimeout time.Duration
+	// registrationRetry is how long to keep retrying connecting to osquery
+	// and registering the extension for.
+	registrationRetry time.Duration
+	// stopped is closed by Shutdown to stop any registration retries.
+	stopped chan struct{}
+	// responseObserver is notified of the size of generate responses.
+	responseObserver ResponseObserver
+	// clientTransport and listenTransport replace the sockets used to
+	// communicate with osquery, if set.
+	clientTransport thrift.TTransport
+	listenTransport thrift.TServerTransport
+	// baseContext holds values shared by every plugin call, if set.
+	baseContext context.Context
+	// readTimeout and writeTimeout bound each read and write on the
+	// connections osquery makes to the extension, if set.
+	readTimeout  time.Duration
+	writeTimeout time.Duration
 }
 
-// validRegistryNames contains the allowable RegistryName() values. If a plugin
-// attempts to register with another value, the program will panic.
+// validRegistryNames contains the RegistryName() values that every server
+// allows. If a plugin attempts to register with another value that hasn't been
+// added with ServerRegistries, RegisterPlugin returns an error.
 var validRegistryNames = map[string]bool{
 	"table":       true,
 	"logger":      true,
@@ -69,11 +134,324 @@ func ServerTimeout(timeout time.Duration) ServerOption {
 	}
 }
 
+// ServerPingInterval sets how often the server checks that osquery is still
+// alive, by pinging it and checking the liveness timeout. The default is 5
+// seconds.
+func ServerPingInterval(interval time.Duration) ServerOption {
+	return func(s *ExtensionManagerServer) {
+		s.pingInterval = interval
+	}
+}
+
+// ServerLivenessTimeout sets how long the server waits for a request from
+// osquery, including its periodic pings, before assuming that osquery has gone
+// away. Run then shuts down the server and returns. The default is 10 seconds,
+// and a timeout of 0 disables the check. The timeout is never shorter than
+// twice the ping interval, as osquery pings extensions at a similar interval.
+func ServerLivenessTimeout(timeout time.Duration) ServerOption {
+	return func(s *ExtensionManagerServer) {
+		s.livenessTimeout = timeout
+	}
+}
+
+// ServerCallTimeout sets a deadline on the context passed to every plugin call,
+// so that plugins which honour the context can't block osquery indefinitely.
+// By default there is no deadline.
+func ServerCallTimeout(timeout time.Duration) ServerOption {
+	return func(s *ExtensionManagerServer) {
+		s.callTimeout = timeout
+	}
+}
+
+// ServerReadTimeout sets how long the server waits for each read from a
+// connection made by osquery, including while waiting for the next request on
+// an idle connection. A connection which times out is closed and reported to
+// the ErrorHandler, so that a slow or stuck client can't hold it open forever.
+// By default reads never time out, other than over transport.TCP where reads
+// and writes are bounded by the ServerTimeout.
+func ServerReadTimeout(timeout time.Duration) ServerOption {
+	return func(s *ExtensionManagerServer) {
+		s.readTimeout = timeout
+	}
+}
+
+// ServerWriteTimeout sets how long the server waits for each write of a
+// response to a connection made by osquery. As for ServerReadTimeout, a
+// connection which times out is closed and reported to the ErrorHandler. By
+// default writes are bounded in the same way as reads.
+func ServerWriteTimeout(timeout time.Duration) ServerOption {
+	return func(s *ExtensionManagerServer) {
+		s.writeTimeout = timeout
+	}
+}
+
+// ServerSocketMode sets the file mode of the socket the extension listens on,
+// for example 0600 to only allow connections from the user running the
+// extension. It has no effect on Windows.
+func ServerSocketMode(mode os.FileMode) ServerOption {
+	return func(s *ExtensionManagerServer) {
+		s.listenOpts = append(s.listenOpts, transport.SocketMode(mode))
+	}
+}
+
+// ServerListenBacklog sets the maximum number of pending connections queued on
+// the socket the extension listens on. It has no effect on Windows.
+func ServerListenBacklog(backlog int) ServerOption {
+	return func(s *ExtensionManagerServer) {
+		s.listenOpts = append(s.listenOpts, transport.ListenBacklog(backlog))
+	}
+}
+
+// ServerTransport sets the kind of connection used to communicate with
+// osquery. The default, transport.Socket, is the only kind osquery supports.
+// With transport.TCP the socket path is a host:port address and the extension
+// listens on the same host, on the port after it plus the extension's UUID.
+func ServerTransport(kind transport.Kind) ServerOption {
+	return func(s *ExtensionManagerServer) {
+		s.kind = kind
+	}
+}
+
+// ServerClientTransport sets the transport used to connect to osquery, in
+// place of the socket at the path passed to the server's constructor. Together
+// with ServerListenTransport, this allows the extension to be tested with the
+// transports from transport.NewInMemoryTransport.
+func ServerClientTransport(trans thrift.TTransport) ServerOption {
+	return func(s *ExtensionManagerServer) {
+		s.clientTransport = trans
+	}
+}
+
+// ServerListenTransport sets the transport the extension serves osquery's
+// requests on once registered, in place of the socket derived from the UUID
+// osquery assigns.
+func ServerListenTransport(trans thrift.TServerTransport) ServerOption {
+	return func(s *ExtensionManagerServer) {
+		s.listenTransport = trans
+	}
+}
+
+// ServerBaseContext sets a context that the context of every plugin call is
+// derived from, so that values attached to it, such as a shared database
+// handle, are visible to all plugins without using global variables. Plugin
+// calls in progress are cancelled if the base context is done.
+func ServerBaseContext(ctx context.Context) ServerOption {
+	return func(s *ExtensionManagerServer) {
+		s.baseContext = ctx
+	}
+}
+
+// ErrorHandler is called with errors which happen in the background and so
+// can't be returned to the caller, such as failing to stop the server's
+// transport. Panics in plugin calls are reported as a *PanicError, which
+// includes the stack trace.
+type ErrorHandler func(err error)
+
+// ServerErrorHandler sets a function to be called with errors that happen in
+// the background. By default these errors are discarded.
+func ServerErrorHandler(handler ErrorHandler) ServerOption {
+	return func(s *ExtensionManagerServer) {
+		s.errorHandler = handler
+	}
+}
+
+// ServerLogger sets a structured logger for plugins to use during calls. The
+// logger is passed to plugins in the context of each call, annotated with the
+// registry and name of the plugin called, and can be retrieved with
+// logging.FromContext (or table.Logger for tables). A *slog.Logger can be used.
+// The server also logs panics in plugin calls to it, with their stack traces.
+// By default nothing is logged.
+func ServerLogger(logger logging.Logger) ServerOption {
+	return func(s *ExtensionManagerServer) {
+		s.logger = logger
+	}
+}
+
+// ServerRegistries allows plugins to be registered in the named registries, in
+// addition to the registries that osquery always has. This is only needed for
+// builds of osquery which add their own plugin registries.
+func ServerRegistries(registries ...string) ServerOption {
+	return func(s *ExtensionManagerServer) {
+		for _, reg := range registries {
+			if s.registry[reg] == nil {
+				s.registry[reg] = make(map[string]OsqueryPlugin)
+			}
+		}
+	}
+}
+
+// ServerRegistrationRetry makes the server keep trying to connect to osquery
+// and register the extension for up to the given window, backing off between
+// attempts, when osquery's extension manager socket isn't accepting
+// connections yet. This avoids failing when the extension starts at the same
+// time as osquery. Only failures to communicate with osquery are retried, not
+// osquery rejecting the registration. Calling Shutdown stops the retries in
+// Start. By default nothing is retried.
+func ServerRegistrationRetry(window time.Duration) ServerOption {
+	return func(s *ExtensionManagerServer) {
+		s.registrationRetry = window
+	}
+}
+
+// CallObserver is notified after each plugin call made by osquery completes,
+// with the registry and name of the plugin called, how long the call took and
+// the error it returned. It can be used to record metrics about plugin usage.
+type CallObserver func(registry, plugin string, duration time.Duration, err error)
+
+// ServerCallObserver sets a function to be called after every plugin call
+// completes. The observer is called without any server locks held, but may be
+// called concurrently for calls running in parallel.
+func ServerCallObserver(observer CallObserver) ServerOption {
+	return func(s *ExtensionManagerServer) {
+		s.callObserver = observer
+	}
+}
+
+// ResponseStats describes the response to a table generate call.
+type ResponseStats struct {
+	// Rows is the number of rows returned.
+	Rows int
+	// Bytes is the size of the response as sent to osquery.
+	Bytes int
+}
+
+// ResponseObserver is notified after each table generate call made by osquery
+// returns rows, with the registry and name of the table and the size of the
+// response. It can be used to find tables which return too much data.
+type ResponseObserver func(registry, plugin string, stats ResponseStats)
+
+// ServerResponseObserver sets a function to be called after every table
+// generate call which returns a response, including those which return a
+// partial response with an error. The response is reported by the table, so
+// only tables created with table.NewPlugin are observed. Like a CallObserver,
+// it may be called concurrently for calls running in parallel.
+func ServerResponseObserver(observer ResponseObserver) ServerOption {
+	return func(s *ExtensionManagerServer) {
+		s.responseObserver = observer
+	}
+}
+
 // NewExtensionManagerServer creates a new extension management server
 // communicating with osquery over the socket at the provided path. If
 // resolving the address or connecting to the socket fails, this function will
 // error.
+//
+// This is suited to extensions autoloaded by osquery, which are passed the
+// socket of an osquery that is already running. See
+// NewExternalExtensionManagerServer for extensions started independently.
 func NewExtensionManagerServer(name string, sockPath string, opts ...ServerOption) (*ExtensionManagerServer, error) {
+	manager := newExtensionManagerServer(name, sockPath, opts...)
+
+	var serverClient *ExtensionManagerClient
+	err := manager.retryRegistration(func() (err error) {
+		serverClient, err = manager.newClient()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	manager.serverClient = serverClient
+
+	return manager, nil
+}
+
+const (
+	registrationInitialBackoff = 100 * time.Millisecond
+	registrationMaxBackoff     = 2 * time.Second
+)
+
+// retryRegistration calls fn until it succeeds, it fails for a reason other
+// than communicating with osquery, or the registration retry window is over.
+// The delay between attempts doubles each time, up to a maximum.
+//
+// Shutdown stops the retries, in which case the error from the last attempt is
+// returned.
+func (s *ExtensionManagerServer) retryRegistration(fn func() error) error {
+	stopped := s.stoppedChan()
+	deadline := time.Now().Add(s.registrationRetry)
+	backoff := registrationInitialBackoff
+	for {
+		err := fn()
+		if err == nil || !isTransportError(err) {
+			return err
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return err
+		}
+		if backoff > remaining {
+			backoff = remaining
+		}
+		select {
+		case <-stopped:
+			return fmt.Errorf("server shut down: %w", err)
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > registrationMaxBackoff {
+			backoff = registrationMaxBackoff
+		}
+	}
+}
+
+// stoppedChan returns the channel closed by Shutdown.
+func (s *ExtensionManagerServer) stoppedChan() <-chan struct{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stopped == nil {
+		s.stopped = make(chan struct{})
+	}
+	return s.stopped
+}
+
+// NewExternalExtensionManagerServer creates a new extension management server
+// for an "external" extension, which is started independently of osquery
+// rather than autoloaded by it, and so may start before osquery's extension
+// manager socket exists or is accepting connections. It waits until osquery
+// responds to a ping on the socket at the provided path, retrying until the
+// context is done.
+//
+// The rest of the handshake is the same as for autoloaded extensions: Start
+// registers the plugins with osquery over its socket, and then serves them on
+// the extension's own socket, at the path osquery derives from the UUID it
+// assigned.
+func NewExternalExtensionManagerServer(ctx context.Context, name string, sockPath string, opts ...ServerOption) (*ExtensionManagerServer, error) {
+	manager := newExtensionManagerServer(name, sockPath, opts...)
+
+	var client *ExtensionManagerClient
+	for {
+		var err error
+		client, err = manager.newClient()
+		if err == nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, errors.Wrap(err, "waiting for osquery")
+		case <-time.After(readyPollInterval):
+		}
+	}
+
+	if err := client.WaitUntilReady(ctx); err != nil {
+		client.Close()
+		return nil, errors.Wrap(err, "waiting for osquery")
+	}
+	manager.serverClient = client
+
+	return manager, nil
+}
+
+// newClient connects to osquery, over the transport set with
+// ServerClientTransport if there is one.
+func (s *ExtensionManagerServer) newClient() (*ExtensionManagerClient, error) {
+	if s.clientTransport != nil {
+		return NewClientFromTransport(s.clientTransport, s.timeout)
+	}
+	return NewClient(s.sockPath, s.timeout, ClientTransport(s.kind))
+}
+
+// newExtensionManagerServer creates a server with the options applied, but
+// without a client for osquery.
+func newExtensionManagerServer(name string, sockPath string, opts ...ServerOption) *ExtensionManagerServer {
 	// Initialize nested registry maps
 	registry := make(map[string](map[string]OsqueryPlugin))
 	for reg, _ := range validRegistryNames {
@@ -81,36 +459,50 @@ func NewExtensionManagerServer(name string, sockPath string, opts ...ServerOptio
 	}
 
 	manager := &ExtensionManagerServer{
-		name:     name,
-		sockPath: sockPath,
-		registry: registry,
-		timeout:  defaultTimeout,
-		lastPing: time.Now(),
+		name:            name,
+		sockPath:        sockPath,
+		registry:        registry,
+		timeout:         defaultTimeout,
+		pingInterval:    defaultPingInterval,
+		livenessTimeout: defaultLivenessTimeout,
 	}
 
 	for _, opt := range opts {
 		opt(manager)
 	}
-
-	serverClient, err := NewClient(sockPath, manager.timeout)
-	if err != nil {
-		return nil, err
-	}
-	manager.serverClient = serverClient
-
-	return manager, nil
+	return manager
 }
 
 // RegisterPlugin adds one or more OsqueryPlugins to this extension manager.
-func (s *ExtensionManagerServer) RegisterPlugin(plugins ...OsqueryPlugin) {
+// Any number of plugins may be registered in each registry, but each plugin
+// must have a name that is unique within its registry. If any of the plugins
+// conflicts with an already registered plugin (or another plugin in the same
+// call), or is for an unknown registry, an error is returned and none of the
+// plugins are registered. RegisterPlugin used to return nothing, so callers
+// written against earlier versions should be updated to check the error.
+func (s *ExtensionManagerServer) RegisterPlugin(plugins ...OsqueryPlugin) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+
+	registering := map[string]map[string]bool{}
 	for _, plugin := range plugins {
-		if !validRegistryNames[plugin.RegistryName()] {
-			panic("invalid registry name: " + plugin.RegistryName())
+		if s.registry[plugin.RegistryName()] == nil {
+			return errors.Errorf("invalid registry name: %s", plugin.RegistryName())
+		}
+		if registering[plugin.RegistryName()] == nil {
+			registering[plugin.RegistryName()] = map[string]bool{}
 		}
+		_, registered := s.registry[plugin.RegistryName()][plugin.Name()]
+		if registered || registering[plugin.RegistryName()][plugin.Name()] {
+			return errors.Errorf("duplicate %s plugin: %s", plugin.RegistryName(), plugin.Name())
+		}
+		registering[plugin.RegistryName()][plugin.Name()] = true
+	}
+
+	for _, plugin := range plugins {
 		s.registry[plugin.RegistryName()][plugin.Name()] = plugin
 	}
+	return nil
 }
 
 func (s *ExtensionManagerServer) genRegistry() osquery.ExtensionRegistry {
@@ -128,34 +520,88 @@ func (s *ExtensionManagerServer) genRegistry() osquery.ExtensionRegistry {
 // for requests from the osquery process. All plugins should be registered with
 // RegisterPlugin() before calling Start().
 func (s *ExtensionManagerServer) Start() error {
-	var server thrift.TServer
-	err := func() error {
-		s.mutex.Lock()
-		defer s.mutex.Unlock()
-		registry := s.genRegistry()
+	s.mutex.RLock()
+	registry := s.genRegistry()
+	s.mutex.RUnlock()
 
-		stat, err := s.serverClient.RegisterExtension(
+	// Registration is retried without holding the lock, so that Shutdown
+	// and calls to the server aren't blocked while osquery is unavailable.
+	var stat *osquery.ExtensionStatus
+	attempt := 0
+	err := s.retryRegistration(func() (err error) {
+		if attempt++; attempt > 1 {
+			// The failed attempt may have broken the connection to
+			// osquery.
+			if client, ok := s.serverClient.(*ExtensionManagerClient); ok {
+				client.reconnect()
+			}
+		}
+		stat, err = s.serverClient.RegisterExtension(
 			context.Background(),
 			&osquery.InternalExtensionInfo{
 				Name: s.name,
 			},
 			registry,
 		)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("registering extension: %w", err)
+	}
+	if err := extensionError(stat); err != nil {
+		return fmt.Errorf("status %d registering extension: %w", stat.Code, err)
+	}
 
-		if err != nil {
-			return errors.Wrap(err, "registering extension")
-		}
-		if stat.Code != 0 {
-			return errors.Errorf("status %d registering extension: %s", stat.Code, stat.Message)
+	// The version is informational so failing to fetch it doesn't prevent
+	// the extension from starting.
+	var version string
+	if versioner, ok := s.serverClient.(serverVersioner); ok {
+		version, _ = versioner.ServerVersion(context.Background())
+	}
+
+	var server thrift.TServer
+	err = func() error {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if s.shuttingDown {
+			return errors.New("server shut down while registering extension")
 		}
 
-		listenPath := fmt.Sprintf("%s.%d", s.sockPath, stat.UUID)
+		s.version = version
+		s.uuid = stat.UUID
+		// osquery can't have pinged the extension before it registered,
+		// which may be long after the server was created.
+		s.touch()
 
 		processor := osquery.NewExtensionProcessor(ErrWrap{s})
 
-		s.transport, err = transport.OpenServer(listenPath, s.timeout)
-		if err != nil {
-			return errors.Wrapf(err, "opening server socket (%s)", listenPath)
+		if s.listenTransport != nil {
+			s.transport = s.listenTransport
+		} else {
+			listenPath, err := transport.ExtensionPath(s.kind, s.sockPath, int64(stat.UUID))
+			if err != nil {
+				return err
+			}
+			s.transport, err = transport.OpenServerKind(s.kind, listenPath, s.timeout, s.listenOpts...)
+			if err != nil {
+				return errors.Wrapf(err, "opening server socket (%s)", listenPath)
+			}
+			s.listenPath = listenPath
+		}
+
+		if s.readTimeout > 0 || s.writeTimeout > 0 {
+			deadlines := &deadlineServerTransport{
+				TServerTransport: s.transport,
+				readTimeout:      s.readTimeout,
+				writeTimeout:     s.writeTimeout,
+				onTimeout:        s.handleError,
+			}
+			// Only thrift's TCP server socket sets the server
+			// timeout on the connections it accepts.
+			if s.listenTransport == nil && s.kind == transport.TCP {
+				deadlines.socketTimeout = s.timeout
+			}
+			s.transport = deadlines
 		}
 
 		s.server = thrift.NewTSimpleServer2(processor, s.transport)
@@ -181,10 +627,7 @@ func (e ErrWrap) Call(ctx context.Context, registry string, item string, request
 	resp, err := e.ExtensionManagerServer.Call(ctx, registry, item, request)
 	if err != nil {
 		return &osquery.ExtensionResponse{
-			Status: &osquery.ExtensionStatus{
-				Code:    1,
-				Message: err.Error(),
-			},
+			Status:   errorStatus(err),
 			Response: resp,
 		}, nil
 	}
@@ -197,53 +640,328 @@ func (e ErrWrap) Call(ctx context.Context, registry string, item string, request
 	}, nil
 }
 
+// statusError is implemented by errors which carry the status to report to
+// osquery, such as table.StatusError.
+type statusError interface {
+	ExtensionStatus() osquery.ExtensionStatus
+}
+
+// errorStatus returns the status reported to osquery for a failed call. This
+// is a generic failure unless the error wraps a statusError.
+func errorStatus(err error) *osquery.ExtensionStatus {
+	var withStatus statusError
+	if stderrors.As(err, &withStatus) {
+		status := withStatus.ExtensionStatus()
+		return &status
+	}
+	return &osquery.ExtensionStatus{
+		Code:    1,
+		Message: err.Error(),
+	}
+}
+
 // Run starts the extension manager and runs until osquery calls for a shutdown
-// or the osquery instance goes away.
+// or the osquery instance goes away. The error that stopped the extension is
+// returned; the library never exits the process itself.
 func (s *ExtensionManagerServer) Run() error {
-	errc := make(chan error)
+	// Buffered so that whichever goroutine finishes second doesn't block
+	// forever.
+	errc := make(chan error, 2)
+	done := make(chan struct{})
+	defer close(done)
+
 	go func() {
 		errc <- s.Start()
 	}()
 
 	// Watch for the osquery process going away. If so, initiate shutdown.
 	go func() {
-		for range time.Tick(time.Second) {
-			s.mutex.Lock()
-			sinceLastPing := time.Now().Sub(s.lastPing)
-			s.mutex.Unlock()
-			if sinceLastPing > 10*time.Second {
-				errc <- fmt.Errorf("no server ping for over 10 seconds")
-				break
-			}
+		if err := s.watchOsquery(done); err != nil {
+			errc <- err
 		}
 	}()
 
 	err := <-errc
 	if shutdownErr := s.Shutdown(context.Background()); shutdownErr != nil {
-		return shutdownErr
+		if err == nil {
+			return shutdownErr
+		}
+		s.handleError(errors.Wrap(shutdownErr, "shutting down"))
 	}
 	return err
 }
 
+// watchOsquery checks that osquery is still alive every ping interval until
+// done is closed. An error is returned if pinging osquery fails or osquery
+// hasn't made a request within the liveness timeout.
+func (s *ExtensionManagerServer) watchOsquery(done <-chan struct{}) error {
+	interval := s.pingInterval
+	if interval <= 0 {
+		interval = defaultPingInterval
+	}
+	timeout := s.livenessTimeout
+	if timeout > 0 && timeout < 2*interval {
+		timeout = 2 * interval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return nil
+		}
+
+		if _, err := s.serverClient.Ping(context.Background()); err != nil {
+			return fmt.Errorf("extension ping failed: %w", err)
+		}
+		if timeout > 0 {
+			if s.sinceLastRequest() > timeout {
+				return errors.Errorf("no request from osquery for over %s", timeout)
+			}
+		}
+	}
+}
+
+// touch records that osquery has made a request.
+func (s *ExtensionManagerServer) touch() {
+	s.lastRequest.Store(time.Now())
+}
+
+// sinceLastRequest returns the time since osquery last made a request, or
+// since the extension registered if osquery hasn't made one. It returns 0 until
+// the extension has registered, as osquery can't make requests before then.
+func (s *ExtensionManagerServer) sinceLastRequest() time.Duration {
+	lastRequest, ok := s.lastRequest.Load().(time.Time)
+	if !ok {
+		return 0
+	}
+	return time.Since(lastRequest)
+}
+
+// handleError passes an error which can't be returned to the caller to the
+// error handler, if one is set.
+func (s *ExtensionManagerServer) handleError(err error) {
+	if s.errorHandler != nil {
+		s.errorHandler(err)
+	}
+}
+
 // Ping implements the basic health check.
 func (s *ExtensionManagerServer) Ping(ctx context.Context) (*osquery.ExtensionStatus, error) {
-	s.mutex.Lock()
-	s.lastPing = time.Now()
-	s.mutex.Unlock()
+	s.touch()
+
+	ctx = s.withBaseValues(ctx)
+	for _, plugin := range s.registeredPlugins() {
+		resp := plugin.Ping(ctx)
+		if resp.Code != 0 {
+			return &resp, nil
+		}
+	}
+	return &osquery.ExtensionStatus{Code: 0, Message: "OK"}, nil
+}
+
+// registeredPlugins returns a snapshot of the registered plugins, ordered by
+// registry and name, so that they can be used without holding the lock.
+func (s *ExtensionManagerServer) registeredPlugins() []OsqueryPlugin {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var plugins []OsqueryPlugin
 	for _, registry := range s.registry {
 		for _, plugin := range registry {
-			resp := plugin.Ping(ctx)
-			if resp.Code != 0 {
-				return &resp, nil
-			}
+			plugins = append(plugins, plugin)
 		}
 	}
-	return &osquery.ExtensionStatus{Code: 0, Message: "OK"}, nil
+	sort.Slice(plugins, func(i, j int) bool {
+		if plugins[i].RegistryName() != plugins[j].RegistryName() {
+			return plugins[i].RegistryName() < plugins[j].RegistryName()
+		}
+		return plugins[i].Name() < plugins[j].Name()
+	})
+	return plugins
+}
+
+// PluginStatus is the health of a single registered plugin.
+type PluginStatus struct {
+	Registry string
+	Name     string
+	Status   osquery.ExtensionStatus
+}
+
+// HealthStatus is the aggregated health of all of the registered plugins. The
+// status code is non-zero if any of the plugins are unhealthy, in which case
+// they are listed in Unhealthy.
+type HealthStatus struct {
+	osquery.ExtensionStatus
+	Unhealthy []PluginStatus
+}
+
+// HealthCheck pings every registered plugin and reports any which aren't
+// healthy. Unlike Ping, which osquery uses to check the extension is still
+// reachable, every plugin is checked rather than stopping at the first
+// failure, so this is suited to diagnosing a deployed extension.
+func (s *ExtensionManagerServer) HealthCheck(ctx context.Context) HealthStatus {
+	var unhealthy []PluginStatus
+	var names []string
+	for _, plugin := range s.registeredPlugins() {
+		status := plugin.Ping(ctx)
+		if status.Code != 0 {
+			unhealthy = append(unhealthy, PluginStatus{
+				Registry: plugin.RegistryName(),
+				Name:     plugin.Name(),
+				Status:   status,
+			})
+			names = append(names, plugin.RegistryName()+"/"+plugin.Name())
+		}
+	}
+
+	if len(unhealthy) > 0 {
+		return HealthStatus{
+			ExtensionStatus: osquery.ExtensionStatus{
+				Code:    1,
+				Message: "unhealthy plugins: " + strings.Join(names, ", "),
+			},
+			Unhealthy: unhealthy,
+		}
+	}
+	return HealthStatus{ExtensionStatus: osquery.ExtensionStatus{Code: 0, Message: "OK"}}
 }
 
 // Call routes a call from the osquery process to the appropriate registered
-// plugin.
-func (s *ExtensionManagerServer) Call(ctx context.Context, registry string, item string, request osquery.ExtensionPluginRequest) (osquery.ExtensionPluginResponse, error) {
+// plugin. The registry is only locked while the plugin is looked up, so calls
+// may run concurrently with each other and with plugin registration.
+// The call goes through any middleware added with Use before reaching the
+// plugin. A panic in the plugin or the middleware is returned to osquery as a
+// *PanicError, so that one broken plugin doesn't crash the extension, and is
+// logged with its stack trace and passed to the ErrorHandler.
+func (s *ExtensionManagerServer) Call(ctx context.Context, registry string, item string, request osquery.ExtensionPluginRequest) (resp osquery.ExtensionPluginResponse, err error) {
+	if s.callObserver != nil {
+		start := time.Now()
+		defer func() {
+			s.callObserver(registry, item, time.Since(start), err)
+		}()
+	}
+	if s.responseObserver != nil {
+		ctx = table.WithResponseObserver(ctx, func(rows, bytes int) {
+			s.responseObserver(registry, item, ResponseStats{Rows: rows, Bytes: bytes})
+		})
+	}
+
+	defer s.recoverPanic(registry, item, &resp, &err)
+
+	s.touch()
+	pluginCtx, cancel := s.pluginContext(ctx, registry, item)
+	defer cancel()
+	return s.handler()(pluginCtx, registry, item, request)
+}
+
+// recoverPanic must be deferred by the function handling a plugin call. It
+// recovers from a panic in the call, replacing the call's result with a
+// *PanicError, which it logs to the ServerLogger along with its stack trace and
+// passes to the ErrorHandler.
+func (s *ExtensionManagerServer) recoverPanic(registry, item string, resp *osquery.ExtensionPluginResponse, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	panicErr := newPanicError(registry, item, r)
+	*resp, *err = nil, panicErr
+
+	if s.logger != nil {
+		s.logger.Error("plugin call panicked",
+			"registry", panicErr.Registry,
+			"plugin", panicErr.Plugin,
+			"panic", fmt.Sprint(panicErr.Value),
+			"stack", string(panicErr.Stack))
+	}
+	s.handleError(panicErr)
+}
+
+// callPlugin is the CallHandler which calls the plugin, once the call has been
+// through any middleware. A panic in the plugin is recovered here, so that the
+// middleware sees it as an error.
+func (s *ExtensionManagerServer) callPlugin(ctx context.Context, registry string, item string, request osquery.ExtensionPluginRequest) (resp osquery.ExtensionPluginResponse, err error) {
+	plugin, err := s.startCall(registry, item)
+	if err != nil {
+		return nil, err
+	}
+	defer s.inFlight.Done()
+	defer s.recoverPanic(registry, item, &resp, &err)
+
+	return plugin.Call(ctx, request)
+}
+
+// pluginContext returns the context passed to plugin calls, derived from the
+// context of the request from osquery. The thrift server passes a background
+// context, so the call isn't cancelled if osquery drops the connection: it is
+// only cancelled once the ServerCallTimeout expires or the ServerBaseContext is
+// done. The cancel function must be called once the call completes.
+func (s *ExtensionManagerServer) pluginContext(ctx context.Context, registry, item string) (context.Context, context.CancelFunc) {
+	s.mutex.RLock()
+	version := s.version
+	s.mutex.RUnlock()
+
+	ctx = s.withBaseValues(ctx)
+	ctx = logging.NewContext(ctx, s.logger, "registry", registry, "plugin", item)
+
+	if version != "" {
+		ctx = context.WithValue(ctx, serverVersionKey{}, version)
+	}
+
+	var cancel context.CancelFunc
+	if s.callTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, s.callTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	if s.baseContext != nil && s.baseContext.Done() != nil {
+		go func() {
+			select {
+			case <-s.baseContext.Done():
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+	return ctx, cancel
+}
+
+// withBaseValues returns ctx with the values of the base context set with
+// ServerBaseContext visible through it.
+func (s *ExtensionManagerServer) withBaseValues(ctx context.Context) context.Context {
+	if s.baseContext == nil {
+		return ctx
+	}
+	return baseValuesContext{Context: ctx, base: s.baseContext}
+}
+
+// baseValuesContext is a context which looks up values in the base context
+// when they aren't set in the context itself. The deadline and cancellation
+// are those of the context itself.
+type baseValuesContext struct {
+	context.Context
+	base context.Context
+}
+
+func (c baseValuesContext) Value(key interface{}) interface{} {
+	if value := c.Context.Value(key); value != nil {
+		return value
+	}
+	return c.base.Value(key)
+}
+
+// startCall looks up the plugin for a call and marks the call as in flight.
+// The caller must call s.inFlight.Done() once the call completes.
+func (s *ExtensionManagerServer) startCall(registry string, item string) (OsqueryPlugin, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if s.shuttingDown {
+		return nil, errors.New("extension is shutting down")
+	}
+
 	subreg, ok := s.registry[registry]
 	if !ok {
 		return nil, fmt.Errorf("Unknown registry: %s", registry)
@@ -251,37 +969,97 @@ func (s *ExtensionManagerServer) Call(ctx context.Context, registry string, item
 
 	plugin, ok := subreg[item]
 	if !ok {
-		return nil, fmt.Errorf("Unknown registry item: %s", registry)
+		return nil, fmt.Errorf("Unknown registry item: %s", item)
 	}
 
-	return plugin.Call(context.Background(), request)
+	s.inFlight.Add(1)
+	return plugin, nil
 }
 
-// Shutdown stops the server and closes the listening socket.
+// Shutdown stops the server, closes the listening socket and closes the
+// server's connection to osquery. New plugin calls are rejected immediately,
+// and calls which are already in progress are given until the context is done
+// to complete before the socket is closed. If the context is done first, the
+// context's error is returned.
 func (s *ExtensionManagerServer) Shutdown(ctx context.Context) error {
 	s.mutex.Lock()
-	defer s.mutex.Unlock()
-	if s.server != nil {
-		server := s.server
-		s.server = nil
+	if s.stopped == nil {
+		s.stopped = make(chan struct{})
+	}
+	if !s.shuttingDown {
+		close(s.stopped)
+	}
+	s.shuttingDown = true
+	server := s.server
+	s.server = nil
+	s.mutex.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		s.inFlight.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = fmt.Errorf("waiting for in-flight calls: %w", ctx.Err())
+	}
+
+	s.mutex.Lock()
+	for _, registry := range s.registry {
+		for _, plugin := range registry {
+			plugin.Shutdown()
+		}
+	}
+	s.mutex.Unlock()
+
+	if client, ok := s.serverClient.(*ExtensionManagerClient); ok {
+		client.Close()
+	}
+
+	if server != nil {
 		// Stop the server asynchronously so that the current request
 		// can complete. Otherwise, this is vulnerable to deadlock if a
 		// shutdown request is being processed when shutdown is
 		// explicitly called.
 		go func() {
-			server.Stop()
+			if err := server.Stop(); err != nil {
+				s.handleError(errors.Wrap(err, "stopping server"))
+			}
 		}()
 	}
 
-	return nil
+	return err
+}
+
+// UUID returns the UUID osquery assigned to the extension when it registered.
+// It returns false if the extension hasn't registered yet.
+func (s *ExtensionManagerServer) UUID() (osquery.ExtensionRouteUUID, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.uuid, s.uuid != coreExtensionUUID
+}
+
+// SocketPath returns the path of the socket the extension listens on for
+// requests from osquery, which is derived from osquery's socket path and the
+// UUID osquery assigned once the extension has registered. For transport.TCP
+// it is the host:port address instead. It returns an empty string if the
+// extension hasn't registered yet, or if it listens on a transport set with
+// ServerListenTransport.
+func (s *ExtensionManagerServer) SocketPath() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.listenPath
 }
 
 // Useful for testing
 func (s *ExtensionManagerServer) waitStarted() {
 	for {
-		s.mutex.Lock()
+		s.mutex.RLock()
 		started := s.started
-		s.mutex.Unlock()
+		s.mutex.RUnlock()
 		if started {
 			time.Sleep(10 * time.Millisecond)
 			break
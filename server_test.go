@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
 	"sync"
 	"syscall"
 	"testing"
@@ -17,6 +18,8 @@ import (
 
 	"github.com/bradleyjkemp/osquery-go/gen/osquery"
 	"github.com/bradleyjkemp/osquery-go/plugin/logger"
+	"github.com/bradleyjkemp/osquery-go/plugin/table"
+	"github.com/bradleyjkemp/osquery-go/transport"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -47,7 +50,7 @@ func TestNoDeadlockOnError(t *testing.T) {
 		fmt.Printf("%s: %s\n", log.Type(), log)
 		return nil
 	}
-	server.RegisterPlugin(logger.NewPlugin("testLogger", log))
+	require.NoError(t, server.RegisterPlugin(logger.NewPlugin("testLogger", log)))
 
 	err := server.Run()
 	assert.Error(t, err)
@@ -75,6 +78,7 @@ func TestShutdownWhenPingFails(t *testing.T) {
 	server := &ExtensionManagerServer{
 		serverClient: mock,
 		registry:     registry,
+		pingInterval: 10 * time.Millisecond,
 	}
 
 	err := server.Run()
@@ -82,6 +86,52 @@ func TestShutdownWhenPingFails(t *testing.T) {
 	assert.Contains(t, err.Error(), "broken pipe")
 }
 
+// Ensure that the extension server will shutdown and return if osquery stops
+// making requests, even though pinging it succeeds.
+func TestShutdownLivenessTimeout(t *testing.T) {
+	tempPath, err := ioutil.TempFile("", "")
+	require.Nil(t, err)
+	defer os.Remove(tempPath.Name())
+
+	mock := &mock.ExtensionManager{
+		RegisterExtensionFunc: func(ctx context.Context, info *osquery.InternalExtensionInfo, registry osquery.ExtensionRegistry) (*osquery.ExtensionStatus, error) {
+			return &osquery.ExtensionStatus{Code: 0, UUID: 1}, nil
+		},
+		PingFunc: func(ctx context.Context) (*osquery.ExtensionStatus, error) {
+			return &osquery.ExtensionStatus{Code: 0, Message: "OK"}, nil
+		},
+	}
+	server := &ExtensionManagerServer{
+		serverClient: mock,
+		sockPath:     tempPath.Name(),
+	}
+	ServerPingInterval(10 * time.Millisecond)(server)
+	ServerLivenessTimeout(50 * time.Millisecond)(server)
+
+	// Requests from osquery keep the extension alive
+	stop := make(chan struct{})
+	go func() {
+		server.waitStarted()
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				server.Ping(context.Background())
+			case <-stop:
+				return
+			}
+		}
+	}()
+	time.AfterFunc(200*time.Millisecond, func() { close(stop) })
+
+	start := time.Now()
+	err = server.Run()
+	assert.EqualError(t, err, "no request from osquery for over 50ms")
+	assert.True(t, time.Since(start) > 200*time.Millisecond)
+	assert.True(t, mock.PingFuncInvoked)
+}
+
 // How many parallel tests to run (because sync issues do not occur on every
 // run, this maximizes our chances of seeing any issue by quickly executing
 // many runs of the test).
@@ -196,3 +246,811 @@ func TestShutdownBasic(t *testing.T) {
 		t.Fatal("hung on shutdown")
 	}
 }
+
+func TestShutdownDrainsInFlightCalls(t *testing.T) {
+	registry := make(map[string](map[string]OsqueryPlugin))
+	for reg, _ := range validRegistryNames {
+		registry[reg] = make(map[string]OsqueryPlugin)
+	}
+	server := &ExtensionManagerServer{registry: registry}
+
+	called := make(chan struct{})
+	release := make(chan struct{})
+	require.NoError(t, server.RegisterPlugin(logger.NewPlugin("testLogger", func(ctx context.Context, log logger.Log) error {
+		close(called)
+		<-release
+		return nil
+	})))
+
+	callErr := make(chan error)
+	go func() {
+		_, err := server.Call(context.Background(), "logger", "testLogger", osquery.ExtensionPluginRequest{"string": "foo"})
+		callErr <- err
+	}()
+	<-called
+
+	// The in-flight call doesn't complete before the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	assert.Error(t, err)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	// New calls are rejected once shutdown has started
+	_, err = server.Call(context.Background(), "logger", "testLogger", osquery.ExtensionPluginRequest{"string": "foo"})
+	assert.Error(t, err)
+
+	// Shutdown completes once the in-flight call does
+	shutdownErr := make(chan error)
+	go func() {
+		shutdownErr <- server.Shutdown(context.Background())
+	}()
+	close(release)
+	assert.NoError(t, <-callErr)
+	assert.NoError(t, <-shutdownErr)
+}
+
+func TestRegisterMultiplePlugins(t *testing.T) {
+	registry := make(map[string](map[string]OsqueryPlugin))
+	for reg, _ := range validRegistryNames {
+		registry[reg] = make(map[string]OsqueryPlugin)
+	}
+	server := &ExtensionManagerServer{registry: registry}
+
+	var logged []string
+	logTo := func(name string) logger.LogFunc {
+		return func(ctx context.Context, log logger.Log) error {
+			logged = append(logged, name)
+			return nil
+		}
+	}
+
+	err := server.RegisterPlugin(
+		logger.NewPlugin("first", logTo("first")),
+		logger.NewPlugin("second", logTo("second")),
+	)
+	require.NoError(t, err)
+	err = server.RegisterPlugin(logger.NewPlugin("third", logTo("third")))
+	require.NoError(t, err)
+
+	for _, name := range []string{"third", "first", "second"} {
+		_, err = server.Call(context.Background(), "logger", name, osquery.ExtensionPluginRequest{"string": "foo"})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, []string{"third", "first", "second"}, logged)
+
+	_, err = server.Call(context.Background(), "logger", "fourth", osquery.ExtensionPluginRequest{"string": "foo"})
+	assert.EqualError(t, err, "Unknown registry item: fourth")
+
+	// Name collisions are rejected without registering any of the plugins
+	err = server.RegisterPlugin(
+		logger.NewPlugin("fourth", logTo("fourth")),
+		logger.NewPlugin("first", logTo("first")),
+	)
+	assert.EqualError(t, err, "duplicate logger plugin: first")
+	err = server.RegisterPlugin(
+		logger.NewPlugin("fifth", logTo("fifth")),
+		logger.NewPlugin("fifth", logTo("fifth")),
+	)
+	assert.EqualError(t, err, "duplicate logger plugin: fifth")
+	assert.Len(t, server.registry["logger"], 3)
+}
+
+func TestConcurrentRegisterAndCall(t *testing.T) {
+	registry := make(map[string](map[string]OsqueryPlugin))
+	for reg, _ := range validRegistryNames {
+		registry[reg] = make(map[string]OsqueryPlugin)
+	}
+	server := &ExtensionManagerServer{registry: registry}
+
+	var mutex sync.Mutex
+	logged := 0
+	logFunc := func(ctx context.Context, log logger.Log) error {
+		mutex.Lock()
+		logged++
+		mutex.Unlock()
+		return nil
+	}
+	require.NoError(t, server.RegisterPlugin(logger.NewPlugin("shared", logFunc)))
+
+	const workers = 10
+	var wait sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wait.Add(2)
+		go func(i int) {
+			defer wait.Done()
+			assert.NoError(t, server.RegisterPlugin(logger.NewPlugin(fmt.Sprintf("logger%d", i), logFunc)))
+		}(i)
+		go func() {
+			defer wait.Done()
+			for j := 0; j < 10; j++ {
+				_, err := server.Call(context.Background(), "logger", "shared", osquery.ExtensionPluginRequest{"string": "foo"})
+				assert.NoError(t, err)
+				server.Ping(context.Background())
+			}
+		}()
+	}
+	wait.Wait()
+
+	assert.Equal(t, workers*10, logged)
+	assert.Len(t, server.registry["logger"], workers+1)
+}
+
+func TestCallObserver(t *testing.T) {
+	registry := make(map[string](map[string]OsqueryPlugin))
+	for reg, _ := range validRegistryNames {
+		registry[reg] = make(map[string]OsqueryPlugin)
+	}
+
+	type observation struct {
+		registry, plugin string
+		err              error
+	}
+	var observed []observation
+	var durations []time.Duration
+	server := &ExtensionManagerServer{registry: registry}
+	ServerCallObserver(func(registry, plugin string, duration time.Duration, err error) {
+		// The registry must not be locked while observing
+		server.mutex.Lock()
+		server.mutex.Unlock()
+
+		durations = append(durations, duration)
+		observed = append(observed, observation{registry, plugin, err})
+	})(server)
+
+	logErr := errors.New("log failed")
+	require.NoError(t, server.RegisterPlugin(
+		logger.NewPlugin("ok", func(ctx context.Context, log logger.Log) error {
+			time.Sleep(time.Millisecond)
+			return nil
+		}),
+		logger.NewPlugin("failing", func(ctx context.Context, log logger.Log) error {
+			return logErr
+		}),
+	))
+
+	_, err := server.Call(context.Background(), "logger", "ok", osquery.ExtensionPluginRequest{"string": "foo"})
+	assert.NoError(t, err)
+	_, err = server.Call(context.Background(), "logger", "failing", osquery.ExtensionPluginRequest{"string": "foo"})
+	assert.Error(t, err)
+	_, err = server.Call(context.Background(), "logger", "missing", osquery.ExtensionPluginRequest{"string": "foo"})
+	assert.Error(t, err)
+
+	require.Len(t, observed, 3)
+	assert.Equal(t, observation{"logger", "ok", nil}, observed[0])
+	assert.True(t, durations[0] >= time.Millisecond)
+	assert.Equal(t, "failing", observed[1].plugin)
+	assert.True(t, errors.Is(observed[1].err, logErr))
+	assert.Equal(t, "missing", observed[2].plugin)
+	assert.EqualError(t, observed[2].err, "Unknown registry item: missing")
+}
+
+func TestResponseObserver(t *testing.T) {
+	server := newExtensionManagerServer("test", "/tmp/test.em")
+	type observation struct {
+		registry, plugin string
+		stats            ResponseStats
+	}
+	var observed []observation
+	ServerResponseObserver(func(registry, plugin string, stats ResponseStats) {
+		observed = append(observed, observation{registry, plugin, stats})
+	})(server)
+
+	type row struct {
+		Value string `column:"value"`
+	}
+	generate := func(ctx context.Context, queryContext table.QueryContext) ([]table.RowDefinition, error) {
+		return []table.RowDefinition{row{"aaaaa"}, row{"bbbbb"}}, nil
+	}
+	failing := func(ctx context.Context, queryContext table.QueryContext) ([]table.RowDefinition, error) {
+		return nil, errors.New("boom")
+	}
+	partial := func(ctx context.Context, queryContext table.QueryContext) ([]table.RowDefinition, error) {
+		return []table.RowDefinition{row{"aaaaa"}}, &table.PartialError{Err: errors.New("boom")}
+	}
+	for name, fn := range map[string]table.GenerateRowsImpl{"ok": generate, "failing": failing, "partial": partial} {
+		plugin, err := table.NewPlugin(name, row{}, table.GenerateRows(fn))
+		require.NoError(t, err)
+		require.NoError(t, server.RegisterPlugin(plugin))
+	}
+	require.NoError(t, server.RegisterPlugin(logger.NewPlugin("logger", func(ctx context.Context, log logger.Log) error {
+		return nil
+	})))
+
+	request := osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"}
+	_, err := server.Call(context.Background(), "table", "ok", request)
+	require.NoError(t, err)
+	_, err = server.Call(context.Background(), "table", "failing", request)
+	require.Error(t, err)
+	_, err = server.Call(context.Background(), "table", "partial", request)
+	require.Error(t, err)
+	_, err = server.Call(context.Background(), "table", "ok", osquery.ExtensionPluginRequest{"action": "columns"})
+	require.NoError(t, err)
+	_, err = server.Call(context.Background(), "logger", "logger", osquery.ExtensionPluginRequest{"string": "foo"})
+	require.NoError(t, err)
+
+	// Each row is 24 bytes, and the list of rows adds 5
+	assert.Equal(t, []observation{
+		{"table", "ok", ResponseStats{Rows: 2, Bytes: 53}},
+		{"table", "partial", ResponseStats{Rows: 1, Bytes: 29}},
+	}, observed)
+}
+
+func TestServerVersionContext(t *testing.T) {
+	registry := make(map[string](map[string]OsqueryPlugin))
+	for reg, _ := range validRegistryNames {
+		registry[reg] = make(map[string]OsqueryPlugin)
+	}
+	server := &ExtensionManagerServer{registry: registry}
+
+	var version string
+	var ok bool
+	require.NoError(t, server.RegisterPlugin(logger.NewPlugin("testLogger", func(ctx context.Context, log logger.Log) error {
+		version, ok = ServerVersionFromContext(ctx)
+		return nil
+	})))
+
+	_, err := server.Call(context.Background(), "logger", "testLogger", osquery.ExtensionPluginRequest{"string": "foo"})
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	server.version = "4.4.0"
+	_, err = server.Call(context.Background(), "logger", "testLogger", osquery.ExtensionPluginRequest{"string": "foo"})
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "4.4.0", version)
+}
+
+func TestServerBaseContext(t *testing.T) {
+	type dbKey struct{}
+	type requestKey struct{}
+	base, cancelBase := context.WithCancel(context.WithValue(context.Background(), dbKey{}, "db"))
+	defer cancelBase()
+
+	server := newExtensionManagerServer("test", "", ServerBaseContext(base))
+	var db, request interface{}
+	var cancelled bool
+	require.NoError(t, server.RegisterPlugin(logger.NewPlugin("testLogger", func(ctx context.Context, log logger.Log) error {
+		db, request = ctx.Value(dbKey{}), ctx.Value(requestKey{})
+		if log.ToRequest()["string"] == "wait" {
+			cancelBase()
+			<-ctx.Done()
+			cancelled = true
+		}
+		return nil
+	})))
+
+	ctx := context.WithValue(context.Background(), requestKey{}, "request")
+	_, err := server.Call(ctx, "logger", "testLogger", osquery.ExtensionPluginRequest{"string": "foo"})
+	require.NoError(t, err)
+	assert.Equal(t, "db", db)
+	assert.Equal(t, "request", request)
+
+	// Calls are cancelled once the base context is done
+	_, err = server.Call(ctx, "logger", "testLogger", osquery.ExtensionPluginRequest{"string": "wait"})
+	require.NoError(t, err)
+	assert.True(t, cancelled)
+}
+
+func TestServerUUID(t *testing.T) {
+	tempPath, err := ioutil.TempFile("", "")
+	require.Nil(t, err)
+	defer os.Remove(tempPath.Name())
+
+	mock := &mock.ExtensionManager{
+		RegisterExtensionFunc: func(ctx context.Context, info *osquery.InternalExtensionInfo, registry osquery.ExtensionRegistry) (*osquery.ExtensionStatus, error) {
+			return &osquery.ExtensionStatus{Code: 0, UUID: 7}, nil
+		},
+	}
+	server := &ExtensionManagerServer{serverClient: mock, sockPath: tempPath.Name()}
+	_, ok := server.UUID()
+	assert.False(t, ok)
+	assert.Equal(t, "", server.SocketPath())
+
+	go server.Start()
+	server.waitStarted()
+	defer server.Shutdown(context.Background())
+
+	uuid, ok := server.UUID()
+	assert.True(t, ok)
+	assert.Equal(t, osquery.ExtensionRouteUUID(7), uuid)
+
+	// A client can connect to the extension at its socket path
+	assert.Equal(t, tempPath.Name()+".7", server.SocketPath())
+	client, err := NewClient(server.SocketPath(), time.Second)
+	require.NoError(t, err)
+	client.Close()
+}
+
+func TestExternalExtensionManagerServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "osquery")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	sockPath := filepath.Join(dir, "osquery.em")
+
+	// osquery isn't running when the extension starts
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	_, err = NewExternalExtensionManagerServer(ctx, "external", sockPath)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "waiting for osquery")
+
+	// osquery starts while the extension is waiting
+	mock := &mock.ExtensionManager{
+		PingFunc: func(ctx context.Context) (*osquery.ExtensionStatus, error) {
+			return &osquery.ExtensionStatus{Code: 0, Message: "OK"}, nil
+		},
+	}
+	trans, err := transport.OpenServer(sockPath, time.Second)
+	require.NoError(t, err)
+	osqueryServer := thrift.NewTSimpleServer2(osquery.NewExtensionManagerProcessor(mock), trans)
+	time.AfterFunc(100*time.Millisecond, func() { osqueryServer.Serve() })
+	defer osqueryServer.Stop()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server, err := NewExternalExtensionManagerServer(ctx, "external", sockPath)
+	require.NoError(t, err)
+	require.NotNil(t, server.serverClient)
+	defer server.serverClient.(*ExtensionManagerClient).Close()
+	assert.Equal(t, "external", server.name)
+}
+
+func TestServerRegistrationRetry(t *testing.T) {
+	tempPath, err := ioutil.TempFile("", "")
+	require.Nil(t, err)
+	defer os.Remove(tempPath.Name())
+
+	// osquery isn't accepting connections for the first two attempts
+	var attempts int
+	mock := &mock.ExtensionManager{
+		RegisterExtensionFunc: func(ctx context.Context, info *osquery.InternalExtensionInfo, registry osquery.ExtensionRegistry) (*osquery.ExtensionStatus, error) {
+			if attempts++; attempts < 3 {
+				return nil, errors.New("connection refused")
+			}
+			return &osquery.ExtensionStatus{Code: 0, UUID: 1}, nil
+		},
+	}
+	server := &ExtensionManagerServer{serverClient: mock, sockPath: tempPath.Name()}
+	ServerRegistrationRetry(5 * time.Second)(server)
+
+	go server.Start()
+	server.waitStarted()
+	defer server.Shutdown(context.Background())
+	assert.Equal(t, 3, attempts)
+}
+
+func TestServerRegistrationRetryErrors(t *testing.T) {
+	var attempts int
+	mock := &mock.ExtensionManager{
+		RegisterExtensionFunc: func(ctx context.Context, info *osquery.InternalExtensionInfo, registry osquery.ExtensionRegistry) (*osquery.ExtensionStatus, error) {
+			attempts++
+			return nil, errors.New("connection refused")
+		},
+	}
+
+	// Without retries the first failure is returned
+	server := &ExtensionManagerServer{serverClient: mock}
+	err := server.Start()
+	assert.EqualError(t, err, "registering extension: connection refused")
+	assert.Equal(t, 1, attempts)
+
+	// Retrying gives up once the window is over
+	attempts = 0
+	ServerRegistrationRetry(250 * time.Millisecond)(server)
+	start := time.Now()
+	err = server.Start()
+	assert.EqualError(t, err, "registering extension: connection refused")
+	assert.True(t, attempts > 1)
+	assert.True(t, time.Since(start) >= 250*time.Millisecond)
+
+	// osquery rejecting the request isn't retried
+	attempts = 0
+	mock.RegisterExtensionFunc = func(ctx context.Context, info *osquery.InternalExtensionInfo, registry osquery.ExtensionRegistry) (*osquery.ExtensionStatus, error) {
+		attempts++
+		return nil, thrift.NewTApplicationException(thrift.INTERNAL_ERROR, "rejected")
+	}
+	err = server.Start()
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestServerRegistrationRetryShutdown(t *testing.T) {
+	mock := &mock.ExtensionManager{
+		RegisterExtensionFunc: func(ctx context.Context, info *osquery.InternalExtensionInfo, registry osquery.ExtensionRegistry) (*osquery.ExtensionStatus, error) {
+			return nil, errors.New("connection refused")
+		},
+	}
+	server := &ExtensionManagerServer{serverClient: mock}
+	ServerRegistrationRetry(time.Minute)(server)
+
+	errs := make(chan error, 1)
+	go func() { errs <- server.Start() }()
+	time.Sleep(50 * time.Millisecond)
+
+	// The server isn't locked while registration is retried
+	_, ok := server.UUID()
+	assert.False(t, ok)
+
+	require.NoError(t, server.Shutdown(context.Background()))
+	select {
+	case err := <-errs:
+		assert.EqualError(t, err, "registering extension: server shut down: connection refused")
+	case <-time.After(time.Second):
+		t.Fatal("Start didn't return after Shutdown")
+	}
+}
+
+func TestNewExtensionManagerServerRegistrationRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "osquery")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	sockPath := filepath.Join(dir, "osquery.em")
+
+	_, err = NewExtensionManagerServer("retry", sockPath)
+	require.Error(t, err)
+
+	// osquery starts listening shortly after the extension starts
+	time.AfterFunc(200*time.Millisecond, func() {
+		trans, err := transport.OpenServer(sockPath, time.Second)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		trans.Listen()
+	})
+	server, err := NewExtensionManagerServer("retry", sockPath, ServerRegistrationRetry(5*time.Second))
+	require.NoError(t, err)
+	assert.NotNil(t, server.serverClient)
+}
+
+// recordingLogger records the arguments of every line logged at info level,
+// and of every line logged at error level separately.
+type recordingLogger struct {
+	lines  [][]interface{}
+	errors [][]interface{}
+}
+
+func (l *recordingLogger) Debug(msg string, args ...interface{}) {}
+func (l *recordingLogger) Info(msg string, args ...interface{}) {
+	l.lines = append(l.lines, append([]interface{}{msg}, args...))
+}
+func (l *recordingLogger) Warn(msg string, args ...interface{}) {}
+func (l *recordingLogger) Error(msg string, args ...interface{}) {
+	l.errors = append(l.errors, append([]interface{}{msg}, args...))
+}
+
+func TestServerLogger(t *testing.T) {
+	registry := make(map[string](map[string]OsqueryPlugin))
+	for reg, _ := range validRegistryNames {
+		registry[reg] = make(map[string]OsqueryPlugin)
+	}
+	server := &ExtensionManagerServer{registry: registry}
+
+	plugin, err := table.NewPlugin("testTable", struct{}{}, table.GenerateRows(func(ctx context.Context, queryCtx table.QueryContext) ([]table.RowDefinition, error) {
+		table.Logger(ctx).Info("scanning", "path", "/tmp")
+		return nil, nil
+	}))
+	require.NoError(t, err)
+	require.NoError(t, server.RegisterPlugin(plugin))
+
+	// Without a logger nothing is logged
+	_, err = server.Call(context.Background(), "table", "testTable", osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	require.NoError(t, err)
+
+	logger := &recordingLogger{}
+	ServerLogger(logger)(server)
+	_, err = server.Call(context.Background(), "table", "testTable", osquery.ExtensionPluginRequest{"action": "generate", "context": "{}", "request_id": "abc123"})
+	require.NoError(t, err)
+	assert.Equal(t, [][]interface{}{
+		{"scanning", "registry", "table", "plugin", "testTable", "request_id", "abc123", "path", "/tmp"},
+	}, logger.lines)
+}
+
+type pingPlugin struct {
+	registry, name string
+	status         osquery.ExtensionStatus
+}
+
+func (p *pingPlugin) Name() string                                     { return p.name }
+func (p *pingPlugin) RegistryName() string                             { return p.registry }
+func (p *pingPlugin) Routes() osquery.ExtensionPluginResponse          { return nil }
+func (p *pingPlugin) Ping(ctx context.Context) osquery.ExtensionStatus { return p.status }
+func (p *pingPlugin) Call(context.Context, osquery.ExtensionPluginRequest) (osquery.ExtensionPluginResponse, error) {
+	return nil, nil
+}
+func (p *pingPlugin) Shutdown() {}
+
+func TestHealthCheck(t *testing.T) {
+	registry := make(map[string](map[string]OsqueryPlugin))
+	for reg, _ := range validRegistryNames {
+		registry[reg] = make(map[string]OsqueryPlugin)
+	}
+	server := &ExtensionManagerServer{registry: registry}
+
+	ok := osquery.ExtensionStatus{Code: 0, Message: "OK"}
+	require.NoError(t, server.RegisterPlugin(
+		&pingPlugin{"table", "healthy", ok},
+		&pingPlugin{"logger", "healthy", ok},
+	))
+	assert.Equal(t, HealthStatus{ExtensionStatus: ok}, server.HealthCheck(context.Background()))
+
+	broken := osquery.ExtensionStatus{Code: 1, Message: "broken"}
+	require.NoError(t, server.RegisterPlugin(
+		&pingPlugin{"table", "broken", broken},
+		&pingPlugin{"config", "broken", broken},
+	))
+	assert.Equal(t, HealthStatus{
+		ExtensionStatus: osquery.ExtensionStatus{
+			Code:    1,
+			Message: "unhealthy plugins: config/broken, table/broken",
+		},
+		Unhealthy: []PluginStatus{
+			{Registry: "config", Name: "broken", Status: broken},
+			{Registry: "table", Name: "broken", Status: broken},
+		},
+	}, server.HealthCheck(context.Background()))
+}
+
+func TestServerCallTimeout(t *testing.T) {
+	registry := make(map[string](map[string]OsqueryPlugin))
+	for reg, _ := range validRegistryNames {
+		registry[reg] = make(map[string]OsqueryPlugin)
+	}
+	server := &ExtensionManagerServer{registry: registry}
+
+	var deadline time.Time
+	var hasDeadline bool
+	var ctxErr error
+	require.NoError(t, server.RegisterPlugin(logger.NewPlugin("testLogger", func(ctx context.Context, log logger.Log) error {
+		deadline, hasDeadline = ctx.Deadline()
+		<-ctx.Done()
+		ctxErr = ctx.Err()
+		return ctxErr
+	})))
+
+	// Without a timeout the call's context is cancelled when it returns
+	require.NoError(t, server.RegisterPlugin(logger.NewPlugin("noDeadline", func(ctx context.Context, log logger.Log) error {
+		_, hasDeadline = ctx.Deadline()
+		return nil
+	})))
+	_, err := server.Call(context.Background(), "logger", "noDeadline", osquery.ExtensionPluginRequest{"string": "foo"})
+	require.NoError(t, err)
+	assert.False(t, hasDeadline)
+
+	ServerCallTimeout(10 * time.Millisecond)(server)
+	start := time.Now()
+	_, err = server.Call(context.Background(), "logger", "testLogger", osquery.ExtensionPluginRequest{"string": "foo"})
+	assert.Error(t, err)
+	assert.True(t, hasDeadline)
+	assert.WithinDuration(t, start.Add(10*time.Millisecond), deadline, 5*time.Millisecond)
+	assert.Equal(t, context.DeadlineExceeded, ctxErr)
+}
+
+func TestServerCallCancelled(t *testing.T) {
+	server := &ExtensionManagerServer{registry: map[string]map[string]OsqueryPlugin{"logger": {}}}
+
+	var ctxErr error
+	require.NoError(t, server.RegisterPlugin(logger.NewPlugin("testLogger", func(ctx context.Context, log logger.Log) error {
+		<-ctx.Done()
+		ctxErr = ctx.Err()
+		return ctxErr
+	})))
+
+	// Cancelling the request cancels the plugin call
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	_, err := server.Call(ctx, "logger", "testLogger", osquery.ExtensionPluginRequest{"string": "foo"})
+	assert.Error(t, err)
+	assert.Equal(t, context.Canceled, ctxErr)
+}
+
+func TestCallStatusError(t *testing.T) {
+	registry := make(map[string](map[string]OsqueryPlugin))
+	for reg, _ := range validRegistryNames {
+		registry[reg] = make(map[string]OsqueryPlugin)
+	}
+	server := &ExtensionManagerServer{registry: registry}
+
+	var generateErr error
+	plugin, err := table.NewPlugin("testTable", struct{}{}, table.GenerateRows(func(context.Context, table.QueryContext) ([]table.RowDefinition, error) {
+		return nil, generateErr
+	}))
+	require.NoError(t, err)
+	require.NoError(t, server.RegisterPlugin(plugin))
+
+	generateErr = table.StatusError{Code: 13, Message: "permission denied"}
+	resp, err := ErrWrap{server}.Call(context.Background(), "table", "testTable", osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	require.NoError(t, err)
+	assert.Equal(t, &osquery.ExtensionStatus{Code: 13, Message: "permission denied"}, resp.Status)
+
+	// Wrapping doesn't hide the status
+	generateErr = fmt.Errorf("listing files: %w", &table.StatusError{Code: 11, Message: "try again"})
+	resp, err = ErrWrap{server}.Call(context.Background(), "table", "testTable", osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	require.NoError(t, err)
+	assert.Equal(t, &osquery.ExtensionStatus{Code: 11, Message: "try again"}, resp.Status)
+
+	generateErr = errors.New("foobar")
+	resp, err = ErrWrap{server}.Call(context.Background(), "table", "testTable", osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	require.NoError(t, err)
+	assert.Equal(t, &osquery.ExtensionStatus{Code: 1, Message: "error generating table: foobar"}, resp.Status)
+
+	// Partial errors succeed with the error as the message
+	generateErr = &table.PartialError{Err: errors.New("some rows missing")}
+	resp, err = ErrWrap{server}.Call(context.Background(), "table", "testTable", osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	require.NoError(t, err)
+	assert.Equal(t, &osquery.ExtensionStatus{Code: 0, Message: "some rows missing"}, resp.Status)
+}
+
+func TestCallPanic(t *testing.T) {
+	registry := make(map[string](map[string]OsqueryPlugin))
+	for reg, _ := range validRegistryNames {
+		registry[reg] = make(map[string]OsqueryPlugin)
+	}
+	var handled []error
+	var observed error
+	server := &ExtensionManagerServer{
+		registry:     registry,
+		errorHandler: func(err error) { handled = append(handled, err) },
+		callObserver: func(registry, plugin string, duration time.Duration, err error) { observed = err },
+	}
+
+	broken, err := table.NewPlugin("broken", struct{}{}, table.GenerateRows(func(context.Context, table.QueryContext) ([]table.RowDefinition, error) {
+		var rows []table.RowDefinition
+		return []table.RowDefinition{rows[1]}, nil
+	}))
+	require.NoError(t, err)
+	working, err := table.NewPlugin("working", struct{}{}, table.GenerateRows(func(context.Context, table.QueryContext) ([]table.RowDefinition, error) {
+		return []table.RowDefinition{struct{}{}}, nil
+	}))
+	require.NoError(t, err)
+	require.NoError(t, server.RegisterPlugin(broken, working))
+
+	resp, err := ErrWrap{server}.Call(context.Background(), "table", "broken", osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), resp.Status.Code)
+	assert.Contains(t, resp.Status.Message, "panic in table plugin broken: runtime error: index out of range")
+
+	// The stack trace is passed to the error handler, and the observer sees
+	// the call fail
+	require.Len(t, handled, 1)
+	var panicErr *PanicError
+	require.True(t, errors.As(handled[0], &panicErr))
+	assert.Contains(t, string(panicErr.Stack), "TestCallPanic")
+	assert.Equal(t, panicErr, observed)
+
+	// The panic is also logged with its stack trace when there's a logger
+	logger := &recordingLogger{}
+	ServerLogger(logger)(server)
+	_, err = server.Call(context.Background(), "table", "broken", osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	require.Error(t, err)
+	require.Len(t, logger.errors, 1)
+	logged := logger.errors[0]
+	assert.Equal(t, []interface{}{"plugin call panicked", "registry", "table", "plugin", "broken", "panic"}, logged[:6])
+	assert.Contains(t, logged[6], "index out of range")
+	assert.Equal(t, "stack", logged[7])
+	assert.Contains(t, logged[8], "TestCallPanic")
+
+	// Other plugins keep working
+	resp, err = ErrWrap{server}.Call(context.Background(), "table", "working", osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"})
+	require.NoError(t, err)
+	assert.Equal(t, int32(0), resp.Status.Code)
+	assert.NoError(t, server.Shutdown(context.Background()))
+}
+
+func TestRegisterInvalidRegistry(t *testing.T) {
+	registry := make(map[string](map[string]OsqueryPlugin))
+	for reg, _ := range validRegistryNames {
+		registry[reg] = make(map[string]OsqueryPlugin)
+	}
+	server := &ExtensionManagerServer{registry: registry}
+
+	err := server.RegisterPlugin(&pingPlugin{name: "foo", registry: "invalid"})
+	assert.EqualError(t, err, "invalid registry name: invalid")
+}
+
+func TestServerRegistries(t *testing.T) {
+	server := newExtensionManagerServer("test", "/tmp/test.em", ServerRegistries("custom", "table"))
+
+	plugin, err := table.NewPlugin("foo", struct {
+		Value string `column:"value"`
+	}{}, table.WithRegistry("custom"))
+	require.NoError(t, err)
+	require.NoError(t, server.RegisterPlugin(plugin))
+	assert.Contains(t, server.registry["custom"], "foo")
+	assert.Contains(t, server.genRegistry(), "custom")
+
+	// The standard registries are still available
+	require.NoError(t, server.RegisterPlugin(logger.NewPlugin("foo", nil)))
+
+	err = server.RegisterPlugin(&pingPlugin{name: "foo", registry: "other"})
+	assert.EqualError(t, err, "invalid registry name: other")
+}
+
+type failingStopServer struct {
+	thrift.TServer
+}
+
+func (failingStopServer) Stop() error {
+	return errors.New("boom")
+}
+
+func TestShutdownErrorHandler(t *testing.T) {
+	errc := make(chan error, 1)
+	server := &ExtensionManagerServer{
+		registry: map[string](map[string]OsqueryPlugin){},
+		server:   failingStopServer{},
+	}
+	ServerErrorHandler(func(err error) {
+		errc <- err
+	})(server)
+
+	require.NoError(t, server.Shutdown(context.Background()))
+	select {
+	case err := <-errc:
+		assert.EqualError(t, err, "stopping server: boom")
+	case <-time.After(time.Second):
+		t.Fatal("error handler not called")
+	}
+}
+
+func TestInMemoryTransportRoundTrip(t *testing.T) {
+	// osquery's extension manager socket
+	osqueryClient, osqueryServer := transport.NewInMemoryTransport()
+	var registered *osquery.InternalExtensionInfo
+	mock := &mock.ExtensionManager{
+		RegisterExtensionFunc: func(ctx context.Context, info *osquery.InternalExtensionInfo, registry osquery.ExtensionRegistry) (*osquery.ExtensionStatus, error) {
+			registered = info
+			return &osquery.ExtensionStatus{Code: 0, UUID: 1}, nil
+		},
+		ExtensionsFunc: func(ctx context.Context) (osquery.InternalExtensionList, error) {
+			return osquery.InternalExtensionList{}, nil
+		},
+	}
+	manager := thrift.NewTSimpleServer2(osquery.NewExtensionManagerProcessor(mock), osqueryServer)
+	require.NoError(t, manager.Listen())
+	go manager.AcceptLoop()
+	defer manager.Stop()
+
+	// The extension's socket, which osquery calls plugins over
+	extensionClient, extensionServer := transport.NewInMemoryTransport()
+	require.NoError(t, extensionServer.Listen())
+
+	server, err := NewExtensionManagerServer("inmemory", "unused",
+		ServerClientTransport(osqueryClient),
+		ServerListenTransport(extensionServer),
+	)
+	require.NoError(t, err)
+	defer server.serverClient.(*ExtensionManagerClient).Close()
+
+	type nameRow struct {
+		Name string `column:"name"`
+	}
+	plugin, err := table.NewPlugin("names", nameRow{}, table.GenerateRows(func(context.Context, table.QueryContext) ([]table.RowDefinition, error) {
+		return []table.RowDefinition{nameRow{Name: "alice"}}, nil
+	}))
+	require.NoError(t, err)
+	require.NoError(t, server.RegisterPlugin(plugin))
+
+	go server.Start()
+	server.waitStarted()
+	defer server.Shutdown(context.Background())
+	require.NotNil(t, registered)
+	assert.Equal(t, "inmemory", registered.Name)
+
+	client, err := NewClientFromTransport(extensionClient, time.Second)
+	require.NoError(t, err)
+	defer client.Close()
+
+	request := osquery.ExtensionPluginRequest{"action": "generate", "context": "{}"}
+	resp, err := client.Call(context.Background(), "table", "names", request)
+	require.NoError(t, err)
+	assert.Equal(t, int32(0), resp.Status.Code)
+	assert.Equal(t, osquery.ExtensionPluginResponse{{"name": "alice"}}, resp.Response)
+
+	// Reconnecting opens a new connection to the extension
+	client.reconnect()
+	resp, err = client.Call(context.Background(), "table", "names", request)
+	require.NoError(t, err)
+	assert.Equal(t, osquery.ExtensionPluginResponse{{"name": "alice"}}, resp.Response)
+}
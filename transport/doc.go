@@ -1,4 +1,5 @@
 // Package transport provides Thrift TTransport and TServerTransport
-// implementations for use on mac/linux (TSocket/TServerSocket) and Windows
-// (custom named pipe implementation).
+// implementations for use on mac/linux (unix domain sockets) and Windows
+// (custom named pipe implementation). TCP can be selected with a Kind for
+// bridging extensions to osquery across network namespaces.
 package transport
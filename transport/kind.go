@@ -0,0 +1,100 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/apache/thrift/lib/go/thrift"
+	"github.com/pkg/errors"
+)
+
+// Kind is the kind of connection used to communicate with osquery.
+type Kind int
+
+const (
+	// Socket connects over a unix domain socket, or a named pipe on
+	// Windows. This is the default and the only kind osquery supports.
+	Socket Kind = iota
+	// TCP connects over TCP to a host:port address. osquery itself doesn't
+	// support TCP extensions, so this is only useful when bridging the
+	// extension socket between network namespaces or for testing.
+	TCP
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Socket:
+		return "socket"
+	case TCP:
+		return "tcp"
+	default:
+		return fmt.Sprintf("Kind(%d)", int(k))
+	}
+}
+
+// OpenKind opens a connection of the given kind to the provided path, which is
+// a host:port address for TCP.
+func OpenKind(kind Kind, path string, timeout time.Duration) (*thrift.TSocket, error) {
+	switch kind {
+	case Socket:
+		return Open(path, timeout)
+	case TCP:
+		trans, err := thrift.NewTSocketTimeout(path, timeout, timeout)
+		if err != nil {
+			return nil, errors.Wrapf(err, "resolving address '%s'", path)
+		}
+		if err := trans.Open(); err != nil {
+			return nil, errors.Wrap(err, "opening tcp transport")
+		}
+		return trans, nil
+	default:
+		return nil, errors.Errorf("unsupported transport kind %s", kind)
+	}
+}
+
+// OpenServerKind returns a TServerTransport of the given kind listening on the
+// provided path, which is a host:port address for TCP. The listen options only
+// apply to sockets.
+func OpenServerKind(kind Kind, listenPath string, timeout time.Duration, opts ...ListenOption) (thrift.TServerTransport, error) {
+	switch kind {
+	case Socket:
+		return OpenServer(listenPath, timeout, opts...)
+	case TCP:
+		trans, err := thrift.NewTServerSocketTimeout(listenPath, timeout)
+		if err != nil {
+			return nil, errors.Wrapf(err, "resolving address '%s'", listenPath)
+		}
+		return trans, nil
+	default:
+		return nil, errors.Errorf("unsupported transport kind %s", kind)
+	}
+}
+
+// ExtensionPath returns the path an extension listens on once registered with
+// the extension manager at managerPath. For sockets this is the manager's
+// socket path with the extension's UUID appended, as osquery expects. For TCP
+// the extension listens on the manager's host, with the UUID added to the
+// manager's port.
+func ExtensionPath(kind Kind, managerPath string, uuid int64) (string, error) {
+	switch kind {
+	case Socket:
+		return fmt.Sprintf("%s.%d", managerPath, uuid), nil
+	case TCP:
+		host, portString, err := net.SplitHostPort(managerPath)
+		if err != nil {
+			return "", errors.Wrapf(err, "parsing address '%s'", managerPath)
+		}
+		port, err := strconv.ParseUint(portString, 10, 16)
+		if err != nil {
+			return "", errors.Wrapf(err, "parsing port of '%s'", managerPath)
+		}
+		if port+uint64(uuid) > 65535 {
+			return "", errors.Errorf("no port for extension %d of '%s'", uuid, managerPath)
+		}
+		return net.JoinHostPort(host, strconv.FormatUint(port+uint64(uuid), 10)), nil
+	default:
+		return "", errors.Errorf("unsupported transport kind %s", kind)
+	}
+}
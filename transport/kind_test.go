@@ -0,0 +1,31 @@
+package transport
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtensionPath(t *testing.T) {
+	path, err := ExtensionPath(Socket, "/var/osquery/osquery.em", 12)
+	require.NoError(t, err)
+	assert.Equal(t, "/var/osquery/osquery.em.12", path)
+
+	path, err = ExtensionPath(TCP, "localhost:9000", 12)
+	require.NoError(t, err)
+	assert.Equal(t, "localhost:9012", path)
+
+	path, err = ExtensionPath(TCP, "[::1]:9000", 1)
+	require.NoError(t, err)
+	assert.Equal(t, "[::1]:9001", path)
+
+	_, err = ExtensionPath(TCP, "/var/osquery/osquery.em", 1)
+	assert.Error(t, err)
+
+	_, err = ExtensionPath(TCP, "localhost:65535", 1)
+	assert.EqualError(t, err, "no port for extension 1 of 'localhost:65535'")
+
+	_, err = ExtensionPath(Kind(7), "localhost:9000", 1)
+	assert.EqualError(t, err, "unsupported transport kind Kind(7)")
+}
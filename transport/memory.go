@@ -0,0 +1,259 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/apache/thrift/lib/go/thrift"
+	"github.com/pkg/errors"
+)
+
+// inMemoryBacklog is the number of connections that can be opened to an
+// InMemoryServerTransport before they are accepted.
+const inMemoryBacklog = 16
+
+// NewInMemoryTransport returns a pair of transports connected in memory rather
+// than over a socket, for testing clients and servers without touching the
+// filesystem. The server transport is served like any other, for example with
+// thrift.NewTSimpleServer2, and the client transport is passed to
+// osquery.NewClientFromTransport.
+//
+// Each time the client transport is opened it is connected to the server with
+// a new net.Pipe, which the server returns from Accept. Like a socket, opening
+// the client fails if the server isn't listening, and closing and reopening it
+// makes a new connection, so reconnects and timeouts can be tested
+// deterministically.
+func NewInMemoryTransport() (*InMemoryTransport, *InMemoryServerTransport) {
+	server := &InMemoryServerTransport{}
+	return &InMemoryTransport{server: server}, server
+}
+
+// InMemoryTransport is one end of a connection made by NewInMemoryTransport. It
+// implements thrift.TTransport.
+type InMemoryTransport struct {
+	// server is the transport to connect to when opened, or nil for the
+	// server's end of an accepted connection, which can't be reopened.
+	server *InMemoryServerTransport
+
+	mu      sync.Mutex
+	conn    net.Conn
+	timeout time.Duration
+}
+
+// Open connects the transport to the server, which must be listening.
+func (p *InMemoryTransport) Open() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn != nil {
+		return thrift.NewTTransportException(thrift.ALREADY_OPEN, "in-memory transport already open")
+	}
+	if p.server == nil {
+		return thrift.NewTTransportException(thrift.NOT_OPEN, "cannot reopen accepted in-memory transport")
+	}
+
+	client, server := net.Pipe()
+	if err := p.server.connect(server); err != nil {
+		client.Close()
+		server.Close()
+		return err
+	}
+	p.conn = client
+	return nil
+}
+
+// IsOpen returns whether the transport is connected.
+func (p *InMemoryTransport) IsOpen() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.conn != nil
+}
+
+// Close closes the connection. The other end sees the transport as closed on
+// its next read or write.
+func (p *InMemoryTransport) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn == nil {
+		return nil
+	}
+	err := p.conn.Close()
+	p.conn = nil
+	return err
+}
+
+// Conn returns the underlying connection, or nil if the transport isn't open.
+func (p *InMemoryTransport) Conn() net.Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.conn
+}
+
+// SetSocketTimeout sets the timeout for each read and write, as for
+// thrift.TSocket. A timeout of 0 means reads and writes never time out.
+func (p *InMemoryTransport) SetSocketTimeout(timeout time.Duration) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.timeout = timeout
+	return nil
+}
+
+// pushDeadline returns the connection with the deadline for the next read or
+// write set.
+func (p *InMemoryTransport) pushDeadline(read bool) (net.Conn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn == nil {
+		return nil, thrift.NewTTransportException(thrift.NOT_OPEN, "in-memory transport not open")
+	}
+	var deadline time.Time
+	if p.timeout > 0 {
+		deadline = time.Now().Add(p.timeout)
+	}
+	if read {
+		p.conn.SetReadDeadline(deadline)
+	} else {
+		p.conn.SetWriteDeadline(deadline)
+	}
+	return p.conn, nil
+}
+
+func (p *InMemoryTransport) Read(buf []byte) (int, error) {
+	conn, err := p.pushDeadline(true)
+	if err != nil {
+		return 0, err
+	}
+	n, err := conn.Read(buf)
+	return n, thrift.NewTTransportExceptionFromError(err)
+}
+
+func (p *InMemoryTransport) Write(buf []byte) (int, error) {
+	conn, err := p.pushDeadline(false)
+	if err != nil {
+		return 0, err
+	}
+	// Unlike a socket, a pipe passes empty writes to the reader as empty
+	// reads, which thrift would mistake for a zero byte.
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	n, err := conn.Write(buf)
+	return n, thrift.NewTTransportExceptionFromError(err)
+}
+
+// Flush does nothing, as writes aren't buffered.
+func (p *InMemoryTransport) Flush(ctx context.Context) error {
+	return nil
+}
+
+// RemainingBytes returns the maximum value, as the number of bytes left to
+// read isn't known.
+func (p *InMemoryTransport) RemainingBytes() uint64 {
+	return ^uint64(0)
+}
+
+// InMemoryServerTransport accepts connections from the InMemoryTransport
+// returned with it by NewInMemoryTransport. It implements
+// thrift.TServerTransport.
+type InMemoryServerTransport struct {
+	mu          sync.Mutex
+	listening   bool
+	interrupted bool
+	conns       chan net.Conn
+	// stop is closed to unblock Accept when the transport stops listening.
+	stop chan struct{}
+}
+
+// Listen starts accepting connections.
+func (p *InMemoryServerTransport) Listen() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.listening {
+		return nil
+	}
+	p.listening = true
+	p.conns = make(chan net.Conn, inMemoryBacklog)
+	p.stop = make(chan struct{})
+	return nil
+}
+
+// connect queues the server's end of a new connection to be accepted.
+func (p *InMemoryServerTransport) connect(conn net.Conn) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.listening {
+		return thrift.NewTTransportException(thrift.NOT_OPEN, "in-memory transport not listening")
+	}
+	select {
+	case p.conns <- conn:
+		return nil
+	default:
+		return thrift.NewTTransportException(thrift.NOT_OPEN, "in-memory transport backlog full")
+	}
+}
+
+// Accept waits for the client transport to be opened, returning the server's
+// end of the connection.
+func (p *InMemoryServerTransport) Accept() (thrift.TTransport, error) {
+	p.mu.Lock()
+	interrupted := p.interrupted
+	listening := p.listening
+	conns, stop := p.conns, p.stop
+	p.mu.Unlock()
+
+	if interrupted {
+		return nil, errors.New("transport interrupted")
+	}
+	if !listening {
+		return nil, thrift.NewTTransportException(thrift.NOT_OPEN, "in-memory transport not listening")
+	}
+
+	select {
+	case conn := <-conns:
+		return &InMemoryTransport{conn: conn}, nil
+	case <-stop:
+		return nil, thrift.NewTTransportException(thrift.NOT_OPEN, "in-memory transport closed")
+	}
+}
+
+// Close stops listening, closing any connections that haven't been accepted.
+// Connections that have been accepted stay open.
+func (p *InMemoryServerTransport) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.close()
+	return nil
+}
+
+func (p *InMemoryServerTransport) close() {
+	if !p.listening {
+		return
+	}
+	p.listening = false
+	close(p.stop)
+	for {
+		select {
+		case conn := <-p.conns:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// Interrupt stops listening and causes any further calls to Accept to fail.
+func (p *InMemoryServerTransport) Interrupt() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.interrupted = true
+	p.close()
+	return nil
+}
@@ -0,0 +1,87 @@
+package transport
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/apache/thrift/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInMemoryTransport(t *testing.T) {
+	client, server := NewInMemoryTransport()
+
+	// Like a socket, the client can't connect until the server listens
+	assert.Error(t, client.Open())
+	assert.False(t, client.IsOpen())
+
+	require.NoError(t, server.Listen())
+	require.NoError(t, client.Open())
+	assert.True(t, client.IsOpen())
+	assert.Error(t, client.Open())
+
+	accepted, err := server.Accept()
+	require.NoError(t, err)
+
+	go func() {
+		client.Write([]byte("ping"))
+		client.Flush(context.Background())
+	}()
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(accepted, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+
+	// Closing the client is seen by the server as the end of the
+	// connection, and reopening it makes a new one
+	require.NoError(t, client.Close())
+	_, err = accepted.Read(buf)
+	require.Error(t, err)
+	assert.Equal(t, thrift.END_OF_FILE, err.(thrift.TTransportException).TypeId())
+
+	require.NoError(t, client.Open())
+	reconnected, err := server.Accept()
+	require.NoError(t, err)
+	assert.NotEqual(t, accepted, reconnected)
+	assert.Error(t, accepted.Open())
+}
+
+func TestInMemoryTransportTimeout(t *testing.T) {
+	client, server := NewInMemoryTransport()
+	require.NoError(t, server.Listen())
+	require.NoError(t, client.Open())
+	_, err := server.Accept()
+	require.NoError(t, err)
+
+	// Nothing is written by the server, so the read times out
+	require.NoError(t, client.SetSocketTimeout(10*time.Millisecond))
+	_, err = client.Read(make([]byte, 1))
+	require.Error(t, err)
+	assert.Equal(t, thrift.TIMED_OUT, err.(thrift.TTransportException).TypeId())
+}
+
+func TestInMemoryServerTransportInterrupt(t *testing.T) {
+	client, server := NewInMemoryTransport()
+	require.NoError(t, server.Listen())
+
+	accepted := make(chan error)
+	go func() {
+		_, err := server.Accept()
+		accepted <- err
+	}()
+
+	require.NoError(t, server.Interrupt())
+	select {
+	case err := <-accepted:
+		assert.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("accept not interrupted")
+	}
+
+	_, err := server.Accept()
+	assert.EqualError(t, err, "transport interrupted")
+	assert.Error(t, client.Open())
+}
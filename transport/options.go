@@ -0,0 +1,29 @@
+package transport
+
+import "os"
+
+// ListenOption configures the socket created by OpenServer.
+type ListenOption func(*listenConfig)
+
+type listenConfig struct {
+	mode    os.FileMode
+	backlog int
+}
+
+// SocketMode sets the file mode of the unix socket once it has been created,
+// which controls the users that are able to connect to it. By default the mode
+// is determined by the process umask. It has no effect on Windows.
+func SocketMode(mode os.FileMode) ListenOption {
+	return func(c *listenConfig) {
+		c.mode = mode
+	}
+}
+
+// ListenBacklog sets the maximum number of pending connections that the socket
+// will queue. By default the system maximum is used. It has no effect on
+// Windows.
+func ListenBacklog(backlog int) ListenOption {
+	return func(c *listenConfig) {
+		c.backlog = backlog
+	}
+}
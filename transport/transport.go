@@ -6,6 +6,8 @@ import (
 	"context"
 	"net"
 	"os"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/apache/thrift/lib/go/thrift"
@@ -36,13 +38,184 @@ func Open(sockPath string, timeout time.Duration) (*thrift.TSocket, error) {
 	return trans, nil
 }
 
-func OpenServer(listenPath string, timeout time.Duration) (*thrift.TServerSocket, error) {
+// OpenServer returns a TServerTransport listening on the unix domain socket
+// with the provided path. Any stale socket left at the path by a previous
+// process is removed when the transport starts listening.
+func OpenServer(listenPath string, timeout time.Duration, opts ...ListenOption) (*TServerSocket, error) {
 	addr, err := net.ResolveUnixAddr("unix", listenPath)
 	if err != nil {
 		return nil, errors.Wrapf(err, "resolving addr (%s)", addr)
 	}
 
-	return thrift.NewTServerSocketFromAddrTimeout(addr, 0), nil
+	config := listenConfig{}
+	for _, opt := range opts {
+		opt(&config)
+	}
+
+	return &TServerSocket{path: addr.Name, config: config}, nil
+}
+
+// TServerSocket is a unix domain socket implementation of the
+// thrift.TServerTransport interface. Unlike thrift.TServerSocket, it allows the
+// permissions and listen backlog of the socket to be set.
+type TServerSocket struct {
+	listener net.Listener
+	path     string
+	config   listenConfig
+
+	// Protects the listener and interrupted values to make them thread safe.
+	mu          sync.RWMutex
+	interrupted bool
+}
+
+// Listen creates the socket and starts listening for connections.
+func (p *TServerSocket) Listen() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.IsListening() {
+		return nil
+	}
+
+	if err := removeStaleSocket(p.path); err != nil {
+		return err
+	}
+
+	l, err := listenUnix(p.path, p.config.backlog)
+	if err != nil {
+		return errors.Wrapf(err, "listening on socket (%s)", p.path)
+	}
+
+	if p.config.mode != 0 {
+		if err := os.Chmod(p.path, p.config.mode); err != nil {
+			l.Close()
+			os.Remove(p.path)
+			return errors.Wrapf(err, "setting socket mode (%s)", p.path)
+		}
+	}
+
+	p.listener = l
+	return nil
+}
+
+// IsListening returns whether the server transport is currently listening.
+func (p *TServerSocket) IsListening() bool {
+	return p.listener != nil
+}
+
+// Accept wraps the standard net.Listener accept to return a thrift.TTransport.
+func (p *TServerSocket) Accept() (thrift.TTransport, error) {
+	p.mu.RLock()
+	interrupted := p.interrupted
+	listener := p.listener
+	p.mu.RUnlock()
+
+	if interrupted {
+		return nil, errors.New("transport interrupted")
+	}
+	if listener == nil {
+		return nil, thrift.NewTTransportException(thrift.NOT_OPEN, "no underlying socket listener")
+	}
+
+	conn, err := listener.Accept()
+	if err != nil {
+		return nil, thrift.NewTTransportExceptionFromError(err)
+	}
+	return thrift.NewTSocketFromConnTimeout(conn, 0), nil
+}
+
+// Close stops listening on the socket and removes it.
+func (p *TServerSocket) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.close()
+}
+
+func (p *TServerSocket) close() error {
+	if !p.IsListening() {
+		return nil
+	}
+	err := p.listener.Close()
+	p.listener = nil
+	// Listeners created with a custom backlog don't remove the socket
+	// when closed, so make sure it is always cleaned up.
+	if removeErr := os.Remove(p.path); removeErr != nil && !os.IsNotExist(removeErr) && err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+// Interrupt stops listening on the socket and causes any further calls to
+// Accept to fail.
+func (p *TServerSocket) Interrupt() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.interrupted = true
+	return p.close()
+}
+
+// removeStaleSocket removes a socket left at the path by a process which is no
+// longer listening on it, so that it doesn't cause "address already in use"
+// errors. Sockets which are still accepting connections are left alone.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "checking for stale socket (%s)", path)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return errors.Errorf("%s exists and is not a socket", path)
+	}
+
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return errors.Errorf("socket %s is already in use", path)
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "removing stale socket (%s)", path)
+	}
+	return nil
+}
+
+// listenUnix listens on a unix domain socket at the path. If backlog is
+// positive it is used as the maximum length of the queue of pending
+// connections, which net.Listen doesn't allow to be set.
+func listenUnix(path string, backlog int) (net.Listener, error) {
+	if backlog <= 0 {
+		return net.Listen("unix", path)
+	}
+
+	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	syscall.CloseOnExec(fd)
+
+	if err := syscall.Bind(fd, &syscall.SockaddrUnix{Name: path}); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	if err := syscall.Listen(fd, backlog); err != nil {
+		syscall.Close(fd)
+		os.Remove(path)
+		return nil, os.NewSyscallError("listen", err)
+	}
+
+	// FileListener duplicates the file descriptor, so the original can be
+	// closed once the listener has been created.
+	file := os.NewFile(uintptr(fd), path)
+	defer file.Close()
+	l, err := net.FileListener(file)
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return l, nil
 }
 
 func waitForSocket(sockPath string, timeout time.Duration) error {
@@ -0,0 +1,69 @@
+// +build !windows
+
+package transport
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerSocketOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "osquery-go-transport")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.em")
+
+	server, err := OpenServer(path, 0, SocketMode(0600), ListenBacklog(16))
+	require.NoError(t, err)
+	require.NoError(t, server.Listen())
+	assert.True(t, server.IsListening())
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	conn, err := net.Dial("unix", path)
+	require.NoError(t, err)
+	conn.Close()
+
+	// The socket is cleaned up when the server is closed
+	require.NoError(t, server.Close())
+	assert.False(t, server.IsListening())
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestServerSocketStaleSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "osquery-go-transport")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.em")
+
+	// Leave a socket behind with nothing listening on it
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	require.NoError(t, err)
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+	_, err = os.Stat(path)
+	require.NoError(t, err)
+
+	server, err := OpenServer(path, 0)
+	require.NoError(t, err)
+	require.NoError(t, server.Listen())
+
+	// A socket which is in use isn't removed
+	other, err := OpenServer(path, 0)
+	require.NoError(t, err)
+	assert.EqualError(t, other.Listen(), "socket "+path+" is already in use")
+	require.NoError(t, server.Interrupt())
+
+	// Nor is anything which isn't a socket
+	require.NoError(t, ioutil.WriteFile(path, nil, 0600))
+	assert.EqualError(t, other.Listen(), path+" exists and is not a socket")
+}
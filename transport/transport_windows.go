@@ -21,11 +21,16 @@ func Open(path string, timeout time.Duration) (*thrift.TSocket, error) {
 	return thrift.NewTSocketFromConnTimeout(conn, timeout), nil
 }
 
-func OpenServer(pipePath string, timeout time.Duration) (*TServerPipe, error) {
+// OpenServer returns a TServerTransport listening on the named pipe with the
+// provided path. osquery on Windows uses named pipes (eg. \\.\pipe\shell.em)
+// in place of unix domain sockets. The ListenOptions only apply to unix domain
+// sockets and are ignored.
+func OpenServer(pipePath string, timeout time.Duration, opts ...ListenOption) (*TServerPipe, error) {
 	return NewTServerPipeTimeout(pipePath, timeout)
 }
 
 // TServerPipe is a windows named pipe implementation of the
+// thrift.TServerTransport interface.
 type TServerPipe struct {
 	listener      net.Listener
 	pipePath      string
@@ -36,6 +41,8 @@ type TServerPipe struct {
 	interrupted bool
 }
 
+// NewTServerPipeTimeout creates a TServerPipe for the given path. The timeout
+// is applied to each accepted client connection.
 func NewTServerPipeTimeout(pipePath string, clientTimeout time.Duration) (*TServerPipe, error) {
 	return &TServerPipe{pipePath: pipePath, clientTimeout: clientTimeout}, nil
 }
@@ -72,6 +79,9 @@ func (p *TServerPipe) Accept() (thrift.TTransport, error) {
 	if interrupted {
 		return nil, errors.New("transport interrupted")
 	}
+	if listener == nil {
+		return nil, thrift.NewTTransportException(thrift.NOT_OPEN, "no underlying pipe listener")
+	}
 
 	conn, err := listener.Accept()
 	if err != nil {
@@ -80,23 +90,29 @@ func (p *TServerPipe) Accept() (thrift.TTransport, error) {
 	return thrift.NewTSocketFromConnTimeout(conn, p.clientTimeout), nil
 }
 
+// Close stops listening on the named pipe.
 func (p *TServerPipe) Close() error {
-	defer func() {
-		p.listener = nil
-	}()
-	if p.IsListening() {
-		return p.listener.Close()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.close()
+}
+
+func (p *TServerPipe) close() error {
+	if !p.IsListening() {
+		return nil
 	}
-	return nil
+	err := p.listener.Close()
+	p.listener = nil
+	return err
 }
 
-// Interrupt is a noop for this implementation
+// Interrupt stops listening on the named pipe and causes any further calls to
+// Accept to fail.
 func (p *TServerPipe) Interrupt() error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
 	p.interrupted = true
-	p.Close()
-
-	return nil
+	return p.close()
 }